@@ -25,6 +25,16 @@ If this isn't what you want please run:
 	return fmt.Sprintf(warning, strings.Join(goPackageSpec, " "))
 }
 
+func KibanaSettingOverride(envName string, value string) string {
+	warning := `Using $%s override.
+    $%s = %s
+
+If this isn't what you want please run:
+    cf unset-env <app> %s`
+
+	return fmt.Sprintf(warning, envName, envName, value, envName)
+}
+
 func GodirError() string {
 	errorMessage := `Deprecated, .godir file found! Please update to supported Godep or Glide dependency managers.
 See https://github.com/tools/godep or https://github.com/Masterminds/glide for usage information.`
@@ -0,0 +1,249 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Extensions are the file extensions of certificate files, in the order of their precedence
+var Extensions = []string{".crt", ".pem", ".cer"}
+
+// KeyExtensions are the file extensions of private key files, in the order of their precedence
+var KeyExtensions = []string{".key", ".pem"}
+
+// Find returns the file of the certificate name in dir, e.g. elasticsearch.pem for elasticsearch
+func Find(dir string, name string) (string, error) {
+	return find(dir, name, Extensions, "certificate")
+}
+
+// FindKey returns the file of the private key name in dir, e.g. client.key for client
+func FindKey(dir string, name string) (string, error) {
+	return find(dir, name, KeyExtensions, "key")
+}
+
+func find(dir string, name string, extensions []string, kind string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, ext := range extensions {
+		for _, f := range files {
+			if !f.IsDir() && strings.EqualFold(f.Name(), name+ext) {
+				return filepath.Join(dir, f.Name()), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s %s not found, expected one of %s%s", kind, name, name, strings.Join(extensions, ", "+name))
+}
+
+// Parse parses all certificates of a PEM bundle or of a DER encoded file
+func Parse(data []byte) ([]*x509.Certificate, error) {
+	certificates := []*x509.Certificate{}
+
+	rest := bytes.TrimSpace(data)
+	for len(rest) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block %s, only certificates are allowed", block.Type)
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) > 0 {
+		return certificates, nil
+	}
+
+	// no PEM blocks: DER encoded, as .cer files often are
+	certificates, err := x509.ParseCertificates(data)
+	if err != nil {
+		return nil, errors.New("neither PEM nor DER encoded certificates")
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certificates, nil
+}
+
+// Encode returns the certificates as PEM bundle
+func Encode(certificates []*x509.Certificate) []byte {
+	var out bytes.Buffer
+	for _, c := range certificates {
+		pem.Encode(&out, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return out.Bytes()
+}
+
+// Check returns an error if the certificate can not be used as CA (not a CA or expired)
+// and a warning if it expires within warnDays
+func Check(c *x509.Certificate, now time.Time, warnDays int) (warning string, err error) {
+	if !isCA(c) {
+		return "", fmt.Errorf("%s is not a CA certificate", c.Subject.CommonName)
+	}
+	return checkValidity(c, now, warnDays)
+}
+
+// CheckClient returns an error if the certificate can not be used for client authentication
+// (a CA, not allowed by its extended key usage or expired) and a warning if it expires within warnDays
+func CheckClient(c *x509.Certificate, now time.Time, warnDays int) (warning string, err error) {
+	return checkLeaf(c, x509.ExtKeyUsageClientAuth, "client", now, warnDays)
+}
+
+// CheckServer returns an error if the certificate can not be used for server authentication
+// (a CA, not allowed by its extended key usage or expired) and a warning if it expires within warnDays
+func CheckServer(c *x509.Certificate, now time.Time, warnDays int) (warning string, err error) {
+	return checkLeaf(c, x509.ExtKeyUsageServerAuth, "server", now, warnDays)
+}
+
+func checkLeaf(c *x509.Certificate, usage x509.ExtKeyUsage, kind string, now time.Time, warnDays int) (string, error) {
+	if c.BasicConstraintsValid && c.IsCA {
+		return "", fmt.Errorf("%s is a CA certificate, not a %s certificate", c.Subject.CommonName, kind)
+	}
+	if len(c.ExtKeyUsage) > 0 && !hasExtKeyUsage(c, usage) && !hasExtKeyUsage(c, x509.ExtKeyUsageAny) {
+		return "", fmt.Errorf("%s is not allowed for %s authentication (extended key usage)", c.Subject.CommonName, kind)
+	}
+	return checkValidity(c, now, warnDays)
+}
+
+// CheckKeyPair returns an error unless the PEM encoded private key is unencrypted and matches
+// the first of the PEM encoded certificates
+func CheckKeyPair(certPEM []byte, keyPEM []byte) error {
+	block, _ := pem.Decode(bytes.TrimSpace(keyPEM))
+	if block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return errors.New("no PEM encoded private key")
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		return errors.New("encrypted private keys are not supported")
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return errors.New(strings.TrimPrefix(err.Error(), "tls: "))
+	}
+	return nil
+}
+
+func hasExtKeyUsage(c *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range c.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+func checkValidity(c *x509.Certificate, now time.Time, warnDays int) (warning string, err error) {
+	if now.After(c.NotAfter) {
+		return "", fmt.Errorf("%s expired on %s", c.Subject.CommonName, c.NotAfter.Format("2006-01-02"))
+	}
+	if now.Before(c.NotBefore) {
+		return "", fmt.Errorf("%s is not valid before %s", c.Subject.CommonName, c.NotBefore.Format("2006-01-02"))
+	}
+	if days := int(c.NotAfter.Sub(now).Hours() / 24); days < warnDays {
+		return fmt.Sprintf("%s expires in %d days (%s)", c.Subject.CommonName, days, c.NotAfter.Format("2006-01-02")), nil
+	}
+	return "", nil
+}
+
+// isCA accepts CA certificates and legacy self-signed roots without basic constraints
+func isCA(c *x509.Certificate) bool {
+	if c.BasicConstraintsValid {
+		return c.IsCA
+	}
+	return c.CheckSignatureFrom(c) == nil
+}
+
+// Describe returns the subject, the SHA-256 fingerprint and the expiry date of a certificate
+func Describe(c *x509.Certificate) string {
+	return fmt.Sprintf("subject: %s, SHA-256 fingerprint: %s, expires: %s", subject(c), Fingerprint(c), c.NotAfter.Format("2006-01-02"))
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate in the usual colon separated hex notation
+func Fingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func subject(c *x509.Certificate) string {
+	parts := []string{}
+	if c.Subject.CommonName != "" {
+		parts = append(parts, "CN="+c.Subject.CommonName)
+	}
+	for _, o := range c.Subject.Organization {
+		parts = append(parts, "O="+o)
+	}
+	for _, country := range c.Subject.Country {
+		parts = append(parts, "C="+country)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// verification modes of the TLS connection to Elasticsearch, as elasticsearch.ssl.verificationMode
+const (
+	VerifyFull        = "full"        // certificate chain and host name
+	VerifyCertificate = "certificate" // certificate chain only
+	VerifyNone        = "none"
+)
+
+// A ConnectError is returned by VerifyServer if the server can not be reached
+type ConnectError struct {
+	Address string
+	Err     error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connecting to %s: %s", e.Address, e.Err.Error())
+}
+
+// VerifyServer connects to a TLS server (host:port) and verifies its certificate chain against the CA
+// certificates, or the system roots if there are none, and in mode full also the host name
+func VerifyServer(address string, cas []*x509.Certificate, mode string, timeout time.Duration) error {
+	if mode == VerifyNone {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return &ConnectError{Address: address, Err: err}
+	}
+	defer conn.Close()
+
+	peer := conn.ConnectionState().PeerCertificates
+	opts := x509.VerifyOptions{Intermediates: x509.NewCertPool()}
+	if len(cas) > 0 {
+		opts.Roots = x509.NewCertPool()
+		for _, c := range cas {
+			opts.Roots.AddCert(c)
+		}
+	}
+	for _, c := range peer[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if mode == VerifyFull {
+		opts.DNSName = host
+	}
+	_, err = peer[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,59 @@
+package config
+
+import "strings"
+
+// AliasFor returns the credential field names for a service: the first matching profile of the
+// Kibana file wins over the profiles of templates.yml, fields missing in the profile are taken
+// from the default alias. service may be nil if the service is not bound during staging.
+func (c TemplatesConfig) AliasFor(service *VcapService, overrides []AliasProfile) Alias {
+	if service != nil {
+		for _, profile := range append(append([]AliasProfile{}, overrides...), c.AliasProfiles...) {
+			if profile.Matches(*service) {
+				return profile.Alias.withDefaults(c.Alias)
+			}
+		}
+	}
+	return c.Alias
+}
+
+// Matches returns true if the service has one of the labels or tags of the profile
+func (p AliasProfile) Matches(service VcapService) bool {
+	return matching([]string{service.Label}, p.Labels) != "" || matching(service.Tags, p.Tags) != ""
+}
+
+// String describes the services the profile applies to
+func (p AliasProfile) String() string {
+	selectors := []string{}
+	for _, label := range p.Labels {
+		selectors = append(selectors, "label "+label)
+	}
+	for _, tag := range p.Tags {
+		selectors = append(selectors, "tag "+tag)
+	}
+	return strings.Join(selectors, "|")
+}
+
+func (a Alias) withDefaults(defaults Alias) Alias {
+	if a.CredentialsHostField == "" {
+		a.CredentialsHostField = defaults.CredentialsHostField
+	}
+	if a.CredentialsUsernameField == "" {
+		a.CredentialsUsernameField = defaults.CredentialsUsernameField
+	}
+	if a.CredentialsPasswordField == "" {
+		a.CredentialsPasswordField = defaults.CredentialsPasswordField
+	}
+	if a.CredentialsUriField == "" {
+		a.CredentialsUriField = defaults.CredentialsUriField
+	}
+	if a.CredentialsCaField == "" {
+		a.CredentialsCaField = defaults.CredentialsCaField
+	}
+	if a.CredentialsClientCertField == "" {
+		a.CredentialsClientCertField = defaults.CredentialsClientCertField
+	}
+	if a.CredentialsClientKeyField == "" {
+		a.CredentialsClientKeyField = defaults.CredentialsClientKeyField
+	}
+	return a
+}
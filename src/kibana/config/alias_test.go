@@ -0,0 +1,74 @@
+package config_test
+
+import (
+	conf "kibana/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AliasFor", func() {
+	var templates conf.TemplatesConfig
+
+	BeforeEach(func() {
+		templates = conf.TemplatesConfig{}
+		Expect(templates.Parse([]byte(`
+alias:
+  credentials-host-field: host
+  credentials-username-field: kibana_system_username
+  credentials-password-field: kibana_system_password
+  credentials-uri-field: uri
+alias-profiles:
+- labels: [user-provided]
+  alias:
+    credentials-username-field: username
+    credentials-password-field: password
+`))).To(Succeed())
+	})
+
+	It("uses the default alias for unbound or unmatched services", func() {
+		Expect(templates.AliasFor(nil, nil)).To(Equal(templates.Alias))
+		Expect(templates.AliasFor(&conf.VcapService{Label: "a9s-elasticsearch"}, nil)).To(Equal(templates.Alias))
+	})
+
+	It("uses the profile matching the label, with the defaults for missing fields", func() {
+		alias := templates.AliasFor(&conf.VcapService{Label: "user-provided"}, nil)
+		Expect(alias).To(Equal(conf.Alias{CredentialsHostField: "host", CredentialsUsernameField: "username", CredentialsPasswordField: "password", CredentialsUriField: "uri"}))
+	})
+
+	It("prefers the profiles of the Kibana file", func() {
+		kibana := conf.KibanaConfig{}
+		Expect(kibana.Parse([]byte(`
+alias-profiles:
+- tags: [legacy]
+  alias:
+    credentials-host-field: url
+`))).To(Succeed())
+		Expect(conf.ValidateKibanaFile([]byte("alias-profiles:\n- tags: [legacy]\n  alias:\n    credentials-host-field: url\n")).Errors).To(BeEmpty())
+
+		alias := templates.AliasFor(&conf.VcapService{Label: "user-provided", Tags: []string{"Legacy"}}, kibana.AliasProfiles)
+		Expect(alias.CredentialsHostField).To(Equal("url"))
+		Expect(alias.CredentialsUsernameField).To(Equal("kibana_system_username"))
+	})
+})
+
+var _ = Describe("Credential", func() {
+	It("returns credentials by name or by path", func() {
+		service := conf.VcapService{Credentials: map[string]interface{}{
+			"cacrt":   "ca",
+			"tls":     map[string]interface{}{"ca": "nested ca"},
+			"tls.key": "dotted name",
+		}}
+		value := func(field string) interface{} {
+			v, ok := service.Credential(field)
+			Expect(ok).To(BeTrue())
+			return v
+		}
+		Expect(value("cacrt")).To(Equal("ca"))
+		Expect(value("tls.ca")).To(Equal("nested ca"))
+		Expect(value("tls.key")).To(Equal("dotted name"))
+
+		_, ok := service.Credential("tls.cert")
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -5,30 +5,44 @@ import (
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"net/url"
 	"strings"
 )
 
 // [BP]/defaults/templates/templates.yml
 type TemplatesConfig struct {
-	Set         bool             `yaml:"-"`
-	Alias 		Alias            `yaml:"alias"`
-	Templates []Template         `yaml:"templates"`
+	Alias         Alias          `yaml:"alias"`
+	AliasProfiles []AliasProfile `yaml:"alias-profiles"`
+	Templates     []Template     `yaml:"templates"`
 }
 
 type Alias struct {
-	Set                      bool   `yaml:"-"`
-	CredentialsHostField     string `yaml:"credentials-host-field"`
-	CredentialsUsernameField string `yaml:"credentials-username-field"`
-	CredentialsPasswordField string `yaml:"credentials-password-field"`
+	CredentialsHostField       string `yaml:"credentials-host-field"`
+	CredentialsUsernameField   string `yaml:"credentials-username-field"`
+	CredentialsPasswordField   string `yaml:"credentials-password-field"`
+	CredentialsUriField        string `yaml:"credentials-uri-field"`
+	CredentialsCaField         string `yaml:"credentials-ca-field"` // may be a path like tls.ca
+	CredentialsClientCertField string `yaml:"credentials-client-cert-field"`
+	CredentialsClientKeyField  string `yaml:"credentials-client-key-field"`
 }
+
+// AliasProfile is the credential alias for the services with one of the labels or tags
+type AliasProfile struct {
+	Labels []string `yaml:"labels"`
+	Tags   []string `yaml:"tags"`
+	Alias  Alias    `yaml:"alias"`
+}
+
 type Template struct {
-	Name                string   `yaml:"name"`
-	Type                string   `yaml:"type"`
-	IsDefault           bool     `yaml:"is-default"`
-	IsFallback          bool     `yaml:"is-fallback"`
-	Tags                []string `yaml:"tags"`
-	Plugins             []string `yaml:"plugins"`
-	ServiceInstanceName string   `yaml:"-"`
+	Name                string    `yaml:"name"`
+	Type                string    `yaml:"type"`
+	IsDefault           bool      `yaml:"is-default"`
+	IsFallback          bool      `yaml:"is-fallback"`
+	Tags                []string  `yaml:"tags"`
+	Plugins             []string  `yaml:"plugins"`
+	Selection           Selection `yaml:"selection"`
+	Dir                 string    `yaml:"-"` // directory of the template files
+	ServiceInstanceName string    `yaml:"-"`
 }
 
 func (c *TemplatesConfig) Parse(data []byte) (err error) {
@@ -43,47 +57,70 @@ func (c *TemplatesConfig) Parse(data []byte) (err error) {
 
 // [APP]Kibana
 type KibanaConfig struct {
-	Set                   bool             `yaml:"-"`
-	Version               string           `yaml:"version"`
-	Plugins               []string         `yaml:"plugins"`
-	Certificates          []string         `yaml:"certificates"`
-	CmdArgs               string           `yaml:"cmd-args"`
-	NodeOpts              string           `yaml:"nodejs-options"`
-	ReservedMemory        int              `yaml:"reserved-memory"`
-	HeapPercentage        int              `yaml:"heap-percentage"`
-	ConfigCheck           bool             `yaml:"config-check"`
-	ConfigTemplates       []ConfigTemplate `yaml:"config-templates"`
-	EnableServiceFallback bool             `yaml:"enable-service-fallback"`
-//	XPack                 XPack            `yaml:"x-pack"`
-	Buildpack             Buildpack        `yaml:"buildpack"`
+	Version                      string            `yaml:"version"`
+	Plugins                      []Plugin          `yaml:"plugins"`
+	RemovePlugins                []string          `yaml:"remove-plugins"` // plugins of the Kibana distribution to remove
+	Certificates                 []string          `yaml:"certificates"`
+	CertificateExpiryWarningDays int               `yaml:"certificate-expiry-warning-days"`
+	SslVerification              string            `yaml:"ssl-verification"`
+	ClientCertificate            ClientCertificate `yaml:"client-certificate"`
+	ServerSsl                    ServerSsl         `yaml:"server-ssl"`
+	CmdArgs                      string            `yaml:"cmd-args"`
+	NodeOpts                     string            `yaml:"node-options"`
+	NodeOptsDeprecated           string            `yaml:"nodejs-options"` // deprecated spelling of node-options
+	ReservedMemory               int               `yaml:"reserved-memory"`
+	HeapPercentage               int               `yaml:"heap-percentage"`
+	OptimizeHeapSize             int               `yaml:"optimize-heap-size"` // MB, calculated from the staging memory if 0
+	ConfigCheck                  bool              `yaml:"config-check"`
+	ConfigTemplates              []ConfigTemplate  `yaml:"config-templates"`
+	EnableServiceFallback        bool              `yaml:"enable-service-fallback"`
+	AliasProfiles                []AliasProfile    `yaml:"alias-profiles"`
+	TemplatesDir                 string            `yaml:"templates-dir"`
+	Auth                         Auth              `yaml:"auth"`
+	Buildpack                    Buildpack         `yaml:"buildpack"`
 }
 
 type Buildpack struct {
-    Set                   bool 			   `yaml:"-"`
-	LogLevel              string           `yaml:"log-level"`
-	NoCache               bool             `yaml:"no-cache"`
-	DoSleepCommand        bool             `yaml:"sleep-command"`
+	LogLevel       string `yaml:"log-level"`
+	NoCache        bool   `yaml:"no-cache"`
+	Offline        bool   `yaml:"offline"` // no downloads, all dependencies and plugins must be cached or in the app
+	DoSleepCommand bool   `yaml:"sleep-command"`
 }
 
-type ConfigTemplate struct {
-	Name                string `yaml:"name"`
-	ServiceInstanceName string `yaml:"service-instance-name"`
+// ClientCertificate names the files of the client certificate for the connection to Elasticsearch
+// in the certificates folder of the app, without file extension
+type ClientCertificate struct {
+	Certificate string `yaml:"certificate"`
+	Key         string `yaml:"key"`
 }
 
-/*
-type XPack struct {
-	Set        bool           `yaml:"-"`
-	Monitoring XPackComponent `yaml:"monitoring"`
-	Management XPackComponent `yaml:"management"`
+// ServerSsl enables TLS for the Kibana server with the CF instance identity certificate, or with the
+// server certificate of the app (files in the certificates folder, without file extension)
+type ServerSsl struct {
+	Enabled     bool   `yaml:"enabled"`
+	Certificate string `yaml:"certificate"`
+	Key         string `yaml:"key"`
 }
 
-type XPackComponent struct {
-	Set      bool   `yaml:"-"`
-	Enabled  bool   `yaml:"enabled"`
-	Interval string `yaml:"interval"`
+// Auth configures the authentication proxy in front of Kibana, the secrets are taken from the
+// credentials of the service: users (basic) or client_id and client_secret (oidc)
+type Auth struct {
+	Type         string   `yaml:"type"`          // basic or oidc, no proxy if empty
+	Service      string   `yaml:"service"`       // service instance with the credentials, e.g. a user-provided service
+	Issuer       string   `yaml:"issuer"`        // oidc: issuer URL, e.g. https://uaa.example.com/oauth/token of the UAA
+	Scopes       []string `yaml:"scopes"`        // oidc: additional scopes, openid is always requested
+	AllowedUsers []string `yaml:"allowed-users"` // oidc: user names or emails allowed to log in, any user of the issuer if empty
 }
-*/
 
+const (
+	AuthBasic = "basic"
+	AuthOidc  = "oidc"
+)
+
+type ConfigTemplate struct {
+	Name                string `yaml:"name"`
+	ServiceInstanceName string `yaml:"service-instance-name"`
+}
 
 func (c *KibanaConfig) Parse(data []byte) (err error) {
 	defer func() {
@@ -156,9 +193,58 @@ func (s *VcapServices) WithTags(tags []string) []VcapService {
 	return result
 }
 
+// WithName returns the service instance with the given name, nil if it is not bound
+func (s *VcapServices) WithName(name string) *VcapService {
+	for _, service_instances := range *s {
+		for i := range service_instances {
+			if service_instances[i].Name == name {
+				return &service_instances[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Endpoint returns the url of the service from the host field of the alias, or from the uri field without user info
+func (s VcapService) Endpoint(alias Alias) string {
+	if host, ok := s.Credential(alias.CredentialsHostField); ok {
+		return fmt.Sprintf("%v", host)
+	}
+	uri, ok := s.Credentials[alias.CredentialsUriField].(string)
+	if !ok {
+		return ""
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
+
+// Credential returns a credential of the service, field is either the name of a credential
+// or the path to a nested credential like tls.ca
+func (s VcapService) Credential(field string) (interface{}, bool) {
+	if value, ok := s.Credentials[field]; ok {
+		return value, true
+	}
+
+	var value interface{} = s.Credentials
+	for _, name := range strings.Split(field, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
 func (s *VcapServices) UserProvided() []VcapService {
 	result := []VcapService{}
-	for service , service_instances := range *s {
+	for service, service_instances := range *s {
 		if service == "user-provided" {
 			for i := range service_instances {
 				service_instance := service_instances[i]
@@ -170,7 +256,6 @@ func (s *VcapServices) UserProvided() []VcapService {
 	return result
 }
 
-
 func (c *VcapServices) Parse(data []byte) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Plugin is an entry of plugins in the Kibana file: a plain plugin name, or a structured entry
+// with the archive of the plugin and its checksum
+type Plugin struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"` // expected version of the plugin
+	Url     string `yaml:"url"`     // archive to download
+	File    string `yaml:"file"`    // archive in the app, e.g. plugins/my-plugin-6.1.3.zip
+	Sha256  string `yaml:"sha256"`  // checksum of the archive, required for url
+}
+
+// UnmarshalYAML accepts plain plugin names as well as structured entries
+func (p *Plugin) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*p = Plugin{Name: name}
+		return nil
+	}
+	type plain Plugin
+	return unmarshal((*plain)(p))
+}
+
+func (p Plugin) String() string {
+	switch {
+	case p.Url != "":
+		return p.Name + " (" + p.Url + ")"
+	case p.File != "":
+		return p.Name + " (" + p.File + ")"
+	}
+	return p.Name
+}
+
+// Validate checks that the plugin has a name, at most one source and a checksum for downloads
+func (p Plugin) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("plugin %s: name missing", p.String())
+	}
+	if p.Url != "" && p.File != "" {
+		return fmt.Errorf("plugin %s: either url or file, not both", p.Name)
+	}
+	if p.Url != "" {
+		if u, err := url.Parse(p.Url); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("plugin %s: invalid url '%s'", p.Name, p.Url)
+		}
+		if p.Sha256 == "" {
+			return fmt.Errorf("plugin %s: sha256 is required for downloads", p.Name)
+		}
+	}
+	if p.File != "" && (filepath.IsAbs(p.File) || strings.HasPrefix(filepath.Clean(p.File), "..")) {
+		return fmt.Errorf("plugin %s: file must be relative to the app directory, got '%s'", p.Name, p.File)
+	}
+	if p.Sha256 != "" {
+		if sum, err := hex.DecodeString(p.Sha256); err != nil || len(sum) != 32 {
+			return fmt.Errorf("plugin %s: sha256 must be 64 hex digits", p.Name)
+		}
+	}
+	return nil
+}
+
+// PluginNames returns the names of the plugins
+func PluginNames(plugins []Plugin) []string {
+	names := []string{}
+	for _, p := range plugins {
+		names = append(names, p.Name)
+	}
+	return names
+}
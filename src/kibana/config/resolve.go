@@ -0,0 +1,329 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Source tells where the effective value of a Kibana file setting comes from
+type Source string
+
+const (
+	SourceDefault     Source = "default"
+	SourceKibanaFile  Source = "Kibana file"
+	SourceEnvironment Source = "environment"
+)
+
+// A Layer sets some settings of the KibanaConfig and returns their keys
+type Layer interface {
+	Source() Source
+	Apply(c *KibanaConfig) ([]string, error)
+}
+
+// Resolved is the effective KibanaConfig together with the origin of every setting
+type Resolved struct {
+	Config  KibanaConfig
+	Origins map[string]Source
+}
+
+// Setting is a single resolved setting, used to show the resolved configuration
+type Setting struct {
+	Key    string
+	Value  string
+	Source Source
+}
+
+// Resolve applies the layers in order, later layers win
+func Resolve(layers ...Layer) (Resolved, error) {
+	r := Resolved{Origins: map[string]Source{}}
+
+	for _, layer := range layers {
+		keys, err := layer.Apply(&r.Config)
+		if err != nil {
+			return r, err
+		}
+		for _, key := range keys {
+			r.Origins[key] = layer.Source()
+		}
+	}
+	return r, nil
+}
+
+// Origin returns the source of a setting
+func (r Resolved) Origin(key string) Source {
+	if source, ok := r.Origins[key]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// Settings lists all settings of the resolved config in the order of the KibanaConfig struct
+func (r Resolved) Settings() []Setting {
+	settings := []Setting{}
+	for _, key := range SettingKeys() {
+		settings = append(settings, Setting{Key: key, Value: formatValue(settingValue(&r.Config, key)), Source: r.Origin(key)})
+	}
+	return settings
+}
+
+// SettingKeys returns the dotted keys of all (non deprecated) Kibana file settings
+func SettingKeys() []string {
+	return settingKeys(reflect.TypeOf(KibanaConfig{}), "")
+}
+
+func settingKeys(t reflect.Type, prefix string) []string {
+	keys := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if _, deprecated := deprecatedKeys[name]; deprecated && prefix == "" {
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct {
+			keys = append(keys, settingKeys(f.Type, joinKey(prefix, name))...)
+			continue
+		}
+		keys = append(keys, joinKey(prefix, name))
+	}
+	return keys
+}
+
+// settingValue returns the (addressable) field of a setting, or an invalid value for unknown keys
+func settingValue(c *KibanaConfig, key string) reflect.Value {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}
+		}
+		field, ok := yamlFields(v.Type())[name]
+		if !ok {
+			return reflect.Value{}
+		}
+		v = v.FieldByIndex(field.Index)
+	}
+	return v
+}
+
+func formatValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return ""
+	}
+	switch value := v.Interface().(type) {
+	case string:
+		return fmt.Sprintf("%q", value)
+	case []string:
+		return "[" + strings.Join(value, ", ") + "]"
+	case []ConfigTemplate:
+		templates := []string{}
+		for _, t := range value {
+			if t.ServiceInstanceName != "" {
+				templates = append(templates, t.Name+" ("+t.ServiceInstanceName+")")
+			} else {
+				templates = append(templates, t.Name)
+			}
+		}
+		return "[" + strings.Join(templates, ", ") + "]"
+	case []Plugin:
+		plugins := []string{}
+		for _, p := range value {
+			plugins = append(plugins, p.String())
+		}
+		return "[" + strings.Join(plugins, ", ") + "]"
+	case []AliasProfile:
+		profiles := []string{}
+		for _, p := range value {
+			profiles = append(profiles, p.String())
+		}
+		return "[" + strings.Join(profiles, ", ") + "]"
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// DefaultsLayer sets all settings to the buildpack defaults
+type DefaultsLayer struct {
+	Config KibanaConfig
+}
+
+func (l DefaultsLayer) Source() Source {
+	return SourceDefault
+}
+
+func (l DefaultsLayer) Apply(c *KibanaConfig) ([]string, error) {
+	*c = l.Config
+	return SettingKeys(), nil
+}
+
+// FileLayer sets the settings present in the Kibana file, explicit zero values included
+type FileLayer struct {
+	Data []byte
+}
+
+func (l FileLayer) Source() Source {
+	return SourceKibanaFile
+}
+
+func (l FileLayer) Apply(c *KibanaConfig) ([]string, error) {
+	previous := *c
+	if err := c.Parse(l.Data); err != nil {
+		return nil, err
+	}
+
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(l.Data, &doc); err != nil {
+		return nil, err
+	}
+
+	// empty values (e.g. "heap-percentage:") are parsed as zero values, they keep the previous value
+	keepPrevious := func(key string) {
+		if v := settingValue(c, key); v.IsValid() {
+			v.Set(settingValue(&previous, key))
+		}
+	}
+
+	keys := []string{}
+	for _, item := range doc {
+		name := fmt.Sprintf("%v", item.Key)
+		if item.Value == nil {
+			keepPrevious(name)
+			continue
+		}
+		if nested, ok := item.Value.(yaml.MapSlice); ok {
+			for _, nestedItem := range nested {
+				key := joinKey(name, fmt.Sprintf("%v", nestedItem.Key))
+				if nestedItem.Value == nil {
+					keepPrevious(key)
+					continue
+				}
+				keys = append(keys, key)
+			}
+			continue
+		}
+		if replacement, deprecated := deprecatedKeys[name]; deprecated {
+			if !hasKey(doc, replacement) {
+				settingValue(c, replacement).Set(settingValue(c, name))
+				keys = append(keys, replacement)
+			}
+			continue
+		}
+		keys = append(keys, name)
+	}
+	return keys, nil
+}
+
+func hasKey(doc yaml.MapSlice, name string) bool {
+	for _, item := range doc {
+		if fmt.Sprintf("%v", item.Key) == name && item.Value != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// EnvPrefix is the prefix of the environment variables overriding Kibana file settings
+const EnvPrefix = "KIBANA_BP_"
+
+// EnvName returns the environment variable overriding a setting,
+// e.g. KIBANA_BP_BUILDPACK_LOG_LEVEL for buildpack.log-level
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// EnvironmentLayer sets settings from KIBANA_BP_* environment variables
+type EnvironmentLayer struct {
+	Lookup func(string) (string, bool)
+}
+
+func (l EnvironmentLayer) Source() Source {
+	return SourceEnvironment
+}
+
+func (l EnvironmentLayer) Apply(c *KibanaConfig) ([]string, error) {
+	lookup := l.Lookup
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+
+	keys := []string{}
+	for _, key := range SettingKeys() {
+		name := EnvName(key)
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setFromString(settingValue(c, key), key, value); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// setFromString sets a setting from its environment variable representation:
+// lists are comma separated, config templates are written as name[:service-instance-name]
+func setFromString(v reflect.Value, key string, value string) error {
+	value = strings.TrimSpace(value)
+
+	switch v.Interface().(type) {
+	case string:
+		if message := CheckValue(key, value); message != "" {
+			return errors.New(message)
+		}
+		v.SetString(value)
+	case int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be an integer, got '%s'", value)
+		}
+		if message := CheckValue(key, i); message != "" {
+			return errors.New(message)
+		}
+		v.SetInt(int64(i))
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be true or false, got '%s'", value)
+		}
+		v.SetBool(b)
+	case []string:
+		v.Set(reflect.ValueOf(splitList(value)))
+	case []Plugin:
+		plugins := []Plugin{}
+		for _, name := range splitList(value) {
+			plugins = append(plugins, Plugin{Name: name})
+		}
+		v.Set(reflect.ValueOf(plugins))
+	case []ConfigTemplate:
+		templates := []ConfigTemplate{}
+		for _, entry := range splitList(value) {
+			parts := strings.SplitN(entry, ":", 2)
+			t := ConfigTemplate{Name: strings.TrimSpace(parts[0])}
+			if len(parts) == 2 {
+				t.ServiceInstanceName = strings.TrimSpace(parts[1])
+			}
+			templates = append(templates, t)
+		}
+		v.Set(reflect.ValueOf(templates))
+	default:
+		return fmt.Errorf("can not be set from the environment")
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
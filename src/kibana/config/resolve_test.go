@@ -0,0 +1,151 @@
+package config_test
+
+import (
+	conf "kibana/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resolve", func() {
+	var (
+		defaults conf.KibanaConfig
+		env      map[string]string
+	)
+
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	BeforeEach(func() {
+		defaults = conf.KibanaConfig{
+			ReservedMemory: 300,
+			HeapPercentage: 90,
+			Buildpack:      conf.Buildpack{LogLevel: "Info"},
+		}
+		env = map[string]string{}
+	})
+
+	It("keeps the defaults for settings missing in the Kibana file", func() {
+		resolved, err := conf.Resolve(
+			conf.DefaultsLayer{Config: defaults},
+			conf.FileLayer{Data: []byte("version: 6.1.3\n")},
+			conf.EnvironmentLayer{Lookup: lookup})
+		Expect(err).To(BeNil())
+
+		Expect(resolved.Config.Version).To(Equal("6.1.3"))
+		Expect(resolved.Config.HeapPercentage).To(Equal(90))
+		Expect(resolved.Origin("version")).To(Equal(conf.SourceKibanaFile))
+		Expect(resolved.Origin("heap-percentage")).To(Equal(conf.SourceDefault))
+		Expect(resolved.Origin("buildpack.log-level")).To(Equal(conf.SourceDefault))
+	})
+
+	It("distinguishes explicit zero values from defaults", func() {
+		resolved, err := conf.Resolve(
+			conf.DefaultsLayer{Config: defaults},
+			conf.FileLayer{Data: []byte("reserved-memory: 0\nbuildpack:\n  no-cache: false\n")})
+		Expect(err).To(BeNil())
+
+		Expect(resolved.Config.ReservedMemory).To(Equal(0))
+		Expect(resolved.Origin("reserved-memory")).To(Equal(conf.SourceKibanaFile))
+		Expect(resolved.Origin("buildpack.no-cache")).To(Equal(conf.SourceKibanaFile))
+		Expect(resolved.Config.Buildpack.LogLevel).To(Equal("Info"))
+	})
+
+	It("keeps the defaults for settings with an empty value", func() {
+		resolved, err := conf.Resolve(
+			conf.DefaultsLayer{Config: defaults},
+			conf.FileLayer{Data: []byte("heap-percentage:\nbuildpack:\n  log-level:\n")})
+		Expect(err).To(BeNil())
+
+		Expect(resolved.Config.HeapPercentage).To(Equal(90))
+		Expect(resolved.Config.Buildpack.LogLevel).To(Equal("Info"))
+		Expect(resolved.Origin("heap-percentage")).To(Equal(conf.SourceDefault))
+		Expect(resolved.Origin("buildpack.log-level")).To(Equal(conf.SourceDefault))
+	})
+
+	It("honors the deprecated nodejs-options key", func() {
+		resolved, err := conf.Resolve(
+			conf.DefaultsLayer{Config: defaults},
+			conf.FileLayer{Data: []byte("nodejs-options: --trace-warnings\n")})
+		Expect(err).To(BeNil())
+
+		Expect(resolved.Config.NodeOpts).To(Equal("--trace-warnings"))
+		Expect(resolved.Origin("node-options")).To(Equal(conf.SourceKibanaFile))
+	})
+
+	It("lets the environment win", func() {
+		env["KIBANA_BP_BUILDPACK_LOG_LEVEL"] = "debug"
+		resolved, err := conf.Resolve(
+			conf.DefaultsLayer{Config: defaults},
+			conf.FileLayer{Data: []byte("buildpack:\n  log-level: Info\n")},
+			conf.EnvironmentLayer{Lookup: lookup})
+		Expect(err).To(BeNil())
+
+		Expect(resolved.Config.Buildpack.LogLevel).To(Equal("debug"))
+		Expect(resolved.Origin("buildpack.log-level")).To(Equal(conf.SourceEnvironment))
+	})
+
+	It("maps every setting to a KIBANA_BP_* environment variable", func() {
+		env["KIBANA_BP_VERSION"] = "6.2"
+		env["KIBANA_BP_HEAP_PERCENTAGE"] = "60"
+		env["KIBANA_BP_CMD_ARGS"] = "--verbose"
+		env["KIBANA_BP_PLUGINS"] = "x-pack, my-plugin"
+		env["KIBANA_BP_CONFIG_TEMPLATES"] = "cf-kibana:my-es,cf-certificates"
+		env["KIBANA_BP_BUILDPACK_LOG_LEVEL"] = "debug"
+		resolved, err := conf.Resolve(
+			conf.DefaultsLayer{Config: defaults},
+			conf.FileLayer{Data: []byte("version: 6.1.3\nheap-percentage: 75\n")},
+			conf.EnvironmentLayer{Lookup: lookup})
+		Expect(err).To(BeNil())
+
+		Expect(resolved.Config.Version).To(Equal("6.2"))
+		Expect(resolved.Config.HeapPercentage).To(Equal(60))
+		Expect(resolved.Config.CmdArgs).To(Equal("--verbose"))
+		Expect(resolved.Config.Plugins).To(Equal([]conf.Plugin{{Name: "x-pack"}, {Name: "my-plugin"}}))
+		Expect(resolved.Config.ConfigTemplates).To(Equal([]conf.ConfigTemplate{{Name: "cf-kibana", ServiceInstanceName: "my-es"}, {Name: "cf-certificates"}}))
+		Expect(resolved.Config.Buildpack.LogLevel).To(Equal("debug"))
+		Expect(resolved.Origin("heap-percentage")).To(Equal(conf.SourceEnvironment))
+		Expect(resolved.Origin("reserved-memory")).To(Equal(conf.SourceDefault))
+	})
+
+	It("lets the environment force the offline mode over the Kibana file", func() {
+		env["KIBANA_BP_BUILDPACK_OFFLINE"] = "true"
+		resolved, err := conf.Resolve(
+			conf.DefaultsLayer{Config: defaults},
+			conf.FileLayer{Data: []byte("buildpack:\n  offline: false\n")},
+			conf.EnvironmentLayer{Lookup: lookup})
+		Expect(err).To(BeNil())
+		Expect(resolved.Config.Buildpack.Offline).To(BeTrue())
+		Expect(resolved.Origin("buildpack.offline")).To(Equal(conf.SourceEnvironment))
+	})
+
+	It("rejects invalid environment values", func() {
+		env["KIBANA_BP_RESERVED_MEMORY"] = "-1"
+		_, err := conf.Resolve(conf.DefaultsLayer{Config: defaults}, conf.EnvironmentLayer{Lookup: lookup})
+		Expect(err).To(MatchError("KIBANA_BP_RESERVED_MEMORY: must be greater than 0, got -1"))
+
+		env["KIBANA_BP_RESERVED_MEMORY"] = "much"
+		_, err = conf.Resolve(conf.DefaultsLayer{Config: defaults}, conf.EnvironmentLayer{Lookup: lookup})
+		Expect(err).To(MatchError("KIBANA_BP_RESERVED_MEMORY: must be an integer, got 'much'"))
+
+		delete(env, "KIBANA_BP_RESERVED_MEMORY")
+		env["KIBANA_BP_AUTH_TYPE"] = "ldap"
+		_, err = conf.Resolve(conf.DefaultsLayer{Config: defaults}, conf.EnvironmentLayer{Lookup: lookup})
+		Expect(err).To(MatchError("KIBANA_BP_AUTH_TYPE: must be basic or oidc, got 'ldap'"))
+	})
+
+	It("lists every setting with its source", func() {
+		resolved, err := conf.Resolve(
+			conf.DefaultsLayer{Config: defaults},
+			conf.FileLayer{Data: []byte("plugins:\n- x-pack\n")})
+		Expect(err).To(BeNil())
+
+		Expect(resolved.Settings()).To(ContainElement(conf.Setting{Key: "plugins", Value: "[x-pack]", Source: conf.SourceKibanaFile}))
+		Expect(resolved.Settings()).To(ContainElement(conf.Setting{Key: "heap-percentage", Value: "90", Source: conf.SourceDefault}))
+		for _, setting := range resolved.Settings() {
+			Expect(setting.Key).NotTo(Equal("nodejs-options"))
+		}
+	})
+})
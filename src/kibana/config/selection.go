@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Selection holds the rules of a template in templates.yml which select the service instance
+// the template is bound to. A service is a candidate if it matches one of the tags of the template,
+// one of the labels or the name pattern. Plans and credentials restrict the candidates further.
+type Selection struct {
+	Labels      []string `yaml:"labels"`      // service labels (offering names), e.g. a9s-elasticsearch
+	Plans       []string `yaml:"plans"`       // allowed service plans, any plan if empty
+	Name        string   `yaml:"name"`        // regular expression matched against the service instance name
+	Credentials []string `yaml:"credentials"` // credential fields the service must provide
+	TieBreaker  string   `yaml:"tie-breaker"` // "error" (default) or "name": the first service in alphabetical order wins
+}
+
+const (
+	TieBreakerError = "error"
+	TieBreakerName  = "name"
+)
+
+// A Candidate is a service instance considered for a template, with the reasons why it was considered
+type Candidate struct {
+	Service VcapService
+	Reasons []string
+}
+
+func (c Candidate) String() string {
+	return fmt.Sprintf("%s (label '%s', plan '%s'): %s", c.Service.Name, c.Service.Label, c.Service.Plan, strings.Join(c.Reasons, ", "))
+}
+
+// AmbiguousServicesError is returned if the selection rules of a template match more than one service
+type AmbiguousServicesError struct {
+	Template   string
+	Candidates []Candidate
+}
+
+func (e *AmbiguousServicesError) Error() string {
+	services := []string{}
+	for _, c := range e.Candidates {
+		services = append(services, c.String())
+	}
+	return fmt.Sprintf("more than one service found for template %s: %s", e.Template, strings.Join(services, "; "))
+}
+
+// BindsService returns true if the template is bound to a service instance.
+// Fallback templates are used if no service is bound, their tags only relate them to other templates.
+func (t Template) BindsService() bool {
+	return !t.IsFallback && len(t.Tags) > 0 || len(t.Selection.Labels) > 0 || t.Selection.Name != ""
+}
+
+// SelectionHint describes the services which match the rules of the template
+func (t Template) SelectionHint() string {
+	hints := []string{}
+	if len(t.Tags) > 0 {
+		hints = append(hints, "tag '"+strings.Join(t.Tags, "' or '")+"'")
+	}
+	if len(t.Selection.Labels) > 0 {
+		hints = append(hints, "label '"+strings.Join(t.Selection.Labels, "' or '")+"'")
+	}
+	if t.Selection.Name != "" {
+		hints = append(hints, "a name matching '"+t.Selection.Name+"'")
+	}
+	return strings.Join(hints, " or ")
+}
+
+// Validate checks the type and the selection rules of the template
+func (t Template) Validate() error {
+	if matching([]string{t.TemplateType()}, templateTypes) == "" {
+		return fmt.Errorf("template %s: invalid type '%s', must be one of %s", t.Name, t.Type, strings.Join(templateTypes, ", "))
+	}
+	if _, err := regexp.Compile(t.Selection.Name); err != nil {
+		return fmt.Errorf("template %s: invalid name pattern '%s': %s", t.Name, t.Selection.Name, err.Error())
+	}
+	switch t.Selection.TieBreaker {
+	case "", TieBreakerError, TieBreakerName:
+	default:
+		return fmt.Errorf("template %s: invalid tie-breaker '%s', must be %s or %s", t.Name, t.Selection.TieBreaker, TieBreakerError, TieBreakerName)
+	}
+	return nil
+}
+
+// Candidates returns the services matching the selection rules of the template,
+// ordered by the number of matching rules and then by name
+func (t Template) Candidates(services VcapServices) ([]Candidate, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	var namePattern *regexp.Regexp
+	if t.Selection.Name != "" {
+		namePattern = regexp.MustCompile(t.Selection.Name)
+	}
+
+	candidates := []Candidate{}
+	for _, instances := range services {
+		for _, service := range instances {
+			reasons := []string{}
+			if tag := matching(service.Tags, t.Tags); tag != "" {
+				reasons = append(reasons, fmt.Sprintf("tag '%s'", tag))
+			}
+			if label := matching([]string{service.Label}, t.Selection.Labels); label != "" {
+				reasons = append(reasons, fmt.Sprintf("label '%s'", label))
+			}
+			if namePattern != nil && namePattern.MatchString(service.Name) {
+				reasons = append(reasons, fmt.Sprintf("name matches '%s'", t.Selection.Name))
+			}
+			if len(reasons) == 0 {
+				continue
+			}
+			if len(t.Selection.Plans) > 0 && matching([]string{service.Plan}, t.Selection.Plans) == "" {
+				continue
+			}
+			if missingCredential(service, t.Selection.Credentials) != "" {
+				continue
+			}
+			candidates = append(candidates, Candidate{Service: service, Reasons: reasons})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if len(candidates[i].Reasons) != len(candidates[j].Reasons) {
+			return len(candidates[i].Reasons) > len(candidates[j].Reasons)
+		}
+		return candidates[i].Service.Name < candidates[j].Service.Name
+	})
+	return candidates, nil
+}
+
+// SelectService returns the service the template is bound to, nil if no service matches.
+// A service matching more rules than all others wins, otherwise the tie-breaker decides.
+func (t Template) SelectService(services VcapServices) (*VcapService, error) {
+	candidates, err := t.Candidates(services)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	// candidates are ordered, the first one wins unless the next one matches as many rules
+	if len(candidates) > 1 && len(candidates[1].Reasons) == len(candidates[0].Reasons) && t.Selection.TieBreaker != TieBreakerName {
+		return nil, &AmbiguousServicesError{Template: t.Name, Candidates: candidates}
+	}
+	return &candidates[0].Service, nil
+}
+
+// matching returns the first value which is one of allowed (case insensitive)
+func matching(values []string, allowed []string) string {
+	for _, v := range values {
+		for _, a := range allowed {
+			if strings.EqualFold(v, a) {
+				return a
+			}
+		}
+	}
+	return ""
+}
+
+func missingCredential(service VcapService, fields []string) string {
+	for _, field := range fields {
+		if _, ok := service.Credential(field); !ok {
+			return field
+		}
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package config_test
+
+import (
+	conf "kibana/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Selection", func() {
+	var services conf.VcapServices
+
+	BeforeEach(func() {
+		services = conf.VcapServices{}
+		Expect(services.Parse([]byte(`{
+			"a9s-elasticsearch": [
+				{"name": "logs-es", "label": "a9s-elasticsearch", "plan": "small", "tags": ["elasticsearch"], "credentials": {"host": "https://logs:9200"}},
+				{"name": "audit-es", "label": "a9s-elasticsearch", "plan": "large", "tags": ["elasticsearch"], "credentials": {"host": "https://audit:9200"}}
+			],
+			"user-provided": [
+				{"name": "smtp", "label": "user-provided", "tags": [], "credentials": {"server": "mail"}},
+				{"name": "cloud-es", "label": "user-provided", "tags": ["elastic"], "credentials": {"uri": "https://u:p@cloud:9243"}}
+			]
+		}`))).To(Succeed())
+	})
+
+	names := func(candidates []conf.Candidate) []string {
+		result := []string{}
+		for _, c := range candidates {
+			result = append(result, c.Service.Name)
+		}
+		return result
+	}
+
+	It("does not consider user-provided services without a matching rule", func() {
+		t := conf.Template{Name: "cf-kibana", Tags: []string{"elasticsearch"}}
+		candidates, err := t.Candidates(services)
+		Expect(err).To(BeNil())
+		Expect(names(candidates)).To(Equal([]string{"audit-es", "logs-es"}))
+	})
+
+	It("restricts the candidates by plan and credentials", func() {
+		t := conf.Template{Name: "cf-kibana", Tags: []string{"elasticsearch", "elastic"}, Selection: conf.Selection{Plans: []string{"small"}}}
+		candidates, err := t.Candidates(services)
+		Expect(err).To(BeNil())
+		Expect(names(candidates)).To(Equal([]string{"logs-es"}))
+
+		t = conf.Template{Name: "cf-kibana", Tags: []string{"elasticsearch", "elastic"}, Selection: conf.Selection{Credentials: []string{"uri"}}}
+		candidates, err = t.Candidates(services)
+		Expect(err).To(BeNil())
+		Expect(names(candidates)).To(Equal([]string{"cloud-es"}))
+	})
+
+	It("selects the service matching the most rules", func() {
+		t := conf.Template{Name: "cf-kibana", Tags: []string{"elasticsearch"}, Selection: conf.Selection{Name: "^logs-"}}
+		service, err := t.SelectService(services)
+		Expect(err).To(BeNil())
+		Expect(service.Name).To(Equal("logs-es"))
+	})
+
+	It("lists all candidates if the rules are ambiguous", func() {
+		t := conf.Template{Name: "cf-kibana", Selection: conf.Selection{Labels: []string{"a9s-elasticsearch"}}}
+		_, err := t.SelectService(services)
+		Expect(err).To(MatchError("more than one service found for template cf-kibana: " +
+			"audit-es (label 'a9s-elasticsearch', plan 'large'): label 'a9s-elasticsearch'; " +
+			"logs-es (label 'a9s-elasticsearch', plan 'small'): label 'a9s-elasticsearch'"))
+	})
+
+	It("uses the tie-breaker for ambiguous rules", func() {
+		t := conf.Template{Name: "cf-kibana", Selection: conf.Selection{Labels: []string{"a9s-elasticsearch"}, TieBreaker: conf.TieBreakerName}}
+		service, err := t.SelectService(services)
+		Expect(err).To(BeNil())
+		Expect(service.Name).To(Equal("audit-es"))
+	})
+
+	It("returns no service if nothing matches", func() {
+		t := conf.Template{Name: "cf-kibana", Tags: []string{"mongodb"}}
+		Expect(t.SelectService(services)).To(BeNil())
+	})
+
+	It("rejects invalid rules", func() {
+		Expect(conf.Template{Name: "t", Selection: conf.Selection{Name: "("}}.Validate()).NotTo(Succeed())
+		Expect(conf.Template{Name: "t", Type: "script"}.Validate()).To(MatchError("template t: invalid type 'script', must be one of config, certificates, env, keystore"))
+		Expect(conf.Template{Name: "t", Selection: conf.Selection{TieBreaker: "random"}}.Validate()).To(MatchError("template t: invalid tie-breaker 'random', must be error or name"))
+	})
+})
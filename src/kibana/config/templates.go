@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// TemplatesFile is the catalog of a template directory
+const TemplatesFile = "templates.yml"
+
+// template types, a template without type is a config template
+const (
+	TemplateTypeConfig       = "config"       // kibana.yml fragment, merged into kibana.yml
+	TemplateTypeCertificates = "certificates" // PEM certificates, added to the CA bundle
+	TemplateTypeEnv          = "env"          // environment variables, exported in profile.d
+	TemplateTypeKeystore     = "keystore"     // Kibana keystore entries
+)
+
+var templateTypes = []string{TemplateTypeConfig, TemplateTypeCertificates, TemplateTypeEnv, TemplateTypeKeystore}
+
+// TemplateType returns the type of the template
+func (t Template) TemplateType() string {
+	if t.Type == "" {
+		return TemplateTypeConfig
+	}
+	return t.Type
+}
+
+// LoadTemplates reads the catalog of a template directory, the template files are expected
+// in the same directory as <name>.yml
+func LoadTemplates(dir string) (TemplatesConfig, error) {
+	c := TemplatesConfig{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, TemplatesFile))
+	if err != nil {
+		return c, err
+	}
+	if err := c.Parse(data); err != nil {
+		return c, fmt.Errorf("%s: %s", filepath.Join(dir, TemplatesFile), err.Error())
+	}
+
+	for i := range c.Templates {
+		c.Templates[i].Dir = dir
+		if err := c.Templates[i].Validate(); err != nil {
+			return c, err
+		}
+		if _, err := os.Stat(c.Templates[i].File()); err != nil {
+			return c, fmt.Errorf("template %s: %s", c.Templates[i].Name, err.Error())
+		}
+	}
+	return c, nil
+}
+
+// File returns the path of the template file
+func (t Template) File() string {
+	return filepath.Join(t.Dir, t.Name+".yml")
+}
+
+// FallbackFor returns the fallback template used instead of a template whose service is not bound:
+// the first is-fallback template of the same type, preferably one sharing a tag with the template
+func (c TemplatesConfig) FallbackFor(t Template) (Template, bool) {
+	fallbacks := []Template{}
+	for _, f := range c.Templates {
+		if f.IsFallback && f.Name != t.Name && f.TemplateType() == t.TemplateType() {
+			fallbacks = append(fallbacks, f)
+		}
+	}
+	for _, f := range fallbacks {
+		if matching(f.Tags, t.Tags) != "" {
+			return f, true
+		}
+	}
+	if len(fallbacks) > 0 {
+		return fallbacks[0], true
+	}
+	return Template{}, false
+}
+
+// Add merges the catalog of another template directory: its templates replace templates
+// with the same name, its alias profiles take precedence and its alias overrides the fields it sets.
+// It returns the names of the replaced templates.
+func (c *TemplatesConfig) Add(other TemplatesConfig) []string {
+	replaced := []string{}
+	for _, t := range other.Templates {
+		found := false
+		for i := range c.Templates {
+			if c.Templates[i].Name == t.Name {
+				c.Templates[i] = t
+				replaced = append(replaced, t.Name)
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.Templates = append(c.Templates, t)
+		}
+	}
+
+	c.AliasProfiles = append(append([]AliasProfile{}, other.AliasProfiles...), c.AliasProfiles...)
+	c.Alias = other.Alias.withDefaults(c.Alias)
+	return replaced
+}
@@ -0,0 +1,84 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	conf "kibana/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Templates", func() {
+	var bpDir, appDir string
+
+	write := func(dir string, name string, content string) {
+		Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		bpDir, err = ioutil.TempDir("", "bp-templates")
+		Expect(err).To(BeNil())
+		appDir, err = ioutil.TempDir("", "app-templates")
+		Expect(err).To(BeNil())
+
+		write(bpDir, "templates.yml", "alias:\n  credentials-host-field: host\n  credentials-username-field: username\ntemplates:\n- name: cf-kibana\n  is-default: true\n  tags: [elasticsearch]\n- name: cf-certificates\n  is-default: true\n")
+		write(bpDir, "cf-kibana.yml", "server.host: 0.0.0.0\n")
+		write(bpDir, "cf-certificates.yml", "")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(bpDir)
+		os.RemoveAll(appDir)
+	})
+
+	It("merges the templates of the app into the buildpack catalog", func() {
+		write(appDir, "templates.yml", "alias:\n  credentials-username-field: user\ntemplates:\n- name: team-logging\n  is-default: true\n- name: cf-certificates\n  is-default: false\n")
+		write(appDir, "team-logging.yml", "logging.json: true\n")
+		write(appDir, "cf-certificates.yml", "")
+
+		c, err := conf.LoadTemplates(bpDir)
+		Expect(err).To(BeNil())
+		app, err := conf.LoadTemplates(appDir)
+		Expect(err).To(BeNil())
+		Expect(c.Add(app)).To(Equal([]string{"cf-certificates"}))
+
+		Expect(c.Templates).To(HaveLen(3))
+		Expect(c.Templates[0].File()).To(Equal(filepath.Join(bpDir, "cf-kibana.yml")))
+		Expect(c.Templates[1].File()).To(Equal(filepath.Join(appDir, "cf-certificates.yml")))
+		Expect(c.Templates[1].IsDefault).To(BeFalse())
+		Expect(c.Templates[2].File()).To(Equal(filepath.Join(appDir, "team-logging.yml")))
+		Expect(c.Alias).To(Equal(conf.Alias{CredentialsHostField: "host", CredentialsUsernameField: "user"}))
+	})
+
+	It("finds the fallback template of the same type, preferably with a common tag", func() {
+		c := conf.TemplatesConfig{Templates: []conf.Template{
+			{Name: "cf-kibana", Tags: []string{"elasticsearch"}},
+			{Name: "other-fallback", IsFallback: true, Tags: []string{"mongodb"}},
+			{Name: "cf-kibana-fallback", Type: "config", IsFallback: true, Tags: []string{"elasticsearch"}},
+			{Name: "cert-fallback", Type: "certificates", IsFallback: true},
+			{Name: "cf-certificates", Type: "certificates"},
+		}}
+
+		fallback, ok := c.FallbackFor(c.Templates[0])
+		Expect(ok).To(BeTrue())
+		Expect(fallback.Name).To(Equal("cf-kibana-fallback"))
+		Expect(fallback.BindsService()).To(BeFalse())
+
+		fallback, ok = c.FallbackFor(c.Templates[4])
+		Expect(ok).To(BeTrue())
+		Expect(fallback.Name).To(Equal("cert-fallback"))
+
+		_, ok = c.FallbackFor(conf.Template{Name: "env", Type: "env"})
+		Expect(ok).To(BeFalse())
+	})
+
+	It("requires a template file for every template", func() {
+		write(appDir, "templates.yml", "templates:\n- name: team-sso\n")
+		_, err := conf.LoadTemplates(appDir)
+		Expect(err).To(MatchError(ContainSubstring("template team-sso:")))
+	})
+})
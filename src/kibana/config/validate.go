@@ -0,0 +1,304 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"kibana/util"
+)
+
+// An Issue is a problem found while validating the Kibana file
+type Issue struct {
+	Line    int    // line in the Kibana file, 0 if unknown
+	Key     string // dotted path of the setting, e.g. buildpack.log-level
+	Message string
+}
+
+func (i Issue) String() string {
+	if i.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", i.Line, i.Key, i.Message)
+	}
+	return fmt.Sprintf("%s: %s", i.Key, i.Message)
+}
+
+// Validation holds the result of validating the Kibana file
+type Validation struct {
+	Errors   []Issue
+	Warnings []Issue
+}
+
+// Err returns an error summarizing all validation errors, or nil if there are none
+func (v Validation) Err() error {
+	if len(v.Errors) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, issue := range v.Errors {
+		messages = append(messages, issue.String())
+	}
+	return errors.New("invalid Kibana file: " + strings.Join(messages, "; "))
+}
+
+// deprecated spellings of Kibana file settings which are still honored
+var deprecatedKeys = map[string]string{
+	"nodejs-options": "node-options",
+}
+
+// value constraints of Kibana file settings (beyond their yaml type)
+var valueRules = map[string]func(interface{}) string{
+	"heap-percentage": func(v interface{}) string {
+		if i, ok := v.(int); ok && (i < 1 || i > 100) {
+			return fmt.Sprintf("must be between 1 and 100, got %d", i)
+		}
+		return ""
+	},
+	"optimize-heap-size": func(v interface{}) string {
+		if i, ok := v.(int); ok && i < 0 {
+			return fmt.Sprintf("must not be negative, got %d", i)
+		}
+		return ""
+	},
+	"certificate-expiry-warning-days": func(v interface{}) string {
+		if i, ok := v.(int); ok && i < 0 {
+			return fmt.Sprintf("must not be negative, got %d", i)
+		}
+		return ""
+	},
+	"ssl-verification": func(v interface{}) string {
+		if s, ok := v.(string); ok && s != "" && s != "full" && s != "certificate" && s != "none" {
+			return fmt.Sprintf("must be full, certificate or none, got '%s'", s)
+		}
+		return ""
+	},
+	"auth.type": func(v interface{}) string {
+		if s, ok := v.(string); ok && s != "" && s != AuthBasic && s != AuthOidc {
+			return fmt.Sprintf("must be %s or %s, got '%s'", AuthBasic, AuthOidc, s)
+		}
+		return ""
+	},
+	"reserved-memory": func(v interface{}) string {
+		if i, ok := v.(int); ok && i <= 0 {
+			return fmt.Sprintf("must be greater than 0, got %d", i)
+		}
+		return ""
+	},
+}
+
+// CheckValue checks a single (already typed) setting value against its constraints.
+// An empty string means the value is valid.
+func CheckValue(key string, value interface{}) string {
+	if rule, ok := valueRules[key]; ok {
+		return rule(value)
+	}
+	return ""
+}
+
+// ValidateKibanaFile checks the content of the Kibana file against the KibanaConfig schema:
+// unknown keys (with suggestions for close matches), value types and value constraints.
+func ValidateKibanaFile(data []byte) (v Validation) {
+	defer func() {
+		if r := recover(); r != nil {
+			v.Errors = append(v.Errors, Issue{Key: "Kibana", Message: fmt.Sprintf("Yaml parsing error: %s", r)})
+		}
+	}()
+
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		v.Errors = append(v.Errors, Issue{Key: "Kibana", Message: err.Error()})
+		return v
+	}
+
+	lines := keyLines(data)
+	validateMap(doc, reflect.TypeOf(KibanaConfig{}), "", lines, &v)
+	if len(v.Errors) > 0 {
+		return v
+	}
+
+	config := KibanaConfig{}
+	if err := config.Parse(data); err != nil {
+		v.Errors = append(v.Errors, Issue{Key: "Kibana", Message: err.Error()})
+		return v
+	}
+	for i, p := range config.Plugins {
+		if err := p.Validate(); err != nil {
+			key := fmt.Sprintf("plugins[%d]", i)
+			v.Errors = append(v.Errors, Issue{Line: lines[key], Key: key, Message: err.Error()})
+		}
+	}
+	return v
+}
+
+func validateMap(doc yaml.MapSlice, t reflect.Type, prefix string, lines map[string]int, v *Validation) {
+	fields := yamlFields(t)
+
+	for _, item := range doc {
+		name := fmt.Sprintf("%v", item.Key)
+		key := joinKey(prefix, name)
+		line := lines[key]
+
+		if replacement, deprecated := deprecatedKeys[name]; deprecated && prefix == "" {
+			v.Warnings = append(v.Warnings, Issue{Line: line, Key: key, Message: fmt.Sprintf("deprecated, please use '%s'", replacement)})
+		}
+
+		field, ok := fields[name]
+		if !ok {
+			message := "unknown setting"
+			if suggestion := closestKey(name, fields); suggestion != "" {
+				message += fmt.Sprintf(" (did you mean '%s'?)", joinKey(prefix, suggestion))
+			}
+			v.Errors = append(v.Errors, Issue{Line: line, Key: key, Message: message})
+			continue
+		}
+
+		validateValue(item.Value, field.Type, key, lines, v)
+	}
+}
+
+func validateValue(value interface{}, t reflect.Type, key string, lines map[string]int, v *Validation) {
+	line := lines[key]
+	if value == nil {
+		return // empty values keep the default
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		switch value.(type) {
+		case yaml.MapSlice, []interface{}:
+			v.Errors = append(v.Errors, Issue{Line: line, Key: key, Message: "must be a string"})
+			return
+		}
+	case reflect.Int:
+		if _, ok := value.(int); !ok {
+			v.Errors = append(v.Errors, Issue{Line: line, Key: key, Message: fmt.Sprintf("must be an integer, got '%v'", value)})
+			return
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			v.Errors = append(v.Errors, Issue{Line: line, Key: key, Message: fmt.Sprintf("must be true or false, got '%v'", value)})
+			return
+		}
+	case reflect.Struct:
+		if _, ok := value.(string); ok && reflect.PtrTo(t).Implements(unmarshalerType) {
+			return // short form, e.g. the plain name of a plugin
+		}
+		m, ok := value.(yaml.MapSlice)
+		if !ok {
+			v.Errors = append(v.Errors, Issue{Line: line, Key: key, Message: "must be a map of settings"})
+			return
+		}
+		validateMap(m, t, key, lines, v)
+		return
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			v.Errors = append(v.Errors, Issue{Line: line, Key: key, Message: "must be a list"})
+			return
+		}
+		for i, element := range list {
+			validateValue(element, t.Elem(), fmt.Sprintf("%s[%d]", key, i), lines, v)
+		}
+		return
+	}
+
+	if message := CheckValue(key, value); message != "" {
+		v.Errors = append(v.Errors, Issue{Line: line, Key: key, Message: message})
+	}
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// yamlFields maps the yaml names of a struct to its fields, ignoring fields tagged with "-"
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func joinKey(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// closestKey returns the known key with the smallest edit distance to name, if it is close enough
+func closestKey(name string, fields map[string]reflect.StructField) string {
+	candidates := []string{}
+	for candidate := range fields {
+		candidates = append(candidates, candidate)
+	}
+	return util.ClosestMatch(name, candidates)
+}
+
+var keyPattern = regexp.MustCompile(`^["']?([^"':#\s][^"':#]*?)["']?\s*:(\s|$)`)
+
+// keyLines locates the line of every key (and list item) in a yaml document.
+// yaml.v2 does not expose node positions, so this is a simple indentation based scan
+// which covers the block style used in Kibana files.
+func keyLines(data []byte) map[string]int {
+	type frame struct {
+		indent int
+		path   string
+		item   bool
+	}
+
+	result := map[string]int{}
+	counters := map[string]int{}
+	stack := []frame{}
+
+	for n, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "---") {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			for len(stack) > 0 && (stack[len(stack)-1].indent > indent || (stack[len(stack)-1].indent == indent && stack[len(stack)-1].item)) {
+				stack = stack[:len(stack)-1]
+			}
+			parent := ""
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1].path
+			}
+			path := fmt.Sprintf("%s[%d]", parent, counters[parent])
+			counters[parent]++
+			result[path] = n + 1
+			stack = append(stack, frame{indent: indent, path: path, item: true})
+
+			rest := strings.TrimLeft(trimmed[1:], " ")
+			indent += len(trimmed) - len(rest)
+			trimmed = rest
+		}
+
+		match := keyPattern.FindStringSubmatch(trimmed)
+		if match == nil {
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		path := match[1]
+		if len(stack) > 0 {
+			path = stack[len(stack)-1].path + "." + match[1]
+		}
+		if _, exists := result[path]; !exists {
+			result[path] = n + 1
+		}
+		counters[path] = 0
+		stack = append(stack, frame{indent: indent, path: path})
+	}
+
+	return result
+}
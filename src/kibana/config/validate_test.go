@@ -0,0 +1,115 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	conf "kibana/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidateKibanaFile", func() {
+	It("accepts an empty Kibana file", func() {
+		v := conf.ValidateKibanaFile([]byte(""))
+		Expect(v.Err()).To(BeNil())
+	})
+
+	It("accepts a complete Kibana file", func() {
+		v := conf.ValidateKibanaFile([]byte(`---
+version: 6.1.3
+node-options: "--max-http-header-size=16384"
+reserved-memory: 300
+heap-percentage: 75
+config-templates:
+- name: cf-kibana
+  service-instance-name: my-elasticsearch
+plugins:
+- x-pack
+buildpack:
+  log-level: debug
+`))
+		Expect(v.Errors).To(BeEmpty())
+		Expect(v.Warnings).To(BeEmpty())
+	})
+
+	It("accepts plugin names and structured plugin entries", func() {
+		v := conf.ValidateKibanaFile([]byte(`plugins:
+- x-pack
+- name: my-plugin
+  version: 1.0.0
+  url: https://example.com/my-plugin-1.0.0.zip
+  sha256: 2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b
+- name: local-plugin
+  file: plugins/local-plugin.zip
+`))
+		Expect(v.Errors).To(BeEmpty())
+	})
+
+	It("reports invalid plugin entries", func() {
+		v := conf.ValidateKibanaFile([]byte(`plugins:
+- x-pack
+- name: my-plugin
+  url: https://example.com/my-plugin-1.0.0.zip
+`))
+		Expect(v.Errors).To(HaveLen(1))
+		Expect(v.Errors[0].String()).To(Equal("line 3: plugins[1]: plugin my-plugin: sha256 is required for downloads"))
+
+		v = conf.ValidateKibanaFile([]byte(`plugins:
+- name: my-plugin
+  sha265: abc
+`))
+		Expect(v.Errors[0].String()).To(Equal("line 3: plugins[0].sha265: unknown setting (did you mean 'plugins[0].sha256'?)"))
+	})
+
+	It("reports unknown keys with their line and a suggestion", func() {
+		v := conf.ValidateKibanaFile([]byte(`---
+version: 6.1.3
+heap-percentag: 75
+buildpack:
+  log-levl: debug
+x-pack:
+  monitoring:
+    enabled: false
+`))
+		Expect(v.Errors).To(HaveLen(3))
+		Expect(v.Errors[0].String()).To(Equal("line 3: heap-percentag: unknown setting (did you mean 'heap-percentage'?)"))
+		Expect(v.Errors[1].String()).To(Equal("line 5: buildpack.log-levl: unknown setting (did you mean 'buildpack.log-level'?)"))
+		Expect(v.Errors[2].String()).To(Equal("line 6: x-pack: unknown setting"))
+	})
+
+	It("reports the x-pack section of old Kibana files as unknown", func() {
+		data, err := ioutil.ReadFile(filepath.Join("..", "..", "..", "test", "Kibana_full"))
+		Expect(err).To(BeNil())
+		v := conf.ValidateKibanaFile(data)
+		Expect(v.Errors).To(HaveLen(1))
+		Expect(v.Errors[0].String()).To(Equal("line 11: x-pack: unknown setting"))
+	})
+
+	It("reports values of the wrong type or out of range", func() {
+		v := conf.ValidateKibanaFile([]byte(`heap-percentage: 120
+reserved-memory: lots
+config-templates:
+- name: cf-kibana
+  service-instance-name: [a, b]
+`))
+		Expect(v.Errors).To(HaveLen(3))
+		Expect(v.Errors[0].String()).To(Equal("line 1: heap-percentage: must be between 1 and 100, got 120"))
+		Expect(v.Errors[1].String()).To(Equal("line 2: reserved-memory: must be an integer, got 'lots'"))
+		Expect(v.Errors[2].String()).To(Equal("line 5: config-templates[0].service-instance-name: must be a string"))
+	})
+
+	It("rejects a negative optimize-heap-size", func() {
+		v := conf.ValidateKibanaFile([]byte("optimize-heap-size: -1\n"))
+		Expect(v.Errors).To(HaveLen(1))
+		Expect(v.Errors[0].String()).To(Equal("line 1: optimize-heap-size: must not be negative, got -1"))
+	})
+
+	It("warns about the deprecated nodejs-options key", func() {
+		v := conf.ValidateKibanaFile([]byte("nodejs-options: --trace-warnings\n"))
+		Expect(v.Errors).To(BeEmpty())
+		Expect(v.Warnings).To(HaveLen(1))
+		Expect(v.Warnings[0].String()).To(ContainSubstring("please use 'node-options'"))
+	})
+})
@@ -11,6 +11,9 @@ import (
 	"path/filepath"
 )
 
+// name of the launcher binary in <build-dir>/bin
+const launcherName = "kibana-launcher"
+
 type Command interface {
 	Execute(string, io.Writer, io.Writer, string, ...string) error
 }
@@ -24,9 +27,10 @@ type Stager interface {
 }
 
 type Finalizer struct {
-	Stager  Stager
-	Command Command
-	Log     *libbuildpack.Logger
+	Stager      Stager
+	Command     Command
+	Log         *libbuildpack.Logger
+	LauncherDir string // directory of the launcher binary, the directory of the finalize binary if empty
 }
 
 func NewFinalizer(stager Stager, command Command, logger *libbuildpack.Logger) (*Finalizer, error) {
@@ -64,55 +68,17 @@ func Run(gf *Finalizer) error {
 
 func (gf *Finalizer) CreateStartupEnvironment(tempDir string) error {
 
-	//create start script
+	//install the launcher, it renders the config and runs Kibana
+	if err := gf.InstallLauncher(); err != nil {
+		return err
+	}
 
+	//create start script
 	content := util.TrimLines(fmt.Sprintf(`
 				echo "--> STARTING UP ..."
-				MemLimits="$(echo ${VCAP_APPLICATION} | $JQ_HOME/jq '.limits.mem')"
-
-				echo "--> container memory limit = ${MemLimits}m"
-				if [ -n "$K_BP_NODE_OPTS" ] || [ -z "$MemLimits" ] || [ -z "$K_BP_RESERVED_MEMORY"  ] || [ -z "$K_BP_HEAP_PERCENTAGE" ] ; then
-					export NODE_OPTIONS=$K_BP_NODE_OPTS
-					echo "--> Using NODE_OPTIONS=\"${NODE_OPTIONS}\" (user defined)"
-				else
-					HeapSize=$(( ($MemLimits - $K_BP_RESERVED_MEMORY) / 100 * $K_BP_HEAP_PERCENTAGE ))
-					export NODE_OPTIONS="--max-old-space-size=${HeapSize}"
-					echo "--> Using NODE_OPTIONS=\"${NODE_OPTIONS}\" (calculated max heap size)"
-				fi
-
-				echo "--> preparing runtime directories ..."
-				mkdir -p conf.d
-
-				if [ -d kibana.conf.d ] ; then
-					rm -rf kibana.conf.d
-				fi
-				mkdir -p kibana.conf.d
-
-				if [ -d kibana.config ] ; then
-					rm -rf kibana.config
-				fi
-				mkdir -p kibana.config
-
-				echo "--> template processing ..."
-				$GTE_HOME/gte $HOME/conf.d $HOME/kibana.conf.d
-				$GTE_HOME/gte $K_ROOT/conf.d $HOME/kibana.conf.d
-
-				echo "--> concatenating config files ..."
-				awk 'FNR==1{print ""}1' $HOME/kibana.conf.d/* > $HOME/kibana.config/kibana.yml
-
-
-				echo "--> STARTING KIBANA ..."
-				if [ -n "$K_CMD_ARGS" ] ; then
-					echo "--> using cmd_args=\"$K_CMD_ARGS\""
-				fi
-
-				if [ -n "$K_DO_SLEEP" ] ; then
-					sleep 3600
-				fi
-
 				chmod +x $HOME/bin/*.sh
-				$KIBANA_HOME/bin/kibana -c $HOME/kibana.config/kibana.yml $K_CMD_ARGS
-				`))
+				exec $HOME/bin/%s
+				`, launcherName))
 
 	err := ioutil.WriteFile(filepath.Join(gf.Stager.BuildDir(), "bin/run.sh"), []byte(content), 0755)
 	if err != nil {
@@ -129,3 +95,24 @@ func (gf *Finalizer) CreateStartupEnvironment(tempDir string) error {
 
 	return gf.Stager.WriteProfileD("go.sh", golang.GoScript())
 }
+
+// InstallLauncher copies the launcher binary, which bin/finalize builds next to the finalize binary, into <build-dir>/bin
+func (gf *Finalizer) InstallLauncher() error {
+	launcherDir := gf.LauncherDir
+	if launcherDir == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			gf.Log.Error("Unable to locate the finalize binary: %s", err.Error())
+			return err
+		}
+		launcherDir = filepath.Dir(executable)
+	}
+
+	source := filepath.Join(launcherDir, launcherName)
+	dest := filepath.Join(gf.Stager.BuildDir(), "bin", launcherName)
+	if err := libbuildpack.CopyFile(source, dest); err != nil {
+		gf.Log.Error("Unable to install the Kibana launcher: %s", err.Error())
+		return err
+	}
+	return os.Chmod(dest, 0755)
+}
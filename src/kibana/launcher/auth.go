@@ -0,0 +1,92 @@
+package launcher
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	conf "kibana/config"
+	"kibana/proxy"
+)
+
+// ProxyConfig returns the settings of the authentication proxy with the secrets from the
+// credentials of the auth service: users (basic) or client_id, client_secret and the optional
+// cookie_secret (oidc)
+func (l *Launcher) ProxyConfig() (proxy.Config, error) {
+	config := proxy.Config{Type: l.Auth.Type, Issuer: l.Auth.Issuer, Scopes: l.Auth.Scopes, AllowedUsers: l.Auth.AllowedUsers}
+
+	service := l.VcapServices.WithName(l.Auth.Service)
+	if service == nil {
+		return config, fmt.Errorf("the service %s of auth is not bound", l.Auth.Service)
+	}
+
+	switch l.Auth.Type {
+	case conf.AuthBasic:
+		users, ok := service.Credentials["users"].(map[string]interface{})
+		if !ok || len(users) == 0 {
+			return config, fmt.Errorf("service %s: the credential users must map user names to passwords", service.Name)
+		}
+		config.Users = map[string]string{}
+		for user, password := range users {
+			config.Users[user] = fmt.Sprintf("%v", password)
+		}
+	case conf.AuthOidc:
+		config.ClientId = credentialString(service, "client_id")
+		config.ClientSecret = credentialString(service, "client_secret")
+		if config.ClientId == "" || config.ClientSecret == "" {
+			return config, fmt.Errorf("service %s: oidc requires the credentials client_id and client_secret", service.Name)
+		}
+		// the same for all instances, so sessions survive restarts and work across instances
+		secret := credentialString(service, "cookie_secret")
+		if secret == "" {
+			secret = config.ClientId + ":" + config.ClientSecret
+		}
+		key := sha256.Sum256([]byte("kibana-auth:" + secret))
+		config.SessionKey = key[:]
+	}
+	return config, nil
+}
+
+func credentialString(service *conf.VcapService, field string) string {
+	if value, ok := service.Credential(field); ok {
+		return fmt.Sprintf("%v", value)
+	}
+	return ""
+}
+
+// StartProxy starts the authentication proxy on $PORT, which forwards to Kibana on KibanaPort.
+// With server-ssl the proxy serves TLS and reloads the server certificate when it changes.
+// The returned channel receives the error if the proxy stops.
+func (l *Launcher) StartProxy() (<-chan error, error) {
+	config, err := l.ProxyConfig()
+	if err != nil {
+		return nil, err
+	}
+	target := &url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", strconv.Itoa(l.KibanaPort))}
+	handler, err := proxy.New(config, target, l.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", ":"+l.Port)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	l.Log.Info("Starting %s authentication proxy on port %s", l.Auth.Type, l.Port)
+
+	stopped := make(chan error, 1)
+	go func() {
+		if l.ServerSsl {
+			server.TLSConfig = &tls.Config{GetCertificate: proxy.CertificateLoader(l.ServerCert, l.ServerKey)}
+			stopped <- server.ServeTLS(listener, "", "")
+		} else {
+			stopped <- server.Serve(listener)
+		}
+	}()
+	return stopped, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"kibana/launcher"
+	"os"
+
+	"github.com/andibrunner/libbuildpack"
+)
+
+func main() {
+	logger := libbuildpack.NewLogger(os.Stdout)
+
+	l, err := launcher.New(logger)
+	if err != nil {
+		logger.Error("Unable to read the launch environment: %s", err.Error())
+		os.Exit(1)
+	}
+
+	exitCode, err := l.Run()
+	if err != nil {
+		logger.Error("Unable to start Kibana: %s", err.Error())
+	}
+	os.Exit(exitCode)
+}
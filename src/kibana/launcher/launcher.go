@@ -0,0 +1,630 @@
+package launcher
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/andibrunner/libbuildpack"
+	"kibana/certs"
+	conf "kibana/config"
+	"kibana/merge"
+	"kibana/template"
+)
+
+// TemplateDirs are the directories of the pre-processed buildpack templates in $K_ROOT by template type,
+// env templates are exported in profile.d during staging
+var TemplateDirs = map[string]string{
+	conf.TemplateTypeConfig:       "conf.d",
+	conf.TemplateTypeCertificates: "certificates.d",
+	conf.TemplateTypeKeystore:     "keystore.d",
+}
+
+// Launcher prepares the Kibana configuration and runs Kibana.
+// It replaces the former bash start script and reads the environment written by supply into profile.d.
+type Launcher struct {
+	Log             *libbuildpack.Logger
+	Home            string             // $HOME, the app directory
+	Root            string             // $K_ROOT, the dependency directory of the buildpack
+	WorkDir         string             // directory for the rendered config files, $HOME at runtime
+	KibanaHome      string             // $KIBANA_HOME
+	ReservedMemory  int                // $K_BP_RESERVED_MEMORY
+	HeapPercentage  int                // $K_BP_HEAP_PERCENTAGE
+	NodeOpts        string             // $K_BP_NODE_OPTS, user defined NODE_OPTIONS
+	CmdArgs         []string           // $K_CMD_ARGS
+	DoSleep         bool               // $K_DO_SLEEP
+	ServiceFallback bool               // $K_BP_SERVICE_FALLBACK, serve a status page if Elasticsearch is not configured
+	MissingServices []string           // $K_BP_MISSING_SERVICES, services of templates not bound during staging
+	Port            string             // $PORT
+	SslVerification string             // $K_BP_SSL_VERIFICATION, elasticsearch.ssl.verificationMode unless set by a config file
+	ClientCert      string             // $K_CLIENT_CERT, client certificate file of the app for the connection to Elasticsearch
+	ClientKey       string             // $K_CLIENT_KEY, private key file of ClientCert
+	ClientCreds     *ClientCredentials // $K_CLIENT_CREDENTIALS, client certificate in the credentials of a service
+	ServerSsl       bool               // $K_BP_SERVER_SSL, TLS for the Kibana server
+	ServerCert      string             // $K_SERVER_CERT, server certificate file, e.g. the CF instance identity
+	ServerKey       string             // $K_SERVER_KEY, private key file of ServerCert
+	ReloadInterval  time.Duration      // interval to check the server certificate for changes, Kibana is restarted if it changes
+	Auth            *conf.Auth         // $K_BP_AUTH, authentication proxy on $PORT in front of Kibana
+	KibanaPort      int                // internal port of Kibana behind the authentication proxy
+	VcapApp         conf.VcapApp
+	VcapServices    conf.VcapServices
+}
+
+// ClientCredentials are the credential fields of a service which hold the PEM encoded client
+// certificate and private key for the connection to Elasticsearch
+type ClientCredentials struct {
+	Service     string `json:"service"`
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+// New creates a launcher from the environment
+func New(logger *libbuildpack.Logger) (*Launcher, error) {
+	l := &Launcher{
+		Log:             logger,
+		Home:            os.Getenv("HOME"),
+		Root:            os.Getenv("K_ROOT"),
+		WorkDir:         os.Getenv("HOME"),
+		KibanaHome:      os.Getenv("KIBANA_HOME"),
+		NodeOpts:        os.Getenv("K_BP_NODE_OPTS"),
+		CmdArgs:         strings.Fields(os.Getenv("K_CMD_ARGS")),
+		DoSleep:         os.Getenv("K_DO_SLEEP") != "",
+		Port:            os.Getenv("PORT"),
+		ServiceFallback: os.Getenv("K_BP_SERVICE_FALLBACK") != "",
+		SslVerification: os.Getenv("K_BP_SSL_VERIFICATION"),
+		ClientCert:      os.Getenv("K_CLIENT_CERT"),
+		ClientKey:       os.Getenv("K_CLIENT_KEY"),
+		ServerSsl:       os.Getenv("K_BP_SERVER_SSL") != "",
+		ServerCert:      os.Getenv("K_SERVER_CERT"),
+		ServerKey:       os.Getenv("K_SERVER_KEY"),
+		ReloadInterval:  time.Minute,
+	}
+
+	var err error
+	if l.ReservedMemory, err = intFromEnv("K_BP_RESERVED_MEMORY"); err != nil {
+		return nil, err
+	}
+	if l.HeapPercentage, err = intFromEnv("K_BP_HEAP_PERCENTAGE"); err != nil {
+		return nil, err
+	}
+	if vcapApp := os.Getenv("VCAP_APPLICATION"); vcapApp != "" {
+		if err := l.VcapApp.Parse([]byte(vcapApp)); err != nil {
+			return nil, err
+		}
+	}
+	if vcapServices := os.Getenv("VCAP_SERVICES"); vcapServices != "" {
+		if err := l.VcapServices.Parse([]byte(vcapServices)); err != nil {
+			return nil, err
+		}
+	}
+	if auth := os.Getenv("K_BP_AUTH"); auth != "" {
+		l.Auth = &conf.Auth{}
+		if err := json.Unmarshal([]byte(auth), l.Auth); err != nil {
+			return nil, fmt.Errorf("invalid K_BP_AUTH: %s", err.Error())
+		}
+		l.KibanaPort = 5601
+		if l.Port == strconv.Itoa(l.KibanaPort) {
+			l.KibanaPort = 5602
+		}
+	}
+	if clientCreds := os.Getenv("K_CLIENT_CREDENTIALS"); clientCreds != "" {
+		l.ClientCreds = &ClientCredentials{}
+		if err := json.Unmarshal([]byte(clientCreds), l.ClientCreds); err != nil {
+			return nil, fmt.Errorf("invalid K_CLIENT_CREDENTIALS: %s", err.Error())
+		}
+	}
+	if missing := os.Getenv("K_BP_MISSING_SERVICES"); missing != "" {
+		if err := json.Unmarshal([]byte(missing), &l.MissingServices); err != nil {
+			return nil, fmt.Errorf("K_BP_MISSING_SERVICES: %s", err.Error())
+		}
+	}
+	if l.KibanaHome == "" {
+		return nil, errors.New("KIBANA_HOME is not set")
+	}
+
+	return l, nil
+}
+
+func intFromEnv(name string) (int, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer, got '%s'", name, value)
+	}
+	return i, nil
+}
+
+// Run prepares the configuration and runs Kibana, it returns the exit code of Kibana
+func (l *Launcher) Run() (int, error) {
+	nodeOptions, err := l.NodeOptions()
+	if err != nil {
+		return 1, err
+	}
+	os.Setenv("NODE_OPTIONS", nodeOptions)
+
+	config, err := l.BuildConfig()
+	if err != nil {
+		return 1, err
+	}
+
+	if problems := l.PlaceholderProblems(config); len(problems) > 0 {
+		return l.ServePlaceholder(problems)
+	}
+
+	if err := l.UpdateKeystore(); err != nil {
+		return 1, err
+	}
+
+	var proxyStopped <-chan error
+	if l.Auth != nil {
+		if proxyStopped, err = l.StartProxy(); err != nil {
+			return 1, err
+		}
+	}
+
+	if l.DoSleep {
+		time.Sleep(time.Hour)
+	}
+
+	l.Log.BeginStep("Starting Kibana")
+	if len(l.CmdArgs) > 0 {
+		l.Log.Info("Using cmd-args \"%s\"", strings.Join(l.CmdArgs, " "))
+	}
+	return l.StartKibana(proxyStopped)
+}
+
+// NodeOptions returns the user defined NODE_OPTIONS or the max heap size calculated from the container memory
+func (l *Launcher) NodeOptions() (string, error) {
+	memLimit := 0
+	if l.VcapApp.Limits != nil {
+		memLimit = l.VcapApp.Limits.Mem
+	}
+	l.Log.Info("Container memory limit = %dm", memLimit)
+
+	if l.NodeOpts != "" {
+		l.Log.Info("Using NODE_OPTIONS=\"%s\" (user defined)", l.NodeOpts)
+		return l.NodeOpts, nil
+	}
+	if memLimit == 0 || l.ReservedMemory == 0 || l.HeapPercentage == 0 {
+		l.Log.Info("Not setting NODE_OPTIONS (no memory limit or max heap size calculation disabled)")
+		return "", nil
+	}
+
+	heapSize, err := HeapSize(memLimit, l.ReservedMemory, l.HeapPercentage)
+	if err != nil {
+		return "", err
+	}
+	nodeOptions := fmt.Sprintf("--max-old-space-size=%d", heapSize)
+	l.Log.Info("Using NODE_OPTIONS=\"%s\" (calculated max heap size)", nodeOptions)
+	return nodeOptions, nil
+}
+
+// HeapSize calculates the max heap size in MB: the given percentage of the memory which is not reserved
+func HeapSize(memLimit int, reservedMemory int, heapPercentage int) (int, error) {
+	if memLimit <= reservedMemory {
+		return 0, fmt.Errorf("container memory limit of %dm does not exceed the reserved memory of %dm, please increase the memory of the app or lower reserved-memory", memLimit, reservedMemory)
+	}
+	return (memLimit - reservedMemory) * heapPercentage / 100, nil
+}
+
+func (l *Launcher) confDir() string {
+	return filepath.Join(l.WorkDir, "kibana.conf.d")
+}
+
+// ConfigFile returns the path of the merged kibana.yml
+func (l *Launcher) ConfigFile() string {
+	return filepath.Join(l.WorkDir, "kibana.config", "kibana.yml")
+}
+
+func (l *Launcher) caBundleFile() string {
+	return filepath.Join(l.WorkDir, "kibana.config", "ca-bundle.pem")
+}
+
+func (l *Launcher) clientCertFile() string {
+	return filepath.Join(l.WorkDir, "kibana.config", "client.crt")
+}
+
+func (l *Launcher) clientKeyFile() string {
+	return filepath.Join(l.WorkDir, "kibana.config", "client.key")
+}
+
+// BuildConfig renders and merges all config files into kibana.yml
+func (l *Launcher) BuildConfig() (*merge.Config, error) {
+	l.Log.BeginStep("Preparing runtime directories")
+	if err := l.PrepareDirs(); err != nil {
+		return nil, err
+	}
+
+	l.Log.BeginStep("Processing templates")
+	if err := l.RenderTemplates(); err != nil {
+		return nil, err
+	}
+
+	l.Log.BeginStep("Merging config files")
+	config, err := l.MergeConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.InstallCaBundle(config); err != nil {
+		return nil, err
+	}
+	if err := l.InstallClientCertificate(config); err != nil {
+		return nil, err
+	}
+	if err := l.InstallServerCertificate(config); err != nil {
+		return nil, err
+	}
+	if l.Auth != nil {
+		// only the proxy is reachable from outside the container
+		l.Log.Info("Using %s authentication, Kibana listens on port %d behind the proxy", l.Auth.Type, l.KibanaPort)
+		config.Set("server.host", "127.0.0.1", "auth")
+		config.Set("server.port", l.KibanaPort, "auth")
+	}
+	if _, ok := config.Get("elasticsearch.ssl.verificationMode"); !ok && l.SslVerification != "" {
+		config.Set("elasticsearch.ssl.verificationMode", l.SslVerification, "ssl-verification")
+	}
+	return config, l.WriteConfig(config)
+}
+
+// PrepareDirs (re)creates the directories for the rendered config files
+func (l *Launcher) PrepareDirs() error {
+	for _, dir := range []string{l.confDir(), filepath.Dir(l.ConfigFile())} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// config file directories in the order of their precedence, later ones win
+func (l *Launcher) fragmentDirs() []string {
+	return []string{"buildpack", "app"}
+}
+
+// RenderTemplates renders the config files of the buildpack templates and of the app into kibana.conf.d
+func (l *Launcher) RenderTemplates() error {
+	renderer := template.NewRenderer()
+	sources := map[string]string{
+		"buildpack": filepath.Join(l.Root, TemplateDirs[conf.TemplateTypeConfig]),
+		"app":       filepath.Join(l.Home, "conf.d"),
+	}
+	for _, name := range l.fragmentDirs() {
+		dir := sources[name]
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		if err := renderer.RenderDir(dir, filepath.Join(l.confDir(), name)); err != nil {
+			return fmt.Errorf("rendering %s: %s", dir, err.Error())
+		}
+	}
+	return nil
+}
+
+// Fragments returns the rendered config files in the order of their precedence:
+// buildpack templates < app conf.d, within a directory in the order of the file names
+func (l *Launcher) Fragments() ([]merge.Fragment, error) {
+	fragments := []merge.Fragment{}
+	for _, name := range l.fragmentDirs() {
+		dir := filepath.Join(l.confDir(), name)
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			fragments = append(fragments, merge.Fragment{Name: name + "/" + f.Name(), Data: data})
+		}
+	}
+	return fragments, nil
+}
+
+// MergeConfig deep merges all rendered config files
+func (l *Launcher) MergeConfig() (*merge.Config, error) {
+	fragments, err := l.Fragments()
+	if err != nil {
+		return nil, err
+	}
+
+	config, conflicts, err := merge.Merge(fragments)
+	if err != nil {
+		return nil, err
+	}
+	for _, conflict := range conflicts {
+		l.Log.Info("Setting %s", conflict.String())
+	}
+	return config, nil
+}
+
+// WriteConfig writes the merged config to kibana.yml
+func (l *Launcher) WriteConfig(config *merge.Config) error {
+	content, err := config.Marshal()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.ConfigFile(), content, 0644)
+}
+
+// renderTemplateDir renders the files of a directory of pre-processed buildpack templates in memory,
+// in the order of the file names. Missing directories have no files.
+func (l *Launcher) renderTemplateDir(templateType string) ([]merge.Fragment, error) {
+	dir := filepath.Join(l.Root, TemplateDirs[templateType])
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	renderer := template.NewRenderer()
+	fragments := []merge.Fragment{}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		text, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		out, err := renderer.Render(f.Name(), text)
+		if err != nil {
+			return nil, fmt.Errorf("rendering %s: %s", dir, err.Error())
+		}
+		fragments = append(fragments, merge.Fragment{Name: f.Name(), Data: out})
+	}
+	return fragments, nil
+}
+
+// InstallCaBundle concatenates the certificates of the certificates templates into a CA bundle
+// and makes Kibana trust it for the connection to Elasticsearch, unless the config files define
+// the certificate authorities themselves
+func (l *Launcher) InstallCaBundle(config *merge.Config) error {
+	fragments, err := l.renderTemplateDir(conf.TemplateTypeCertificates)
+	if err != nil {
+		return err
+	}
+
+	var bundle bytes.Buffer
+	for _, fragment := range fragments {
+		certs := bytes.TrimSpace(fragment.Data)
+		if len(certs) == 0 {
+			continue
+		}
+		if block, _ := pem.Decode(certs); block == nil || block.Type != "CERTIFICATE" {
+			return fmt.Errorf("%s: no PEM encoded certificate", fragment.Name)
+		}
+		bundle.Write(certs)
+		bundle.WriteString("\n")
+	}
+	if bundle.Len() == 0 {
+		return nil
+	}
+
+	l.Log.Info("Writing CA bundle %s", l.caBundleFile())
+	if err := ioutil.WriteFile(l.caBundleFile(), bundle.Bytes(), 0644); err != nil {
+		return err
+	}
+	if _, ok := config.Get("elasticsearch.ssl.certificateAuthorities"); !ok {
+		config.Set("elasticsearch.ssl.certificateAuthorities", []interface{}{l.caBundleFile()}, "certificates")
+	}
+	return nil
+}
+
+// InstallClientCertificate makes Kibana authenticate to Elasticsearch with the client certificate in the
+// credentials of the service or, if there is none, with the client certificate of the app, unless the
+// config files define the client certificate themselves
+func (l *Launcher) InstallClientCertificate(config *merge.Config) error {
+	if _, ok := config.Get("elasticsearch.ssl.certificate"); ok {
+		return nil
+	}
+
+	certFile, keyFile := l.ClientCert, l.ClientKey
+	if l.ClientCreds != nil {
+		installed, err := l.writeClientCredentials()
+		if err != nil {
+			return err
+		}
+		if installed {
+			certFile, keyFile = l.clientCertFile(), l.clientKeyFile()
+		}
+	}
+	if certFile == "" || keyFile == "" {
+		return nil
+	}
+
+	l.Log.Info("Using client certificate %s", certFile)
+	config.Set("elasticsearch.ssl.certificate", certFile, "client-certificate")
+	config.Set("elasticsearch.ssl.key", keyFile, "client-certificate")
+	return nil
+}
+
+// writeClientCredentials writes the client certificate and key of the credentials of the service,
+// readable only by the app user. It returns false if the service or the credentials are missing.
+func (l *Launcher) writeClientCredentials() (bool, error) {
+	service := l.VcapServices.WithName(l.ClientCreds.Service)
+	if service == nil {
+		return false, nil
+	}
+	cert, certOk := service.Credential(l.ClientCreds.Certificate)
+	key, keyOk := service.Credential(l.ClientCreds.Key)
+	if !certOk && !keyOk {
+		return false, nil
+	}
+	if !certOk || !keyOk {
+		return false, fmt.Errorf("service %s: the client certificate requires the credentials %s and %s", service.Name, l.ClientCreds.Certificate, l.ClientCreds.Key)
+	}
+
+	certPEM, keyPEM := []byte(fmt.Sprintf("%v", cert)), []byte(fmt.Sprintf("%v", key))
+	if err := certs.CheckKeyPair(certPEM, keyPEM); err != nil {
+		return false, fmt.Errorf("service %s: invalid client certificate: %s", service.Name, err.Error())
+	}
+	if err := ioutil.WriteFile(l.clientCertFile(), certPEM, 0644); err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(l.clientKeyFile(), keyPEM, 0600)
+}
+
+// InstallServerCertificate enables TLS for the Kibana server with the server certificate,
+// unless the config files configure server.ssl themselves
+func (l *Launcher) InstallServerCertificate(config *merge.Config) error {
+	if !l.ServerSsl || l.Auth != nil { // the authentication proxy serves TLS
+		return nil
+	}
+	if _, ok := config.Get("server.ssl.enabled"); ok {
+		l.Log.Info("Using server.ssl of %s", config.Origin("server.ssl.enabled"))
+		return nil
+	}
+	if l.ServerCert == "" || l.ServerKey == "" {
+		return errors.New("server-ssl requires a server certificate, but neither the app has one nor is CF_INSTANCE_CERT set")
+	}
+
+	l.Log.Info("Using server certificate %s", l.ServerCert)
+	config.Set("server.ssl.enabled", true, "server-ssl")
+	config.Set("server.ssl.certificate", l.ServerCert, "server-ssl")
+	config.Set("server.ssl.key", l.ServerKey, "server-ssl")
+	return nil
+}
+
+// UpdateKeystore adds the entries of the keystore templates to the Kibana keystore
+func (l *Launcher) UpdateKeystore() error {
+	fragments, err := l.renderTemplateDir(conf.TemplateTypeKeystore)
+	if err != nil || len(fragments) == 0 {
+		return err
+	}
+	entries, _, err := merge.Merge(fragments)
+	if err != nil {
+		return err
+	}
+
+	l.Log.BeginStep("Updating Kibana keystore")
+	keystore := filepath.Join(l.KibanaHome, "bin", "kibana-keystore")
+	if _, err := os.Stat(keystore); err != nil {
+		return fmt.Errorf("keystore templates require the Kibana keystore (Kibana 6.2 or newer): %s", err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(l.KibanaHome, "data", "kibana.keystore")); os.IsNotExist(err) {
+		if out, err := exec.Command(keystore, "create").CombinedOutput(); err != nil {
+			return fmt.Errorf("creating the Kibana keystore: %s: %s", err.Error(), out)
+		}
+	}
+
+	for _, key := range entries.Keys() {
+		value, _ := entries.Get(key)
+		l.Log.Info("Adding keystore entry %s (%s)", key, entries.Origin(key))
+		cmd := exec.Command(keystore, "add", "--stdin", "--force", key)
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("%v", value))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("adding keystore entry %s: %s: %s", key, err.Error(), out)
+		}
+	}
+	return nil
+}
+
+// StartKibana runs Kibana, forwards signals to it and returns its exit code.
+// With server-ssl Kibana is restarted whenever the server certificate changes, e.g. the CF instance
+// identity certificate is rotated, as Kibana does not reload its certificate.
+// If the authentication proxy stops, Kibana is stopped and 1 is returned.
+func (l *Launcher) StartKibana(proxyStopped <-chan error) (int, error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	var changes <-chan string
+	if l.ServerSsl && l.Auth == nil && l.ReloadInterval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		changes = WatchFiles([]string{l.ServerCert, l.ServerKey}, l.ReloadInterval, stop)
+	}
+
+	for {
+		args := append([]string{"-c", l.ConfigFile()}, l.CmdArgs...)
+		cmd := exec.Command(filepath.Join(l.KibanaHome, "bin", "kibana"), args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Stdin = os.Stdin
+
+		if err := cmd.Start(); err != nil {
+			return 1, err
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+
+		restart := false
+	wait:
+		for {
+			select {
+			case err := <-done:
+				if !restart {
+					return ExitCode(err), nil
+				}
+				break wait
+			case sig := <-signals:
+				restart = false // stopped by Cloud Foundry, also during a restart
+				cmd.Process.Signal(sig)
+			case file := <-changes:
+				if _, err := tls.LoadX509KeyPair(l.ServerCert, l.ServerKey); err != nil {
+					l.Log.Warning("%s changed, but the server certificate is not usable (yet): %s", file, err.Error())
+					continue
+				}
+				l.Log.Info("%s changed, restarting Kibana", file)
+				restart = true
+				cmd.Process.Signal(syscall.SIGTERM)
+			case err := <-proxyStopped:
+				// Kibana is not reachable without the proxy, Cloud Foundry restarts the app
+				l.Log.Error("Authentication proxy stopped: %s", err.Error())
+				cmd.Process.Signal(syscall.SIGTERM)
+				select {
+				case <-done:
+				case <-time.After(10 * time.Second):
+					cmd.Process.Kill()
+					<-done
+				}
+				return 1, nil
+			}
+		}
+	}
+}
+
+// ExitCode returns the exit code of a process from the error returned by Wait.
+// A process terminated by a signal exits with 128 + signal number, as in a shell.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
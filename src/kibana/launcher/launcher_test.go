@@ -0,0 +1,355 @@
+package launcher_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	conf "kibana/config"
+	"kibana/launcher"
+
+	"github.com/andibrunner/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// keyPair creates a self-signed certificate and returns it and its private key PEM encoded
+func keyPair() ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+var _ = Describe("Launcher", func() {
+	var (
+		l      *launcher.Launcher
+		home   string
+		root   string
+		buffer *bytes.Buffer
+		err    error
+	)
+
+	BeforeEach(func() {
+		home, err = ioutil.TempDir("", "kibana-buildpack.home.")
+		Expect(err).To(BeNil())
+		root, err = ioutil.TempDir("", "kibana-buildpack.root.")
+		Expect(err).To(BeNil())
+
+		buffer = new(bytes.Buffer)
+		l = &launcher.Launcher{
+			Log:            libbuildpack.NewLogger(buffer),
+			Home:           home,
+			WorkDir:        home,
+			Root:           root,
+			ReservedMemory: 300,
+			HeapPercentage: 90,
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(home)).To(Succeed())
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	Describe("HeapSize", func() {
+		It("uses the percentage of the memory which is not reserved", func() {
+			Expect(launcher.HeapSize(1024, 300, 90)).To(Equal(651))
+		})
+
+		It("fails if there is no memory left for the heap", func() {
+			_, err := launcher.HeapSize(256, 300, 90)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	Describe("NodeOptions", func() {
+		It("prefers user defined node options", func() {
+			l.NodeOpts = "--max-old-space-size=100"
+			Expect(l.NodeOptions()).To(Equal("--max-old-space-size=100"))
+			Expect(buffer.String()).To(ContainSubstring(`Using NODE_OPTIONS="--max-old-space-size=100" (user defined)`))
+		})
+
+		It("calculates the max heap size from the memory limit", func() {
+			l.VcapApp.Limits = &conf.Limits{Mem: 1024}
+			Expect(l.NodeOptions()).To(Equal("--max-old-space-size=651"))
+			Expect(buffer.String()).To(ContainSubstring("(calculated max heap size)"))
+		})
+
+		It("does not claim empty node options are user defined", func() {
+			Expect(l.NodeOptions()).To(Equal(""))
+			Expect(buffer.String()).To(ContainSubstring("Not setting NODE_OPTIONS"))
+			Expect(buffer.String()).NotTo(ContainSubstring("user defined"))
+		})
+	})
+
+	Describe("config files", func() {
+		It("renders the app and buildpack config files into kibana.yml", func() {
+			Expect(os.MkdirAll(filepath.Join(home, "conf.d"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(root, "conf.d"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(home, "conf.d", "my-kibana.yml"), []byte("logging.verbose: true"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(root, "conf.d", "cf-kibana.yml"), []byte(`server.host: {{ default .Env.NOT_SET "0.0.0.0" }}`), 0644)).To(Succeed())
+
+			_, err := l.BuildConfig()
+			Expect(err).To(BeNil())
+
+			data, err := ioutil.ReadFile(filepath.Join(home, "kibana.config", "kibana.yml"))
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(ContainSubstring("server.host: 0.0.0.0"))
+			Expect(string(data)).To(ContainSubstring("logging.verbose: true"))
+		})
+	})
+
+	Describe("certificates templates", func() {
+		const cert = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+		BeforeEach(func() {
+			Expect(os.MkdirAll(filepath.Join(root, "certificates.d"), 0755)).To(Succeed())
+		})
+
+		It("writes a CA bundle and trusts it for Elasticsearch", func() {
+			Expect(ioutil.WriteFile(filepath.Join(root, "certificates.d", "a.yml"), []byte(cert), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(root, "certificates.d", "b.yml"), []byte("{{ if .Env.NOT_SET }}x{{ end }}"), 0644)).To(Succeed())
+
+			config, err := l.BuildConfig()
+			Expect(err).To(BeNil())
+
+			bundle := filepath.Join(home, "kibana.config", "ca-bundle.pem")
+			data, err := ioutil.ReadFile(bundle)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal(cert))
+			cas, _ := config.Get("elasticsearch.ssl.certificateAuthorities")
+			Expect(cas).To(Equal([]interface{}{bundle}))
+		})
+
+		It("sets the verification mode unless a config file does", func() {
+			l.SslVerification = "certificate"
+			Expect(ioutil.WriteFile(filepath.Join(root, "certificates.d", "a.yml"), []byte(cert), 0644)).To(Succeed())
+
+			config, err := l.BuildConfig()
+			Expect(err).To(BeNil())
+			mode, _ := config.Get("elasticsearch.ssl.verificationMode")
+			Expect(mode).To(Equal("certificate"))
+			Expect(config.Origin("elasticsearch.ssl.verificationMode")).To(Equal("ssl-verification"))
+
+			Expect(os.MkdirAll(filepath.Join(home, "conf.d"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(home, "conf.d", "my-kibana.yml"), []byte("elasticsearch.ssl.verificationMode: full"), 0644)).To(Succeed())
+			config, err = l.BuildConfig()
+			Expect(err).To(BeNil())
+			mode, _ = config.Get("elasticsearch.ssl.verificationMode")
+			Expect(mode).To(Equal("full"))
+		})
+
+		It("rejects templates which do not render to certificates", func() {
+			Expect(ioutil.WriteFile(filepath.Join(root, "certificates.d", "a.yml"), []byte("server.host: 0.0.0.0"), 0644)).To(Succeed())
+
+			_, err := l.BuildConfig()
+			Expect(err).To(MatchError("a.yml: no PEM encoded certificate"))
+		})
+	})
+
+	Describe("client certificate", func() {
+		var certPEM, keyPEM []byte
+
+		BeforeEach(func() {
+			certPEM, keyPEM = keyPair()
+			l.ClientCreds = &launcher.ClientCredentials{Service: "es", Certificate: "tls.cert", Key: "tls.key"}
+		})
+
+		It("writes the client certificate of the credentials of the service", func() {
+			l.VcapServices = conf.VcapServices{"es": {{Name: "es", Credentials: map[string]interface{}{
+				"tls": map[string]interface{}{"cert": string(certPEM), "key": string(keyPEM)},
+			}}}}
+
+			config, err := l.BuildConfig()
+			Expect(err).To(BeNil())
+			keyFile := filepath.Join(home, "kibana.config", "client.key")
+			key, _ := config.Get("elasticsearch.ssl.key")
+			Expect(key).To(Equal(keyFile))
+			Expect(config.Origin("elasticsearch.ssl.key")).To(Equal("client-certificate"))
+			info, err := os.Stat(keyFile)
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("uses the client certificate of the app if the service has none", func() {
+			l.VcapServices = conf.VcapServices{"es": {{Name: "es", Credentials: map[string]interface{}{}}}}
+			l.ClientCert, l.ClientKey = "/deps/0/client.crt", "/deps/0/client.key"
+
+			config, err := l.BuildConfig()
+			Expect(err).To(BeNil())
+			cert, _ := config.Get("elasticsearch.ssl.certificate")
+			Expect(cert).To(Equal("/deps/0/client.crt"))
+		})
+
+		It("rejects keys which do not match the certificate", func() {
+			l.VcapServices = conf.VcapServices{"es": {{Name: "es", Credentials: map[string]interface{}{
+				"tls": map[string]interface{}{"cert": string(certPEM), "key": string(certPEM)},
+			}}}}
+
+			_, err := l.BuildConfig()
+			Expect(err).To(MatchError("service es: invalid client certificate: no PEM encoded private key"))
+		})
+	})
+
+	Describe("server certificate", func() {
+		var certFile, keyFile string
+
+		BeforeEach(func() {
+			certFile, keyFile = filepath.Join(root, "server.crt"), filepath.Join(root, "server.key")
+			certPEM, keyPEM := keyPair()
+			Expect(ioutil.WriteFile(certFile, certPEM, 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(keyFile, keyPEM, 0600)).To(Succeed())
+			l.ServerSsl, l.ServerCert, l.ServerKey = true, certFile, keyFile
+		})
+
+		It("enables TLS for the Kibana server unless a config file does", func() {
+			config, err := l.BuildConfig()
+			Expect(err).To(BeNil())
+			enabled, _ := config.Get("server.ssl.enabled")
+			Expect(enabled).To(Equal(true))
+			cert, _ := config.Get("server.ssl.certificate")
+			Expect(cert).To(Equal(certFile))
+
+			Expect(os.MkdirAll(filepath.Join(home, "conf.d"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(home, "conf.d", "my-kibana.yml"), []byte("server.ssl.enabled: false"), 0644)).To(Succeed())
+			config, err = l.BuildConfig()
+			Expect(err).To(BeNil())
+			_, ok := config.Get("server.ssl.certificate")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("requires a certificate", func() {
+			l.ServerCert = ""
+			_, err := l.BuildConfig()
+			Expect(err).To(MatchError(ContainSubstring("server-ssl requires a server certificate")))
+		})
+
+		It("restarts Kibana when the certificate changes", func() {
+			l.KibanaHome = home
+			l.ReloadInterval = 10 * time.Millisecond
+			Expect(os.MkdirAll(filepath.Join(home, "bin"), 0755)).To(Succeed())
+			script := "#!/bin/sh\necho started >> $(dirname $0)/calls\n[ $(wc -l < $(dirname $0)/calls) -ge 2 ] && exit 0\nexec sleep 10\n"
+			Expect(ioutil.WriteFile(filepath.Join(home, "bin", "kibana"), []byte(script), 0755)).To(Succeed())
+
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(100 * time.Millisecond)
+				certPEM, keyPEM := keyPair()
+				Expect(ioutil.WriteFile(certFile, certPEM, 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(keyFile, keyPEM, 0600)).To(Succeed())
+			}()
+
+			Expect(l.StartKibana(nil)).To(Equal(0))
+			calls, err := ioutil.ReadFile(filepath.Join(home, "bin", "calls"))
+			Expect(err).To(BeNil())
+			Expect(string(calls)).To(Equal("started\nstarted\n"))
+		})
+	})
+
+	Describe("auth", func() {
+		BeforeEach(func() {
+			l.Auth = &conf.Auth{Type: conf.AuthOidc, Service: "sso", Issuer: "https://uaa.example.com/oauth/token"}
+			l.KibanaPort = 5601
+		})
+
+		It("moves Kibana behind the proxy", func() {
+			config, err := l.BuildConfig()
+			Expect(err).To(BeNil())
+			port, _ := config.Get("server.port")
+			Expect(port).To(Equal(5601))
+			host, _ := config.Get("server.host")
+			Expect(host).To(Equal("127.0.0.1"))
+		})
+
+		It("stops Kibana when the proxy stops", func() {
+			l.KibanaHome = home
+			Expect(os.MkdirAll(filepath.Join(home, "bin"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(home, "bin", "kibana"), []byte("#!/bin/sh\nexec sleep 10\n"), 0755)).To(Succeed())
+			proxyStopped := make(chan error, 1)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				proxyStopped <- errors.New("address already in use")
+			}()
+
+			start := time.Now()
+			Expect(l.StartKibana(proxyStopped)).To(Equal(1))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			Expect(buffer.String()).To(ContainSubstring("Authentication proxy stopped: address already in use"))
+		})
+
+		It("takes the secrets from the credentials of the service", func() {
+			_, err := l.ProxyConfig()
+			Expect(err).To(MatchError("the service sso of auth is not bound"))
+
+			l.VcapServices = conf.VcapServices{"user-provided": {{Name: "sso", Credentials: map[string]interface{}{"client_id": "kibana"}}}}
+			_, err = l.ProxyConfig()
+			Expect(err).To(MatchError("service sso: oidc requires the credentials client_id and client_secret"))
+
+			l.VcapServices["user-provided"][0].Credentials["client_secret"] = "s3cr3t"
+			config, err := l.ProxyConfig()
+			Expect(err).To(BeNil())
+			Expect(config.ClientSecret).To(Equal("s3cr3t"))
+			Expect(config.SessionKey).To(HaveLen(32))
+		})
+	})
+
+	Describe("WatchFiles", func() {
+		It("reports changed files", func() {
+			file := filepath.Join(root, "watched")
+			Expect(ioutil.WriteFile(file, []byte("a"), 0644)).To(Succeed())
+			stop := make(chan struct{})
+			defer close(stop)
+
+			changes := launcher.WatchFiles([]string{file}, 10*time.Millisecond, stop)
+			Consistently(changes, 50*time.Millisecond).ShouldNot(Receive())
+			Expect(ioutil.WriteFile(file, []byte("b"), 0644)).To(Succeed())
+			Eventually(changes).Should(Receive(Equal(file)))
+		})
+	})
+
+	Describe("keystore templates", func() {
+		It("requires the Kibana keystore", func() {
+			l.KibanaHome = home
+			Expect(os.MkdirAll(filepath.Join(root, "keystore.d"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(root, "keystore.d", "a.yml"), []byte("elasticsearch.password: secret"), 0644)).To(Succeed())
+
+			Expect(l.UpdateKeystore()).To(MatchError(ContainSubstring("keystore templates require the Kibana keystore")))
+		})
+
+		It("adds the entries with kibana-keystore", func() {
+			l.KibanaHome = home
+			Expect(os.MkdirAll(filepath.Join(home, "bin"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(home, "bin", "kibana-keystore"), []byte("#!/bin/sh\necho \"$@ $(cat)\" >> $(dirname $0)/calls\n"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(root, "keystore.d"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(root, "keystore.d", "a.yml"), []byte("elasticsearch:\n  password: secret"), 0644)).To(Succeed())
+
+			Expect(l.UpdateKeystore()).To(Succeed())
+			calls, err := ioutil.ReadFile(filepath.Join(home, "bin", "calls"))
+			Expect(err).To(BeNil())
+			Expect(string(calls)).To(Equal("create \nadd --stdin --force elasticsearch.password secret\n"))
+		})
+	})
+
+	Describe("ExitCode", func() {
+		It("returns the exit code of the process", func() {
+			Expect(launcher.ExitCode(nil)).To(Equal(0))
+			Expect(launcher.ExitCode(exec.Command("sh", "-c", "exit 3").Run())).To(Equal(3))
+			Expect(launcher.ExitCode(exec.Command("sh", "-c", "kill -TERM $$").Run())).To(Equal(143))
+		})
+	})
+})
@@ -0,0 +1,104 @@
+package launcher
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"kibana/merge"
+)
+
+// ElasticsearchProblems returns the missing or unrendered Elasticsearch settings of the merged config,
+// e.g. of a template whose service is not bound. Empty optional settings like elasticsearch.password
+// are no problem, a service may not need them.
+func ElasticsearchProblems(config *merge.Config) []string {
+	problems := []string{}
+	for _, key := range config.Keys() {
+		if !strings.HasPrefix(key, "elasticsearch.") {
+			continue
+		}
+		value, _ := config.Get(key)
+		if value != nil && strings.Contains(fmt.Sprintf("%v", value), "<no value>") {
+			problems = append(problems, fmt.Sprintf("%s (%s) has no value", key, config.Origin(key)))
+		}
+	}
+
+	url, _ := config.Get("elasticsearch.url")
+	hosts, _ := config.Get("elasticsearch.hosts")
+	if url == nil && hosts == nil {
+		problems = append(problems, "neither elasticsearch.url nor elasticsearch.hosts is set")
+	}
+	return problems
+}
+
+// PlaceholderProblems returns the problems to serve the status page for, none without enable-service-fallback
+func (l *Launcher) PlaceholderProblems(config *merge.Config) []string {
+	if !l.ServiceFallback {
+		return nil
+	}
+	return ElasticsearchProblems(config)
+}
+
+var placeholderPage = template.Must(template.New("placeholder").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Kibana is waiting for Elasticsearch</title></head>
+<body>
+<h1>Kibana is waiting for Elasticsearch</h1>
+<p>Kibana was not started, because the connection to Elasticsearch is not configured:</p>
+<ul>{{ range .Problems }}<li>{{ . }}</li>{{ end }}</ul>
+{{ if .MissingServices }}<p>The following services were not bound during staging:</p>
+<ul>{{ range .MissingServices }}<li>{{ . }}</li>{{ end }}</ul>{{ end }}
+<p>This status page is served because <code>enable-service-fallback</code> is set in the Kibana file.</p>
+</body>
+</html>
+`))
+
+// ServePlaceholder serves a status page explaining the problems on $PORT instead of running Kibana.
+// It answers all requests with 200, so the app passes the health check, and stops on SIGTERM or SIGINT.
+func (l *Launcher) ServePlaceholder(problems []string) (int, error) {
+	l.Log.BeginStep("Serving status page instead of Kibana")
+	for _, problem := range problems {
+		l.Log.Warning("%s", problem)
+	}
+	for _, missing := range l.MissingServices {
+		l.Log.Warning("%s", missing)
+	}
+
+	listener, err := net.Listen("tcp", ":"+l.Port)
+	if err != nil {
+		return 1, err
+	}
+
+	server := &http.Server{Handler: l.PlaceholderHandler(problems)}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	if err := server.Serve(listener); err != nil && !isClosed(err) {
+		return 1, err
+	}
+	return 0, nil
+}
+
+// PlaceholderHandler answers all requests with the status page listing the problems and the missing services
+func (l *Launcher) PlaceholderHandler(problems []string) http.Handler {
+	data := struct{ Problems, MissingServices []string }{problems, l.MissingServices}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		placeholderPage.Execute(w, data)
+	})
+}
+
+func isClosed(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
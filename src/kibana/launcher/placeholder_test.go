@@ -0,0 +1,105 @@
+package launcher_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"kibana/launcher"
+	"kibana/merge"
+
+	"github.com/andibrunner/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ElasticsearchProblems", func() {
+	problems := func(yml string) []string {
+		config, _, err := merge.Merge([]merge.Fragment{{Name: "buildpack/cf-kibana.yml", Data: []byte(yml)}})
+		Expect(err).To(BeNil())
+		return launcher.ElasticsearchProblems(config)
+	}
+
+	It("accepts a configured Elasticsearch", func() {
+		Expect(problems("elasticsearch.url: https://es:9200\nelasticsearch.username: kibana\n")).To(BeEmpty())
+		Expect(problems("elasticsearch.hosts: ['https://es:9200']\n")).To(BeEmpty())
+	})
+
+	It("accepts a service without password", func() {
+		Expect(problems("elasticsearch.url: https://es:9200\nelasticsearch.username:\nelasticsearch.password:\n")).To(BeEmpty())
+	})
+
+	It("reports unrendered and missing settings", func() {
+		Expect(problems("server.port: 8080\nelasticsearch.url: https://es:9200\nelasticsearch.password: <no value>\n")).To(Equal([]string{
+			"elasticsearch.password (buildpack/cf-kibana.yml) has no value",
+		}))
+		Expect(problems("server.port: 8080\nelasticsearch.url:\n")).To(Equal([]string{"neither elasticsearch.url nor elasticsearch.hosts is set"}))
+		Expect(problems("server.port: 8080\n")).To(Equal([]string{"neither elasticsearch.url nor elasticsearch.hosts is set"}))
+	})
+})
+
+var _ = Describe("Placeholder", func() {
+	var (
+		l    *launcher.Launcher
+		home string
+		root string
+		err  error
+	)
+
+	BeforeEach(func() {
+		home, err = ioutil.TempDir("", "kibana-buildpack.home.")
+		Expect(err).To(BeNil())
+		root, err = ioutil.TempDir("", "kibana-buildpack.root.")
+		Expect(err).To(BeNil())
+
+		l = &launcher.Launcher{
+			Log:             libbuildpack.NewLogger(new(bytes.Buffer)),
+			Home:            home,
+			WorkDir:         home,
+			Root:            root,
+			ServiceFallback: true,
+			MissingServices: []string{"template cf-kibana: bind a service with one of the tags elasticsearch, elastic and restage the app"},
+		}
+
+		// staging installs the fallback template of the default catalog for the unbound Elasticsearch service
+		data, err := ioutil.ReadFile(filepath.Join("..", "..", "..", "defaults", "templates", "cf-kibana-fallback.yml"))
+		Expect(err).To(BeNil())
+		Expect(os.MkdirAll(filepath.Join(root, "conf.d"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(root, "conf.d", "cf-kibana-fallback.yml"), data, 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(home)).To(Succeed())
+		Expect(os.RemoveAll(root)).To(Succeed())
+		os.Unsetenv("ELASTICSEARCH_URL")
+	})
+
+	It("serves the status page for an unbound service", func() {
+		config, err := l.BuildConfig()
+		Expect(err).To(BeNil())
+		problems := l.PlaceholderProblems(config)
+		Expect(problems).To(Equal([]string{"neither elasticsearch.url nor elasticsearch.hosts is set"}))
+
+		recorder := httptest.NewRecorder()
+		l.PlaceholderHandler(problems).ServeHTTP(recorder, httptest.NewRequest("GET", "/app/kibana", nil))
+		Expect(recorder.Code).To(Equal(200))
+		Expect(recorder.Body.String()).To(ContainSubstring("<li>neither elasticsearch.url nor elasticsearch.hosts is set</li>"))
+		Expect(recorder.Body.String()).To(ContainSubstring("<li>template cf-kibana: bind a service with one of the tags elasticsearch, elastic and restage the app</li>"))
+	})
+
+	It("starts Kibana with the Elasticsearch of the fallback environment", func() {
+		os.Setenv("ELASTICSEARCH_URL", "https://es:9200")
+		config, err := l.BuildConfig()
+		Expect(err).To(BeNil())
+		Expect(l.PlaceholderProblems(config)).To(BeEmpty())
+	})
+
+	It("starts Kibana without enable-service-fallback", func() {
+		l.ServiceFallback = false
+		config, err := l.BuildConfig()
+		Expect(err).To(BeNil())
+		Expect(l.PlaceholderProblems(config)).To(BeEmpty())
+	})
+})
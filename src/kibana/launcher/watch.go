@@ -0,0 +1,49 @@
+package launcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+)
+
+// WatchFiles checks the files for changes of their content every interval and sends the name
+// of a changed file, until stop is closed. Missing files are treated as empty.
+func WatchFiles(files []string, interval time.Duration, stop <-chan struct{}) <-chan string {
+	changes := make(chan string)
+	sums := map[string][]byte{}
+	for _, file := range files {
+		sums[file] = checksum(file)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for _, file := range files {
+				sum := checksum(file)
+				if bytes.Equal(sum, sums[file]) {
+					continue
+				}
+				sums[file] = sum
+				select {
+				case changes <- file:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return changes
+}
+
+func checksum(file string) []byte {
+	data, _ := ioutil.ReadFile(file)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
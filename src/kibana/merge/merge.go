@@ -0,0 +1,161 @@
+package merge
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A Fragment is a single config file taking part in the merge
+type Fragment struct {
+	Name string
+	Data []byte
+}
+
+// A Conflict is a setting defined by more than one fragment with different values
+type Conflict struct {
+	Key    string
+	Winner string // fragment whose value is used
+	Loser  string // fragment whose value is overridden
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s: %s overrides %s", c.Key, c.Winner, c.Loser)
+}
+
+// Config is a merged Kibana configuration. Nested maps are normalized to dotted keys,
+// so "server: {host: x}" and "server.host: x" are the same setting.
+type Config struct {
+	keys    []string
+	values  map[string]interface{}
+	origins map[string]string
+}
+
+func NewConfig() *Config {
+	return &Config{values: map[string]interface{}{}, origins: map[string]string{}}
+}
+
+// Merge merges the fragments in order, later fragments win
+func Merge(fragments []Fragment) (*Config, []Conflict, error) {
+	config := NewConfig()
+	conflicts := []Conflict{}
+
+	for _, fragment := range fragments {
+		c, err := config.Add(fragment)
+		if err != nil {
+			return nil, nil, err
+		}
+		conflicts = append(conflicts, c...)
+	}
+	return config, conflicts, nil
+}
+
+// Add merges a fragment into the config
+func (c *Config) Add(fragment Fragment) (conflicts []Conflict, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: Yaml parsing error: %s", fragment.Name, r)
+		}
+	}()
+
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(fragment.Data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", fragment.Name, err.Error())
+	}
+
+	for _, setting := range flatten("", doc) {
+		for _, key := range c.overlapping(setting.Key) {
+			if key != setting.Key || !reflect.DeepEqual(c.values[key], setting.Value) {
+				conflicts = append(conflicts, Conflict{Key: key, Winner: fragment.Name, Loser: c.origins[key]})
+			}
+			c.remove(key)
+		}
+		c.Set(setting.Key, setting.Value, fragment.Name)
+	}
+	return conflicts, nil
+}
+
+// Set sets a single setting
+func (c *Config) Set(key string, value interface{}, origin string) {
+	if _, ok := c.values[key]; !ok {
+		c.keys = append(c.keys, key)
+	}
+	c.values[key] = value
+	c.origins[key] = origin
+}
+
+// Get returns the value of a setting
+func (c *Config) Get(key string) (interface{}, bool) {
+	value, ok := c.values[key]
+	return value, ok
+}
+
+// Origin returns the name of the fragment which defined a setting
+func (c *Config) Origin(key string) string {
+	return c.origins[key]
+}
+
+// Keys returns the keys of all settings in the order they were first defined
+func (c *Config) Keys() []string {
+	return append([]string{}, c.keys...)
+}
+
+// Marshal returns the merged config as yaml with dotted keys
+func (c *Config) Marshal() ([]byte, error) {
+	doc := yaml.MapSlice{}
+	for _, key := range c.keys {
+		doc = append(doc, yaml.MapItem{Key: key, Value: c.values[key]})
+	}
+	if len(doc) == 0 {
+		return []byte{}, nil
+	}
+	return yaml.Marshal(doc)
+}
+
+// overlapping returns the existing keys which are the same as key, a parent of key or a child of key
+func (c *Config) overlapping(key string) []string {
+	keys := []string{}
+	for _, existing := range c.keys {
+		if existing == key || strings.HasPrefix(key, existing+".") || strings.HasPrefix(existing, key+".") {
+			keys = append(keys, existing)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *Config) remove(key string) {
+	for i, existing := range c.keys {
+		if existing == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+	delete(c.values, key)
+	delete(c.origins, key)
+}
+
+type setting struct {
+	Key   string
+	Value interface{}
+}
+
+// flatten normalizes nested maps to dotted keys, empty maps and lists are kept as values
+func flatten(prefix string, doc yaml.MapSlice) []setting {
+	settings := []setting{}
+	for _, item := range doc {
+		key := fmt.Sprintf("%v", item.Key)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if nested, ok := item.Value.(yaml.MapSlice); ok && len(nested) > 0 {
+			settings = append(settings, flatten(key, nested)...)
+			continue
+		}
+		settings = append(settings, setting{Key: key, Value: item.Value})
+	}
+	return settings
+}
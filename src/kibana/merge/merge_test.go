@@ -0,0 +1,66 @@
+package merge_test
+
+import (
+	"kibana/merge"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Merge", func() {
+	value := func(config *merge.Config, key string) interface{} {
+		v, ok := config.Get(key)
+		Expect(ok).To(BeTrue())
+		return v
+	}
+
+	It("normalizes nested maps and dotted keys to the same setting", func() {
+		config, conflicts, err := merge.Merge([]merge.Fragment{
+			{Name: "buildpack/cf-kibana.yml", Data: []byte("server.host: 0.0.0.0\nserver.port: 8080\nelasticsearch.url: http://es:9200\n")},
+			{Name: "app/my-kibana.yml", Data: []byte("server:\n  host: 127.0.0.1\nlogging.verbose: true\n")},
+		})
+		Expect(err).To(BeNil())
+
+		Expect(value(config, "server.host")).To(Equal("127.0.0.1"))
+		Expect(config.Origin("server.host")).To(Equal("app/my-kibana.yml"))
+		Expect(value(config, "server.port")).To(Equal(8080))
+		Expect(conflicts).To(Equal([]merge.Conflict{{Key: "server.host", Winner: "app/my-kibana.yml", Loser: "buildpack/cf-kibana.yml"}}))
+
+		out, err := config.Marshal()
+		Expect(err).To(BeNil())
+		Expect(string(out)).To(Equal("server.port: 8080\nelasticsearch.url: http://es:9200\nserver.host: 127.0.0.1\nlogging.verbose: true\n"))
+	})
+
+	It("does not report settings with the same value as conflict", func() {
+		_, conflicts, err := merge.Merge([]merge.Fragment{
+			{Name: "a.yml", Data: []byte("server.port: 8080\n")},
+			{Name: "b.yml", Data: []byte("server:\n  port: 8080\n")},
+		})
+		Expect(err).To(BeNil())
+		Expect(conflicts).To(BeEmpty())
+	})
+
+	It("replaces settings which conflict in structure", func() {
+		config, conflicts, err := merge.Merge([]merge.Fragment{
+			{Name: "a.yml", Data: []byte("elasticsearch.customHeaders.X-Foo: bar\n")},
+			{Name: "b.yml", Data: []byte("elasticsearch.customHeaders: {}\n")},
+		})
+		Expect(err).To(BeNil())
+		Expect(config.Keys()).To(Equal([]string{"elasticsearch.customHeaders"}))
+		Expect(conflicts).To(HaveLen(1))
+	})
+
+	It("keeps lists as values and ignores empty fragments", func() {
+		config, _, err := merge.Merge([]merge.Fragment{
+			{Name: "empty.yml", Data: []byte("")},
+			{Name: "a.yml", Data: []byte("elasticsearch.ssl.certificateAuthorities: [\"/a.crt\", \"/b.crt\"]\n")},
+		})
+		Expect(err).To(BeNil())
+		Expect(value(config, "elasticsearch.ssl.certificateAuthorities")).To(Equal([]interface{}{"/a.crt", "/b.crt"}))
+	})
+
+	It("names the fragment with invalid yaml", func() {
+		_, _, err := merge.Merge([]merge.Fragment{{Name: "app/broken.yml", Data: []byte("a: [b\n")}})
+		Expect(err).To(MatchError(ContainSubstring("app/broken.yml")))
+	})
+})
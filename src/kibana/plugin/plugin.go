@@ -0,0 +1,195 @@
+package plugin
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Checksum returns the hex encoded SHA-256 checksum of a file
+func Checksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Verify returns an error if the SHA-256 checksum of the file is not the expected one
+func Verify(file string, expected string) error {
+	actual, err := Checksum(file)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", strings.ToLower(expected), actual)
+	}
+	return nil
+}
+
+// ScanZip returns an error if the zip archive is malformed or has entries which would be extracted
+// outside of the target directory: absolute paths, paths with .. and symbolic links
+func ScanZip(file string) error {
+	archive, err := zip.OpenReader(file)
+	if err != nil {
+		return fmt.Errorf("not a zip archive: %s", err.Error())
+	}
+	defer archive.Close()
+
+	for _, entry := range archive.File {
+		name := strings.Replace(entry.Name, `\`, "/", -1)
+		if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+			return fmt.Errorf("entry %s has an absolute path", entry.Name)
+		}
+		if cleaned := path.Clean(name); cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return fmt.Errorf("entry %s is outside of the archive directory", entry.Name)
+		}
+		if entry.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("entry %s is a symbolic link", entry.Name)
+		}
+	}
+	return nil
+}
+
+// Manifest is the part of kibana.json or package.json of a plugin which describes its compatibility
+type Manifest struct {
+	Name          string
+	Version       string
+	KibanaVersion string // the Kibana version the plugin is built for, "kibana" for any version
+}
+
+// ReadManifest reads the manifest of the plugin in a zip archive, kibana/<plugin>/kibana.json
+// or kibana/<plugin>/package.json. As kibana-plugin, it falls back to the version of the plugin
+// if package.json has no kibana.version.
+func ReadManifest(file string) (*Manifest, error) {
+	archive, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("not a zip archive: %s", err.Error())
+	}
+	defer archive.Close()
+
+	var kibanaJson, packageJson *zip.File
+	for _, entry := range archive.File {
+		parts := strings.Split(strings.Replace(entry.Name, `\`, "/", -1), "/")
+		if len(parts) != 3 || parts[0] != "kibana" {
+			continue
+		}
+		switch parts[2] {
+		case "kibana.json":
+			kibanaJson = entry
+		case "package.json":
+			packageJson = entry
+		}
+	}
+
+	if kibanaJson != nil {
+		var m struct {
+			Id            string `json:"id"`
+			Version       string `json:"version"`
+			KibanaVersion string `json:"kibanaVersion"`
+		}
+		if err := readJson(kibanaJson, &m); err != nil {
+			return nil, err
+		}
+		if m.KibanaVersion == "" {
+			m.KibanaVersion = m.Version
+		}
+		return &Manifest{Name: m.Id, Version: m.Version, KibanaVersion: m.KibanaVersion}, nil
+	}
+	if packageJson != nil {
+		var m struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			Kibana  struct {
+				Version string `json:"version"`
+			} `json:"kibana"`
+		}
+		if err := readJson(packageJson, &m); err != nil {
+			return nil, err
+		}
+		if m.Kibana.Version == "" {
+			m.Kibana.Version = m.Version
+		}
+		return &Manifest{Name: m.Name, Version: m.Version, KibanaVersion: m.Kibana.Version}, nil
+	}
+	return nil, errors.New("no kibana/<plugin>/kibana.json or package.json in the archive")
+}
+
+func readJson(entry *zip.File, v interface{}) error {
+	r, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("%s: %s", entry.Name, err.Error())
+	}
+	return nil
+}
+
+// Compatible returns true if the plugin is built for the Kibana version, build suffixes
+// like -SNAPSHOT are ignored
+func (m *Manifest) Compatible(kibanaVersion string) bool {
+	if m.KibanaVersion == "kibana" {
+		return true
+	}
+	return versionCore(m.KibanaVersion) == versionCore(kibanaVersion)
+}
+
+func versionCore(version string) string {
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		return version[:i]
+	}
+	return version
+}
+
+// ParseList returns the versions of the installed plugins by name from the output of kibana-plugin list,
+// lines like x-pack@6.1.3
+func ParseList(output string) map[string]string {
+	plugins := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.LastIndex(line, "@")
+		if i <= 0 || i == len(line)-1 || strings.ContainsAny(line, " \t") {
+			continue
+		}
+		plugins[line[:i]] = line[i+1:]
+	}
+	return plugins
+}
+
+// Download downloads the archive at url into the file
+func Download(url string, file string) error {
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
@@ -0,0 +1,156 @@
+package plugin_test
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"kibana/plugin"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plugin", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "plugin")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeZip := func(name string, entries ...string) string {
+		file := filepath.Join(dir, name)
+		out, err := os.Create(file)
+		Expect(err).To(BeNil())
+		defer out.Close()
+		w := zip.NewWriter(out)
+		for _, entry := range entries {
+			f, err := w.Create(entry)
+			Expect(err).To(BeNil())
+			f.Write([]byte("content of " + entry))
+		}
+		Expect(w.Close()).To(Succeed())
+		return file
+	}
+
+	writeZipFiles := func(name string, files map[string]string) string {
+		file := filepath.Join(dir, name)
+		out, err := os.Create(file)
+		Expect(err).To(BeNil())
+		defer out.Close()
+		w := zip.NewWriter(out)
+		for entry, content := range files {
+			f, err := w.Create(entry)
+			Expect(err).To(BeNil())
+			f.Write([]byte(content))
+		}
+		Expect(w.Close()).To(Succeed())
+		return file
+	}
+
+	Describe("ReadManifest", func() {
+		It("reads kibana.version of package.json", func() {
+			file := writeZipFiles("my-plugin.zip", map[string]string{
+				"kibana/my-plugin/index.js":     "",
+				"kibana/my-plugin/package.json": `{"name": "my-plugin", "version": "1.2.0", "kibana": {"version": "6.0.0"}}`,
+			})
+			m, err := plugin.ReadManifest(file)
+			Expect(err).To(BeNil())
+			Expect(*m).To(Equal(plugin.Manifest{Name: "my-plugin", Version: "1.2.0", KibanaVersion: "6.0.0"}))
+			Expect(m.Compatible("6.0.0")).To(BeTrue())
+			Expect(m.Compatible("6.1.3")).To(BeFalse())
+		})
+
+		It("falls back to the version of package.json", func() {
+			file := writeZipFiles("x-pack.zip", map[string]string{
+				"kibana/x-pack/package.json":              `{"name": "x-pack", "version": "6.1.3"}`,
+				"kibana/x-pack/node_modules/package.json": `{"name": "other", "version": "1.0.0"}`,
+			})
+			m, err := plugin.ReadManifest(file)
+			Expect(err).To(BeNil())
+			Expect(m.KibanaVersion).To(Equal("6.1.3"))
+			Expect(m.Compatible("6.1.3-SNAPSHOT")).To(BeTrue())
+		})
+
+		It("prefers kibanaVersion of kibana.json", func() {
+			file := writeZipFiles("new-plugin.zip", map[string]string{
+				"kibana/newPlugin/package.json": `{"name": "new-plugin", "version": "7.10.0"}`,
+				"kibana/newPlugin/kibana.json":  `{"id": "newPlugin", "version": "1.0.0", "kibanaVersion": "kibana"}`,
+			})
+			m, err := plugin.ReadManifest(file)
+			Expect(err).To(BeNil())
+			Expect(m.Name).To(Equal("newPlugin"))
+			Expect(m.Compatible("7.10.2")).To(BeTrue())
+		})
+
+		It("fails without manifest", func() {
+			file := writeZip("empty.zip", "kibana/my-plugin/index.js")
+			_, err := plugin.ReadManifest(file)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	Describe("ParseList", func() {
+		It("returns the installed plugins", func() {
+			out := "x-pack@6.1.3\nlogtrail@0.1.23\n\n"
+			Expect(plugin.ParseList(out)).To(Equal(map[string]string{"x-pack": "6.1.3", "logtrail": "0.1.23"}))
+		})
+
+		It("ignores other output", func() {
+			Expect(plugin.ParseList("No plugins installed.\n")).To(BeEmpty())
+		})
+	})
+
+	Describe("Verify", func() {
+		It("accepts the checksum in any case", func() {
+			file := filepath.Join(dir, "plugin.zip")
+			Expect(ioutil.WriteFile(file, []byte("plugin"), 0644)).To(Succeed())
+
+			sum, err := plugin.Checksum(file)
+			Expect(err).To(BeNil())
+			Expect(sum).To(Equal("5e689e2b01672bf33996e75d5e372ff60c536ce1599a1458e867cd8f4bef5160"))
+			Expect(plugin.Verify(file, "5E689E2B01672BF33996E75D5E372FF60C536CE1599A1458E867CD8F4BEF5160")).To(Succeed())
+		})
+
+		It("rejects a mismatch", func() {
+			file := filepath.Join(dir, "plugin.zip")
+			Expect(ioutil.WriteFile(file, []byte("tampered"), 0644)).To(Succeed())
+
+			err := plugin.Verify(file, "5e689e2b01672bf33996e75d5e372ff60c536ce1599a1458e867cd8f4bef5160")
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("checksum mismatch"))
+		})
+	})
+
+	Describe("ScanZip", func() {
+		It("accepts a plugin archive", func() {
+			file := writeZip("good.zip", "kibana/my-plugin/package.json", "kibana/my-plugin/index.js")
+			Expect(plugin.ScanZip(file)).To(Succeed())
+		})
+
+		It("rejects entries outside of the archive directory", func() {
+			file := writeZip("evil.zip", "kibana/my-plugin/package.json", "kibana/../../evil")
+			err := plugin.ScanZip(file)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("outside of the archive directory"))
+		})
+
+		It("rejects absolute paths", func() {
+			file := writeZip("absolute.zip", "/etc/evil")
+			Expect(plugin.ScanZip(file)).NotTo(Succeed())
+		})
+
+		It("rejects files which are not zip archives", func() {
+			file := filepath.Join(dir, "plugin.zip")
+			Expect(ioutil.WriteFile(file, []byte("no zip"), 0644)).To(Succeed())
+			Expect(plugin.ScanZip(file)).NotTo(Succeed())
+		})
+	})
+})
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateLoader returns a tls.Config.GetCertificate function which reloads the certificate
+// when its files change, e.g. when Cloud Foundry rotates the instance identity certificate
+func CertificateLoader(certFile string, keyFile string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var (
+		mutex       sync.Mutex
+		certificate *tls.Certificate
+		modified    time.Time
+	)
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		latest := time.Time{}
+		for _, file := range []string{certFile, keyFile} {
+			if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+		if certificate != nil && !latest.After(modified) {
+			return certificate, nil
+		}
+
+		loaded, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			if certificate != nil {
+				return certificate, nil // keep the previous certificate while the files are replaced
+			}
+			return nil, err
+		}
+		certificate, modified = &loaded, latest
+		return certificate, nil
+	}
+}
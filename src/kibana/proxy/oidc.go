@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidc implements the authorization code flow of OpenID Connect
+type oidc struct {
+	config Config
+
+	mutex     sync.Mutex
+	discovery *discovery
+}
+
+// discovery is the part of the OpenID provider metadata used by the proxy
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// claims of the ID token used by the proxy
+type claims struct {
+	Issuer        string      `json:"iss"`
+	Audience      interface{} `json:"aud"` // a string or a list of strings
+	Expires       int64       `json:"exp"`
+	Nonce         string      `json:"nonce"`
+	Subject       string      `json:"sub"`
+	UserName      string      `json:"user_name"` // UAA
+	Email         string      `json:"email"`
+	EmailVerified bool        `json:"email_verified"`
+}
+
+// metadata returns the provider metadata of the issuer, fetched on first use
+// so the proxy starts even if the issuer is not reachable
+func (o *oidc) metadata() (*discovery, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	issuer := strings.TrimSuffix(o.config.Issuer, "/")
+	resp, err := o.config.Client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openid configuration of %s: %s", issuer, resp.Status)
+	}
+	d := &discovery{}
+	if err := json.NewDecoder(resp.Body).Decode(d); err != nil {
+		return nil, fmt.Errorf("openid configuration of %s: %s", issuer, err.Error())
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("openid configuration of %s is for issuer %s", issuer, d.Issuer)
+	}
+	o.discovery = d
+	return d, nil
+}
+
+// login redirects to the authorization endpoint of the issuer, the state cookie protects
+// the callback against forged requests and holds the path to return to
+func (p *Proxy) login(w http.ResponseWriter, r *http.Request) {
+	d, err := p.oidc.metadata()
+	if err != nil {
+		p.Log.Error("Unable to log in: %s", err.Error())
+		http.Error(w, "The login service is not available", http.StatusBadGateway)
+		return
+	}
+
+	state, nonce := randomString(), randomString()
+	writeSession(w, r, stateCookie, session{Value: state + " " + r.URL.RequestURI(), Nonce: nonce, Expires: time.Now().Add(10 * time.Minute).Unix()}, p.config.SessionKey)
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientId)
+	query.Set("redirect_uri", redirectUri(r))
+	query.Set("scope", strings.Join(append([]string{"openid"}, p.config.Scopes...), " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// callback exchanges the authorization code for the ID token and starts the session
+func (p *Proxy) callback(w http.ResponseWriter, r *http.Request) {
+	login, ok := readSessionCookie(r, stateCookie, p.config.SessionKey)
+	parts := strings.SplitN(login.Value, " ", 2)
+	if !ok || len(parts) != 2 || r.URL.Query().Get("state") != parts[0] {
+		http.Error(w, "Invalid login state, please try again", http.StatusBadRequest)
+		return
+	}
+	clearCookie(w, stateCookie)
+	if message := r.URL.Query().Get("error"); message != "" {
+		http.Error(w, "Login failed: "+message, http.StatusForbidden)
+		return
+	}
+
+	c, err := p.oidc.exchange(r.URL.Query().Get("code"), redirectUri(r))
+	if err != nil {
+		p.Log.Warning("Login failed: %s", err.Error())
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	if c.Nonce != login.Nonce {
+		p.Log.Warning("Login failed: invalid nonce")
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	user := c.user()
+	if !p.allowed(c) {
+		p.Log.Warning("User %s is not allowed to log in", user)
+		http.Error(w, fmt.Sprintf("User %s is not allowed to use this Kibana", user), http.StatusForbidden)
+		return
+	}
+
+	p.Log.Info("User %s logged in", user)
+	writeSession(w, r, sessionCookie, session{Value: user, Expires: time.Now().Add(p.config.SessionTTL).Unix()}, p.config.SessionKey)
+	http.Redirect(w, r, localPath(parts[1]), http.StatusFound)
+}
+
+// localPath returns the path if it is a path of the route, "/" for other URLs like //example.com
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+// exchange redeems the authorization code at the token endpoint. The ID token is received directly
+// from the issuer over TLS, so its issuer, audience and expiry are checked but not its signature.
+func (o *oidc) exchange(code string, redirectUri string) (*claims, error) {
+	d, err := o.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectUri)
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.config.ClientId), url.QueryEscape(o.config.ClientSecret))
+
+	resp, err := o.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: %s", err.Error())
+	}
+
+	parts := strings.Split(tokens.IdToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("no ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %s", err.Error())
+	}
+	c := &claims{}
+	if err := json.Unmarshal(payload, c); err != nil {
+		return nil, fmt.Errorf("invalid ID token: %s", err.Error())
+	}
+	if strings.TrimSuffix(c.Issuer, "/") != strings.TrimSuffix(d.Issuer, "/") {
+		return nil, fmt.Errorf("ID token of issuer %s", c.Issuer)
+	}
+	if !c.hasAudience(o.config.ClientId) {
+		return nil, errors.New("ID token for another client")
+	}
+	if time.Now().Unix() > c.Expires {
+		return nil, errors.New("expired ID token")
+	}
+	return c, nil
+}
+
+func (c *claims) hasAudience(clientId string) bool {
+	switch aud := c.Audience.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identities returns the claims compared with the allowed users: the UAA user name, the email only if the
+// issuer verified it, since some issuers let users set any email, and the subject. preferred_username is
+// not used, users can choose it freely at many issuers.
+func (c *claims) identities() []string {
+	identities := []string{}
+	for _, identity := range []string{c.UserName, c.verifiedEmail(), c.Subject} {
+		if identity != "" {
+			identities = append(identities, identity)
+		}
+	}
+	return identities
+}
+
+func (c *claims) verifiedEmail() string {
+	if c.EmailVerified {
+		return c.Email
+	}
+	return ""
+}
+
+// user returns the user name, the verified email or the subject
+func (c *claims) user() string {
+	if identities := c.identities(); len(identities) > 0 {
+		return identities[0]
+	}
+	return ""
+}
+
+// allowed returns true if the user name, verified email or subject of the claims is one of the allowed users
+func (p *Proxy) allowed(c *claims) bool {
+	if len(p.config.AllowedUsers) == 0 {
+		return true
+	}
+	for _, allowed := range p.config.AllowedUsers {
+		for _, identity := range c.identities() {
+			if strings.EqualFold(identity, allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redirectUri returns the callback URL of the route of the request.
+// X-Forwarded-Proto is sent by the client, it is trusted because the gorouter overwrites it
+// with the protocol of the client connection
+func redirectUri(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + CallbackPath
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
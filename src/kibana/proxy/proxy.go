@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andibrunner/libbuildpack"
+)
+
+// paths handled by the proxy itself
+const (
+	CallbackPath = "/auth/callback"
+	LogoutPath   = "/auth/logout"
+)
+
+// Config holds the settings and the secrets of the authentication proxy
+type Config struct {
+	Type         string            // basic or oidc
+	Users        map[string]string // basic: passwords by user name, plain or as sha256:<hex>
+	Issuer       string            // oidc: issuer URL
+	ClientId     string            // oidc: client credentials
+	ClientSecret string
+	Scopes       []string      // oidc: additional scopes
+	AllowedUsers []string      // oidc: user names or emails allowed to log in, any user if empty
+	SessionKey   []byte        // oidc: key of the session cookies, the same for all instances of the app
+	SessionTTL   time.Duration // oidc: lifetime of a session, 8 hours if 0
+	Client       *http.Client  // oidc: client for the issuer, http.DefaultClient if nil
+}
+
+// Proxy authenticates the requests with basic auth or OpenID Connect and forwards them to Kibana
+type Proxy struct {
+	Log     *libbuildpack.Logger
+	config  Config
+	target  *url.URL
+	forward *httputil.ReverseProxy
+	oidc    *oidc
+}
+
+// New creates an authentication proxy for Kibana listening on target
+func New(config Config, target *url.URL, logger *libbuildpack.Logger) (*Proxy, error) {
+	p := &Proxy{Log: logger, config: config, target: target, forward: httputil.NewSingleHostReverseProxy(target)}
+	switch config.Type {
+	case "basic":
+		if len(config.Users) == 0 {
+			return nil, errors.New("basic auth requires at least one user")
+		}
+	case "oidc":
+		if config.Issuer == "" || config.ClientId == "" || config.ClientSecret == "" {
+			return nil, errors.New("oidc requires the issuer, the client id and the client secret")
+		}
+		if len(config.SessionKey) == 0 {
+			return nil, errors.New("oidc requires a session key")
+		}
+		if p.config.SessionTTL == 0 {
+			p.config.SessionTTL = 8 * time.Hour
+		}
+		if p.config.Client == nil {
+			p.config.Client = http.DefaultClient
+		}
+		p.oidc = &oidc{config: p.config}
+	default:
+		return nil, fmt.Errorf("unknown auth type '%s'", config.Type)
+	}
+	return p, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == LogoutPath {
+		p.logout(w, r)
+		return
+	}
+	if p.oidc != nil && r.URL.Path == CallbackPath {
+		p.callback(w, r)
+		return
+	}
+
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// Kibana must neither see the credentials of the proxy nor a user header set by the client
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Forwarded-User", user)
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+
+	if isUpgrade(r) {
+		p.forwardUpgrade(w, r)
+		return
+	}
+	p.forward.ServeHTTP(w, r)
+}
+
+// authenticate returns the user of the request, otherwise it answers the request and returns false
+func (p *Proxy) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if p.oidc == nil {
+		user, password, ok := r.BasicAuth()
+		if ok && p.checkPassword(user, password) {
+			return user, true
+		}
+		if ok {
+			p.Log.Warning("Authentication of user %s failed", user)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="Kibana"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+
+	if user, ok := readSession(r, sessionCookie, p.config.SessionKey); ok {
+		return user, true
+	}
+	if isApiRequest(r) {
+		// Kibana's browser app sends kbn-xsrf with its API requests, they can not follow a login redirect
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"statusCode":401,"error":"Unauthorized","message":"session expired, please reload"}`)
+		return "", false
+	}
+	p.login(w, r)
+	return "", false
+}
+
+// checkPassword compares the password with the password of the user in constant time
+func (p *Proxy) checkPassword(user string, password string) bool {
+	expected, ok := p.config.Users[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(expected, "sha256:") {
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(strings.TrimPrefix(expected, "sha256:")))) == 1
+	}
+	given, wanted := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(given[:], wanted[:]) == 1
+}
+
+func (p *Proxy) logout(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, sessionCookie)
+	if p.oidc == nil {
+		// browsers forget basic auth credentials only with a 401
+		w.Header().Set("WWW-Authenticate", `Basic realm="Kibana"`)
+		http.Error(w, "Logged out", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<!DOCTYPE html><html><body><p>Logged out. <a href="/">Log in again</a></p></body></html>`)
+}
+
+// isApiRequest returns true for requests of scripts, which get a 401 instead of a login redirect
+func isApiRequest(r *http.Request) bool {
+	return r.Header.Get("kbn-xsrf") != "" || r.Header.Get("X-Requested-With") != "" ||
+		(r.Method != http.MethodGet && r.Method != http.MethodHead)
+}
+
+// isUpgrade returns true for websocket requests, which the reverse proxy of Go does not forward
+func isUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardUpgrade forwards a websocket request to Kibana and copies the connections in both directions
+func (p *Proxy) forwardUpgrade(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websockets are not supported", http.StatusInternalServerError)
+		return
+	}
+	backend, err := net.DialTimeout("tcp", p.target.Host, 10*time.Second)
+	if err != nil {
+		p.Log.Warning("Unable to connect to Kibana: %s", err.Error())
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer backend.Close()
+
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		p.Log.Warning("Unable to forward websocket: %s", err.Error())
+		return
+	}
+	defer client.Close()
+
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		r.Header.Set("X-Forwarded-For", strings.TrimPrefix(r.Header.Get("X-Forwarded-For")+", "+clientIP, ", "))
+	}
+	if err := r.Write(backend); err != nil {
+		p.Log.Warning("Unable to forward websocket: %s", err.Error())
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, buffered) // also data the client sent after the request
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,235 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"kibana/proxy"
+
+	"github.com/andibrunner/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// noRedirects is a client which returns redirects instead of following them
+var noRedirects = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+var _ = Describe("Proxy", func() {
+	var (
+		kibana   *httptest.Server
+		frontend *httptest.Server
+		received *http.Request
+	)
+
+	BeforeEach(func() {
+		kibana = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			io.WriteString(w, "kibana")
+		}))
+	})
+
+	AfterEach(func() {
+		kibana.Close()
+		if frontend != nil {
+			frontend.Close()
+		}
+	})
+
+	start := func(config proxy.Config) {
+		target, _ := url.Parse(kibana.URL)
+		p, err := proxy.New(config, target, libbuildpack.NewLogger(ioutil.Discard))
+		Expect(err).To(BeNil())
+		frontend = httptest.NewServer(p)
+	}
+
+	Describe("basic auth", func() {
+		BeforeEach(func() {
+			// sha256 of "secret"
+			start(proxy.Config{Type: "basic", Users: map[string]string{
+				"alice": "wonderland",
+				"bob":   "sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+			}})
+		})
+
+		It("requires the credentials of a user", func() {
+			resp, err := http.Get(frontend.URL + "/app/kibana")
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(resp.Header.Get("WWW-Authenticate")).To(Equal(`Basic realm="Kibana"`))
+
+			req, _ := http.NewRequest("GET", frontend.URL+"/app/kibana", nil)
+			req.SetBasicAuth("alice", "secret")
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("forwards authenticated requests without the credentials", func() {
+			req, _ := http.NewRequest("POST", frontend.URL+"/api/saved_objects", strings.NewReader("{}"))
+			req.SetBasicAuth("bob", "secret")
+			req.Header.Set("kbn-xsrf", "true")
+			req.Header.Set("X-Forwarded-User", "admin")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(received.Header.Get("kbn-xsrf")).To(Equal("true"))
+			Expect(received.Header.Get("Authorization")).To(Equal(""))
+			Expect(received.Header.Get("X-Forwarded-User")).To(Equal("bob"))
+		})
+
+		It("forwards websockets", func() {
+			kibana.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, buffered, _ := w.(http.Hijacker).Hijack()
+				defer conn.Close()
+				io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+				line, _ := buffered.ReadString('\n')
+				io.WriteString(conn, "echo "+line)
+			})
+
+			conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			auth := base64.StdEncoding.EncodeToString([]byte("alice:wonderland"))
+			io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: kibana\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nAuthorization: Basic "+auth+"\r\n\r\nhello\n")
+
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			Expect(reader.ReadString('\n')).To(Equal("echo hello\n"))
+		})
+	})
+
+	Describe("oidc", func() {
+		var (
+			issuer   *httptest.Server
+			nonce    string
+			user     string
+			verified bool
+			extra    map[string]interface{}
+		)
+
+		BeforeEach(func() {
+			user = "alice@example.com"
+			verified = true
+			extra = map[string]interface{}{}
+			issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/.well-known/openid-configuration":
+					json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "authorization_endpoint": issuer.URL + "/oauth/authorize", "token_endpoint": issuer.URL + "/oauth/token"})
+				case "/oauth/token":
+					if id, secret, _ := r.BasicAuth(); id != "kibana" || secret != "s3cr3t" || r.FormValue("code") != "the-code" {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					values := map[string]interface{}{"iss": issuer.URL, "aud": []string{"kibana"}, "exp": time.Now().Add(time.Minute).Unix(), "nonce": nonce, "sub": "0815", "email": user, "email_verified": verified}
+					for key, value := range extra {
+						values[key] = value
+					}
+					claims, _ := json.Marshal(values)
+					json.NewEncoder(w).Encode(map[string]string{"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"})
+				}
+			}))
+			start(proxy.Config{Type: "oidc", Issuer: issuer.URL, ClientId: "kibana", ClientSecret: "s3cr3t", AllowedUsers: []string{"alice@example.com"}, SessionKey: []byte("key")})
+		})
+
+		AfterEach(func() {
+			issuer.Close()
+		})
+
+		// login follows the login redirect and returns the response of the callback
+		login := func() *http.Response {
+			resp, err := noRedirects.Get(frontend.URL + "/app/kibana?x=1")
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusFound))
+			authorize, err := url.Parse(resp.Header.Get("Location"))
+			Expect(err).To(BeNil())
+			Expect(authorize.Path).To(Equal("/oauth/authorize"))
+			Expect(authorize.Query().Get("redirect_uri")).To(Equal(frontend.URL + proxy.CallbackPath))
+			nonce = authorize.Query().Get("nonce")
+
+			req, _ := http.NewRequest("GET", frontend.URL+proxy.CallbackPath+"?code=the-code&state="+authorize.Query().Get("state"), nil)
+			for _, cookie := range resp.Cookies() {
+				req.AddCookie(cookie)
+			}
+			resp, err = noRedirects.Do(req)
+			Expect(err).To(BeNil())
+			return resp
+		}
+
+		It("logs in with the issuer and keeps the session", func() {
+			resp := login()
+			Expect(resp.StatusCode).To(Equal(http.StatusFound))
+			Expect(resp.Header.Get("Location")).To(Equal("/app/kibana?x=1"))
+
+			req, _ := http.NewRequest("GET", frontend.URL+"/app/kibana", nil)
+			for _, cookie := range resp.Cookies() {
+				req.AddCookie(cookie)
+			}
+			resp, err := noRedirects.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(received.Header.Get("X-Forwarded-User")).To(Equal("alice@example.com"))
+		})
+
+		It("rejects users who are not allowed", func() {
+			user = "mallory@example.com"
+			Expect(login().StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("rejects allowed emails which are not verified", func() {
+			verified = false
+			Expect(login().StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("ignores the preferred_username claim, which users can choose", func() {
+			user = "mallory@example.com"
+			extra["preferred_username"] = "alice@example.com"
+			Expect(login().StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("allows the UAA user name and the subject", func() {
+			user = "mallory@example.com"
+			extra["user_name"] = "alice@example.com"
+			Expect(login().StatusCode).To(Equal(http.StatusFound))
+
+			extra = map[string]interface{}{"sub": "alice@example.com"}
+			Expect(login().StatusCode).To(Equal(http.StatusFound))
+		})
+
+		It("rejects callbacks without login state", func() {
+			resp, err := noRedirects.Get(frontend.URL + proxy.CallbackPath + "?code=the-code&state=forged")
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
+		It("answers API requests without session with 401", func() {
+			req, _ := http.NewRequest("GET", frontend.URL+"/api/status", nil)
+			req.Header.Set("kbn-xsrf", "true")
+			resp, err := noRedirects.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			body, _ := ioutil.ReadAll(resp.Body)
+			Expect(bytes.Contains(body, []byte("session expired"))).To(BeTrue())
+		})
+	})
+
+	It("rejects incomplete configurations", func() {
+		_, err := proxy.New(proxy.Config{Type: "basic"}, &url.URL{}, nil)
+		Expect(err).To(MatchError("basic auth requires at least one user"))
+		_, err = proxy.New(proxy.Config{Type: "oidc", Issuer: "https://uaa"}, &url.URL{}, nil)
+		Expect(err).To(MatchError("oidc requires the issuer, the client id and the client secret"))
+	})
+})
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cookies of the proxy
+const (
+	sessionCookie = "kibana_auth_session"
+	stateCookie   = "kibana_auth_state"
+)
+
+// session is the content of a signed cookie
+type session struct {
+	Value   string `json:"v"` // user of a session, state and return path of a login
+	Nonce   string `json:"n,omitempty"`
+	Expires int64  `json:"e"`
+}
+
+// writeSession sets a cookie with the session signed by key
+func writeSession(w http.ResponseWriter, r *http.Request, name string, s session, key []byte) {
+	payload, _ := json.Marshal(s)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    encoded + "." + base64.RawURLEncoding.EncodeToString(sign(encoded, key)),
+		Path:     "/",
+		Expires:  time.Unix(s.Expires, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+	})
+}
+
+// readSession returns the value of the session cookie, if it is signed by key and not expired
+func readSession(r *http.Request, name string, key []byte) (string, bool) {
+	s, ok := readSessionCookie(r, name, key)
+	return s.Value, ok
+}
+
+func readSessionCookie(r *http.Request, name string, key []byte) (session, bool) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session{}, false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 2 {
+		return session{}, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, sign(parts[0], key)) {
+		return session{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return session{}, false
+	}
+	var s session
+	if err := json.Unmarshal(payload, &s); err != nil || time.Now().Unix() > s.Expires {
+		return session{}, false
+	}
+	return s, true
+}
+
+func clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+func sign(value string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,306 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"kibana/merge"
+	"kibana/util"
+)
+
+// Kind is the expected type of the value of a Kibana setting
+type Kind int
+
+const (
+	String Kind = iota
+	Int
+	Bool
+	List
+	StringOrList
+	Map // any settings below the key are allowed
+	Any // any value and any settings below the key are allowed
+)
+
+// An Issue is an unknown or malformed setting of the merged kibana.yml
+type Issue struct {
+	Key     string
+	Origin  string // config file which defined the setting
+	Message string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s (%s): %s", i.Key, i.Origin, i.Message)
+}
+
+// Schema contains the known settings of a Kibana major version
+type Schema struct {
+	Major    int
+	Settings map[string]Kind
+	Enums    map[string][]string
+}
+
+// settings known by all supported Kibana versions
+var common = map[string]Kind{
+	"server.port":                              Int,
+	"server.host":                              String,
+	"server.basePath":                          String,
+	"server.defaultRoute":                      String,
+	"server.maxPayloadBytes":                   Int,
+	"server.name":                              String,
+	"server.customResponseHeaders":             Map,
+	"server.ssl.enabled":                       Bool,
+	"server.ssl.key":                           String,
+	"server.ssl.keyPassphrase":                 String,
+	"server.ssl.certificateAuthorities":        StringOrList,
+	"server.ssl.supportedProtocols":            List,
+	"server.ssl.cipherSuites":                  List,
+	"server.ssl.redirectHttpFromPort":          Int,
+	"server.ssl.clientAuthentication":          String,
+	"server.xsrf.whitelist":                    List,
+	"server.xsrf.token":                        String,
+	"server.cors":                              Any,
+	"elasticsearch.preserveHost":               Bool,
+	"elasticsearch.username":                   String,
+	"elasticsearch.password":                   String,
+	"elasticsearch.ssl.certificate":            String,
+	"elasticsearch.ssl.key":                    String,
+	"elasticsearch.ssl.keyPassphrase":          String,
+	"elasticsearch.ssl.certificateAuthorities": StringOrList,
+	"elasticsearch.ssl.verificationMode":       String,
+	"elasticsearch.pingTimeout":                Int,
+	"elasticsearch.requestTimeout":             Int,
+	"elasticsearch.requestHeadersWhitelist":    List,
+	"elasticsearch.customHeaders":              Map,
+	"elasticsearch.shardTimeout":               Int,
+	"elasticsearch.startupTimeout":             Int,
+	"elasticsearch.logQueries":                 Bool,
+	"elasticsearch.apiVersion":                 String,
+	"elasticsearch.healthCheck.delay":          Int,
+	"kibana.index":                             String,
+	"kibana.defaultAppId":                      String,
+	"kibana.enabled":                           Bool,
+	"kibana.autocompleteTerminateAfter":        Int,
+	"kibana.autocompleteTimeout":               Int,
+	"logging.dest":                             String,
+	"logging.silent":                           Bool,
+	"logging.quiet":                            Bool,
+	"logging.verbose":                          Bool,
+	"logging.json":                             Bool,
+	"logging.events":                           Map,
+	"logging.filter":                           Map,
+	"logging.useUTC":                           Bool,
+	"ops.interval":                             Int,
+	"pid.file":                                 String,
+	"pid.exclusive":                            Bool,
+	"path.data":                                String,
+	"status.allowAnonymous":                    Bool,
+	"cpu.cgroup.path.override":                 String,
+	"cpuacct.cgroup.path.override":             String,
+	"optimize":                                 Any,
+	"plugins.scanDirs":                         List,
+	"plugins.paths":                            List,
+	"plugins.initialize":                       Bool,
+	"console":                                  Any,
+	"timelion":                                 Any,
+	"xpack":                                    Any,
+	"metrics":                                  Any,
+	"kibana_legacy":                            Any,
+}
+
+// settings which differ between the major versions
+var versions = map[int]map[string]Kind{
+	5: {
+		"server.ssl.cert":     String,
+		"elasticsearch.url":   String,
+		"elasticsearch.ssl":   Any, // 5.x also knows the deprecated ssl.cert/ssl.ca settings
+		"elasticsearch.tribe": Any,
+		"tilemap":             Any,
+		"regionmap":           Any,
+		"status.v6ApiFormat":  Bool,
+	},
+	6: {
+		"server.ssl.certificate":               String,
+		"server.rewriteBasePath":               Bool,
+		"elasticsearch.url":                    String,
+		"elasticsearch.hosts":                  StringOrList,
+		"elasticsearch.sniffOnStart":           Bool,
+		"elasticsearch.sniffInterval":          Any,
+		"elasticsearch.sniffOnConnectionFault": Bool,
+		"elasticsearch.tribe":                  Any,
+		"tilemap":                              Any,
+		"regionmap":                            Any,
+		"map":                                  Any,
+		"i18n.defaultLocale":                   String,
+		"i18n.locale":                          String,
+		"status.v6ApiFormat":                   Bool,
+		"vega":                                 Any,
+		"csp.rules":                            List,
+		"csp.strict":                           Bool,
+		"csp.warnLegacyBrowsers":               Bool,
+		"savedObjects":                         Any,
+		"telemetry":                            Any,
+		"newsfeed":                             Any,
+	},
+	7: {
+		"server.ssl.certificate":               String,
+		"server.rewriteBasePath":               Bool,
+		"server.compression":                   Any,
+		"server.socketTimeout":                 Int,
+		"server.keepaliveTimeout":              Int,
+		"elasticsearch.hosts":                  StringOrList,
+		"elasticsearch.sniffOnStart":           Bool,
+		"elasticsearch.sniffInterval":          Any,
+		"elasticsearch.sniffOnConnectionFault": Bool,
+		"logging.rotate":                       Any,
+		"logging.timezone":                     String,
+		"map":                                  Any,
+		"i18n.locale":                          String,
+		"vega":                                 Any,
+		"csp.rules":                            List,
+		"csp.strict":                           Bool,
+		"csp.warnLegacyBrowsers":               Bool,
+		"savedObjects":                         Any,
+		"telemetry":                            Any,
+		"newsfeed":                             Any,
+		"migrations":                           Any,
+		"data":                                 Any,
+		"apm_oss":                              Any,
+		"home":                                 Any,
+		"security":                             Any,
+		"monitoring":                           Any,
+		"usageCollection":                      Any,
+	},
+}
+
+var enums = map[string][]string{
+	"elasticsearch.ssl.verificationMode": {"full", "certificate", "none"},
+	"server.ssl.clientAuthentication":    {"required", "optional", "none"},
+}
+
+// ForVersion returns the schema for the major version of a Kibana version like 6.1.3
+func ForVersion(version string) (*Schema, error) {
+	major, err := strconv.Atoi(strings.Split(version, ".")[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kibana version '%s'", version)
+	}
+	specific, ok := versions[major]
+	if !ok {
+		return nil, fmt.Errorf("no known settings for Kibana %d.x", major)
+	}
+
+	s := &Schema{Major: major, Settings: map[string]Kind{}, Enums: enums}
+	for key, kind := range common {
+		s.Settings[key] = kind
+	}
+	for key, kind := range specific {
+		s.Settings[key] = kind
+	}
+	return s, nil
+}
+
+// Check validates all settings of a merged config. Settings below the id of a plugin
+// (e.g. "my_plugin.enabled" for plugin "my-plugin") are not checked.
+func (s *Schema) Check(config *merge.Config, plugins []string) []Issue {
+	pluginIds := map[string]bool{}
+	for _, plugin := range plugins {
+		pluginIds[pluginId(plugin)] = true
+	}
+
+	issues := []Issue{}
+	for _, key := range config.Keys() {
+		value, _ := config.Get(key)
+		if pluginIds[pluginId(strings.Split(key, ".")[0])] {
+			continue
+		}
+		if message := s.check(key, value); message != "" {
+			issues = append(issues, Issue{Key: key, Origin: config.Origin(key), Message: message})
+		}
+	}
+	return issues
+}
+
+func (s *Schema) check(key string, value interface{}) string {
+	if str, ok := value.(string); ok && strings.Contains(str, "<no value>") {
+		return "template expression without value (is the service bound?)"
+	}
+
+	kind, ok := s.Settings[key]
+	if !ok {
+		// settings below a map or a plugin namespace
+		parts := strings.Split(key, ".")
+		for i := len(parts) - 1; i > 0; i-- {
+			if parent, ok := s.Settings[strings.Join(parts[:i], ".")]; ok && (parent == Map || parent == Any) {
+				return ""
+			}
+		}
+		message := fmt.Sprintf("unknown setting for Kibana %d.x", s.Major)
+		if suggestion := s.closest(key); suggestion != "" {
+			message += fmt.Sprintf(" (did you mean '%s'?)", suggestion)
+		}
+		return message
+	}
+
+	if value == nil {
+		return ""
+	}
+	switch kind {
+	case String:
+		if _, ok := value.(string); !ok {
+			if isComposite(value) {
+				return "must be a string"
+			}
+		}
+	case Int:
+		if _, ok := value.(int); !ok {
+			return fmt.Sprintf("must be an integer, got '%v'", value)
+		}
+	case Bool:
+		if _, ok := value.(bool); !ok {
+			return fmt.Sprintf("must be true or false, got '%v'", value)
+		}
+	case List:
+		if _, ok := value.([]interface{}); !ok {
+			return "must be a list"
+		}
+	case StringOrList:
+		if _, ok := value.([]interface{}); !ok && isComposite(value) {
+			return "must be a string or a list"
+		}
+	}
+
+	if allowed, ok := s.Enums[key]; ok {
+		for _, a := range allowed {
+			if fmt.Sprintf("%v", value) == a {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %s, got '%v'", strings.Join(allowed, ", "), value)
+	}
+	return ""
+}
+
+// closest returns the known setting which is closest to an unknown key
+func (s *Schema) closest(key string) string {
+	candidates := []string{}
+	for known := range s.Settings {
+		candidates = append(candidates, known)
+	}
+	sort.Strings(candidates) // deterministic suggestion for equally close settings
+	return util.ClosestMatch(key, candidates)
+}
+
+func isComposite(value interface{}) bool {
+	switch value.(type) {
+	case []interface{}, yaml.MapSlice:
+		return true
+	}
+	return false
+}
+
+// pluginId normalizes a plugin name to the config prefix Kibana derives from the plugin id
+func pluginId(name string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(name))
+}
@@ -0,0 +1,59 @@
+package schema_test
+
+import (
+	"kibana/merge"
+	"kibana/schema"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema", func() {
+	check := func(version string, yml string, plugins ...string) []schema.Issue {
+		config, _, err := merge.Merge([]merge.Fragment{{Name: "app/kibana.yml", Data: []byte(yml)}})
+		Expect(err).To(BeNil())
+		s, err := schema.ForVersion(version)
+		Expect(err).To(BeNil())
+		return s.Check(config, plugins)
+	}
+
+	It("accepts known settings", func() {
+		Expect(check("6.1.3", "server.port: 8080\nserver:\n  host: 0.0.0.0\nelasticsearch.url: http://es:9200\nlogging.events:\n  log: ['info']\nxpack.security.enabled: false\n")).To(BeEmpty())
+	})
+
+	It("reports unknown settings with a suggestion", func() {
+		Expect(check("6.1.3", "server.hostt: 0.0.0.0\n")).To(Equal([]schema.Issue{
+			{Key: "server.hostt", Origin: "app/kibana.yml", Message: "unknown setting for Kibana 6.x (did you mean 'server.host'?)"},
+		}))
+	})
+
+	It("knows the settings of the major version", func() {
+		Expect(check("6.8.0", "elasticsearch.hosts: ['http://es:9200']\n")).To(BeEmpty())
+		Expect(check("5.6.2", "elasticsearch.hosts: ['http://es:9200']\n")).To(HaveLen(1))
+		Expect(check("7.4.0", "elasticsearch.url: http://es:9200\n")).To(HaveLen(1))
+	})
+
+	It("reports malformed values", func() {
+		issues := check("6.1.3", "server.port: abc\nlogging.verbose: yes please\nelasticsearch.ssl.verificationMode: some\nelasticsearch.url: '<no value>'\n")
+		messages := []string{}
+		for _, issue := range issues {
+			messages = append(messages, issue.String())
+		}
+		Expect(messages).To(Equal([]string{
+			"server.port (app/kibana.yml): must be an integer, got 'abc'",
+			"logging.verbose (app/kibana.yml): must be true or false, got 'yes please'",
+			"elasticsearch.ssl.verificationMode (app/kibana.yml): must be one of full, certificate, none, got 'some'",
+			"elasticsearch.url (app/kibana.yml): template expression without value (is the service bound?)",
+		}))
+	})
+
+	It("does not check the settings of installed plugins", func() {
+		Expect(check("6.1.3", "my_plugin.enabled: true\n", "my-plugin")).To(BeEmpty())
+		Expect(check("6.1.3", "my_plugin.enabled: true\n")).To(HaveLen(1))
+	})
+
+	It("has no schema for unknown major versions", func() {
+		_, err := schema.ForVersion("4.6.0")
+		Expect(err).To(MatchError("no known settings for Kibana 4.x"))
+	})
+})
@@ -14,6 +14,26 @@ import (
 	"kibana/util"
 	"os/exec"
 	"encoding/json"
+	"golang"
+	"kibana/certs"
+	"kibana/launcher"
+	pluginutil "kibana/plugin"
+	"kibana/proxy"
+	"kibana/schema"
+	"kibana/template"
+	"regexp"
+	"time"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"net"
+	"net/url"
+	"path"
+
+	"gopkg.in/yaml.v2"
 )
 
 type Manifest interface {
@@ -43,18 +63,28 @@ type Supplier struct {
 	BuildpackDir         string
 	CachedDeps           map[string]string
 	DepCacheDir			 string
-	GTE                  Dependency
-	Jq                   Dependency
 	Kibana               Dependency
 	KibanaPlugins        Dependency
 	XPack                Dependency
 	KibanaConfig         conf.KibanaConfig
+	KibanaConfigOrigins  map[string]conf.Source
 	TemplatesConfig      conf.TemplatesConfig
 	VcapApp              conf.VcapApp
 	VcapServices         conf.VcapServices
 	ConfigFilesExists    bool
 	TemplatesToInstall   []conf.Template
-	PluginsToInstall     map[string]string
+	MissingServices      []string
+	CaCertificates       []*x509.Certificate
+	SslVerification      string
+	ClientCert           string // staging paths of the client certificate and key of the app
+	ClientKey            string
+	ClientCreds          *launcher.ClientCredentials
+	ServerCert           string // server certificate and key, stand-ins for the instance identity during staging
+	ServerKey            string
+	Auth                 *conf.Auth
+	PluginsToInstall     map[string]conf.Plugin
+	PluginArchives       map[string]string // verified archive of each plugin, the plugin name for online installations
+	PluginDownloadDir    string
 }
 
 type Dependency struct {
@@ -71,7 +101,8 @@ func Run(gs *Supplier) error {
 
 	//Init maps for the Installation
 	gs.DepCacheDir = filepath.Join(gs.Stager.CacheDir(), "dependencies")
-	gs.PluginsToInstall = make(map[string]string)
+	gs.PluginsToInstall = make(map[string]conf.Plugin)
+	gs.PluginArchives = make(map[string]string)
 	gs.TemplatesToInstall = []conf.Template{}
 
 	//Eval Kibana file
@@ -114,14 +145,6 @@ func Run(gs *Supplier) error {
 		return err
 	}
 
-	//Install Dependencies
-	if err := gs.InstallDependencyGTE(); err != nil {
-		return err
-	}
-	if err := gs.InstallDependencyJq(); err != nil {
-		return err
-	}
-
 	//Prepare Staging Environment
 	if err := gs.PrepareStagingEnvironment(); err != nil {
 		return err
@@ -138,39 +161,83 @@ func Run(gs *Supplier) error {
 		return err
 	}
 
-	//Install Kibana
-	if err := gs.InstallKibana(); err != nil {
+	if err := gs.InstallServiceCertificates(); err != nil {
+		return err
+	}
+
+	if err := gs.InstallClientCertificate(); err != nil {
 		return err
 	}
 
-	//Install Kibana Plugins
-	if len(gs.PluginsToInstall) > 0 { // there are plugins to install
+	if err := gs.InstallServerCertificate(); err != nil {
+		return err
+	}
 
-		//Install Kibana Plugins Dependencies from S3
-		for key, _ := range gs.PluginsToInstall {
-			if strings.HasPrefix(key, "x-pack") { //is x-pack plugin
-				if err := gs.InstallDependencyXPack(); err != nil {
-					return err
-				}
-				break
-			}
+	if err := gs.InstallSslVerification(); err != nil {
+		return err
+	}
+
+	if err := gs.InstallAuth(); err != nil {
+		return err
+	}
+
+	//Check Kibana config
+	if gs.KibanaConfig.ConfigCheck {
+		if err := gs.CheckKibanaConfig(); err != nil {
+			return err
 		}
+	}
 
-		for key, _ := range gs.PluginsToInstall {
-			if !strings.HasPrefix(key, "x-pack") { //other than  x-pack plugin
-				if err := gs.InstallDependencyKibanaPlugins(); err != nil {
-					return err
-				}
-				break
+	//Offline mode: fail before any download
+	if err := gs.CheckOffline(); err != nil {
+		return err
+	}
+
+	//A plugin must not be installed and removed
+	if err := gs.CheckRemovePlugins(); err != nil {
+		return err
+	}
+
+	//Look for the plugins and the optimized bundle of a previous staging, before anything is downloaded
+	bundleKey, bundleCached := "", false
+	if len(gs.PluginsToInstall) > 0 || len(gs.KibanaConfig.RemovePlugins) > 0 {
+		var err error
+		if bundleKey, err = gs.PluginBundleKey(); err != nil {
+			gs.Log.Error("Unable to calculate the cache key of the Kibana plugins: %s", err.Error())
+			return err
+		}
+		bundleCached = gs.PluginBundleCached(bundleKey)
+	}
+
+	//Resolve and check the Kibana Plugins before Kibana is installed
+	if len(gs.PluginsToInstall) > 0 && !bundleCached { // there are plugins to install
+
+		//Install Kibana Plugins Dependencies from S3
+		for _, name := range gs.PluginDependencies() {
+			install := gs.InstallDependencyXPack
+			if name == "kibana-plugins" {
+				install = gs.InstallDependencyKibanaPlugins
+			}
+			if err := install(); err != nil {
+				return err
 			}
 		}
 
-		//Install Kibana Plugins
-		if err := gs.InstallKibanaPlugins(); err != nil {
+		if err := gs.PrepareKibanaPlugins(); err != nil {
 			return err
 		}
 	}
 
+	//Install Kibana
+	if err := gs.InstallKibana(); err != nil {
+		return err
+	}
+
+	//Remove plugins of the Kibana distribution, install Kibana Plugins or restore them with the optimized bundle
+	if err := gs.InstallPluginBundle(bundleKey, bundleCached); err != nil {
+		return err
+	}
+
 	//List Kibana Plugins
 	if err := gs.ListKibanaPlugins(); err != nil {
 		return err
@@ -212,14 +279,14 @@ func (gs *Supplier) EvalKibanaFile() error {
 	const heapPersentage = 90
 	const logLevel = "Info"
 	const noCache = false
-	const curatorInstall = false
+	const certificateExpiryWarningDays = 30
 
-	gs.KibanaConfig = conf.KibanaConfig{
-		Set:            true,
-		ConfigCheck:    configCheck,
-		ReservedMemory: reservedMemory,
-		HeapPercentage: heapPersentage,
-		Buildpack:      conf.Buildpack{Set: true, LogLevel: logLevel, NoCache: noCache}}
+	defaults := conf.KibanaConfig{
+		ConfigCheck:                  configCheck,
+		ReservedMemory:               reservedMemory,
+		CertificateExpiryWarningDays: certificateExpiryWarningDays,
+		HeapPercentage:               heapPersentage,
+		Buildpack:                    conf.Buildpack{LogLevel: logLevel, NoCache: noCache}}
 
 	KibanaFile := filepath.Join(gs.Stager.BuildDir(), "Kibana")
 
@@ -227,18 +294,39 @@ func (gs *Supplier) EvalKibanaFile() error {
 	if err != nil {
 		return err
 	}
-	if err := gs.KibanaConfig.Parse(data); err != nil {
+
+	validation := conf.ValidateKibanaFile(data)
+	for _, issue := range validation.Warnings {
+		gs.Log.Warning("Kibana file %s", issue.String())
+	}
+	for _, issue := range validation.Errors {
+		gs.Log.Error("Kibana file %s", issue.String())
+	}
+	if err := validation.Err(); err != nil {
+		return err
+	}
+
+	// buildpack defaults < Kibana file < environment
+	resolved, err := conf.Resolve(
+		conf.DefaultsLayer{Config: defaults},
+		conf.FileLayer{Data: data},
+		conf.EnvironmentLayer{})
+	if err != nil {
 		return err
 	}
+	gs.KibanaConfig = resolved.Config
+	gs.KibanaConfigOrigins = resolved.Origins
 
-	if !gs.KibanaConfig.Set {
-		gs.KibanaConfig.HeapPercentage = heapPersentage
-		gs.KibanaConfig.ReservedMemory = reservedMemory
-		gs.KibanaConfig.ConfigCheck = configCheck
+	for _, key := range conf.SettingKeys() {
+		name := conf.EnvName(key)
+		if value, ok := os.LookupEnv(name); ok && resolved.Origin(key) == conf.SourceEnvironment {
+			gs.Log.Warning("%s", golang.KibanaSettingOverride(name, value))
+		}
 	}
-	if !gs.KibanaConfig.Buildpack.Set {
-		gs.KibanaConfig.Buildpack.LogLevel = logLevel
-		gs.KibanaConfig.Buildpack.NoCache = noCache
+
+	gs.Log.Info("----> Resolved configuration:")
+	for _, setting := range resolved.Settings() {
+		gs.Log.Info("       %-28s %-30s (%s)", setting.Key, setting.Value, setting.Source)
 	}
 
 	/*	//Eval X-Pack
@@ -258,7 +346,11 @@ func (gs *Supplier) EvalKibanaFile() error {
 
 	//copy the user defined plugins to the PluginsToInstall map
 	for i := 0; i < len(gs.KibanaConfig.Plugins); i++ {
-		gs.PluginsToInstall[gs.KibanaConfig.Plugins[i]] = ""
+		if err := gs.KibanaConfig.Plugins[i].Validate(); err != nil {
+			gs.Log.Error("Invalid plugins of the Kibana file: %s", err.Error())
+			return err
+		}
+		gs.PluginsToInstall[gs.KibanaConfig.Plugins[i].Name] = gs.KibanaConfig.Plugins[i]
 	}
 
 	return nil
@@ -295,24 +387,40 @@ func (gs *Supplier) EvalTemplatesFile() error {
 	const credHostField = "host"
 	const credUsernameField = "username"
 	const credPasswordField = "password"
+	const credUriField = "uri"
+	const credCaField = "ca_certificate"
+	const credClientCertField = "client_certificate"
+	const credClientKeyField = "client_key"
 
+	// defaults are kept for all fields missing in templates.yml
 	gs.TemplatesConfig = conf.TemplatesConfig{
-		Set:            true,
-		Alias:        conf.Alias{Set: true, CredentialsHostField: credHostField, CredentialsUsernameField: credUsernameField, CredentialsPasswordField: credPasswordField},
-    }
-	templateFile := filepath.Join(gs.BPDir(), "defaults/templates/templates.yml")
-
-	data, err := ioutil.ReadFile(templateFile)
-	if err != nil {
-		return err
+		Alias: conf.Alias{CredentialsHostField: credHostField, CredentialsUsernameField: credUsernameField, CredentialsPasswordField: credPasswordField, CredentialsUriField: credUriField, CredentialsCaField: credCaField,
+			CredentialsClientCertField: credClientCertField, CredentialsClientKeyField: credClientKeyField},
 	}
-	if err := gs.TemplatesConfig.Parse(data); err != nil {
+	buildpackTemplates, err := conf.LoadTemplates(filepath.Join(gs.BPDir(), "defaults/templates"))
+	if err != nil {
+		gs.Log.Error("Invalid buildpack templates: %s", err.Error())
 		return err
 	}
-	if !gs.TemplatesConfig.Alias.Set {
-		gs.TemplatesConfig.Alias.CredentialsHostField = credHostField
-		gs.TemplatesConfig.Alias.CredentialsUsernameField = credUsernameField
-		gs.TemplatesConfig.Alias.CredentialsPasswordField = credPasswordField
+	gs.TemplatesConfig.Add(buildpackTemplates)
+
+	// templates of the app
+	if gs.KibanaConfig.TemplatesDir != "" {
+		dir := filepath.Join(gs.Stager.BuildDir(), gs.KibanaConfig.TemplatesDir)
+		if rel, err := filepath.Rel(gs.Stager.BuildDir(), dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			gs.Log.Error("templates-dir '%s' must be a directory of the app", gs.KibanaConfig.TemplatesDir)
+			return errors.New("templates-dir outside of the app")
+		}
+
+		gs.Log.Info("----> Reading templates of the app from %s", gs.KibanaConfig.TemplatesDir)
+		appTemplates, err := conf.LoadTemplates(dir)
+		if err != nil {
+			gs.Log.Error("Invalid templates of the app: %s", err.Error())
+			return err
+		}
+		for _, name := range gs.TemplatesConfig.Add(appTemplates) {
+			gs.Log.Warning("Template %s of the app replaces the buildpack template %s", name, name)
+		}
 	}
 
 	return nil
@@ -352,54 +460,6 @@ func (gs *Supplier) EvalEnvironment() error {
 	return nil
 }
 
-func (gs *Supplier) InstallDependencyGTE() error {
-	var err error
-
-	gs.GTE, err = gs.NewDependency("gte", 3, "")
-	if err != nil {
-		return err
-	}
-
-	if err := gs.InstallDependency(gs.GTE); err != nil {
-		return err
-	}
-
-	content := util.TrimLines(fmt.Sprintf(`
-				export GTE_HOME=$DEPS_DIR/%s
-				PATH=$PATH:$GTE_HOME
-				`, gs.GTE.RuntimeLocation))
-
-	if err := gs.WriteDependencyProfileD(gs.GTE.Name, content); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (gs *Supplier) InstallDependencyJq() error {
-	var err error
-
-	gs.Jq, err = gs.NewDependency("jq", 3, "")
-	if err != nil {
-		return err
-	}
-
-	if err := gs.InstallDependency(gs.Jq); err != nil {
-		return err
-	}
-
-	content := util.TrimLines(fmt.Sprintf(`
-				export JQ_HOME=$DEPS_DIR/%s
-				PATH=$PATH:$JQ_HOME
-				`, gs.Jq.RuntimeLocation))
-
-	if err := gs.WriteDependencyProfileD(gs.Jq.Name, content); err != nil {
-		return err
-	}
-	return nil
-}
-
-
 func (gs *Supplier) InstallDependencyXPack() error {
 
 	//Install x-pack from S3
@@ -447,6 +507,14 @@ func (gs *Supplier) InstallKibana() error {
 	if gs.KibanaConfig.Buildpack.DoSleepCommand {
 		sleepCommand = "yes"
 	}
+	serviceFallback := ""
+	if gs.KibanaConfig.EnableServiceFallback {
+		serviceFallback = "yes"
+	}
+	missingServices, err := json.Marshal(gs.MissingServices)
+	if err != nil {
+		return err
+	}
 	content := util.TrimLines(fmt.Sprintf(`
 			export K_BP_RESERVED_MEMORY=%d
 			export K_BP_HEAP_PERCENTAGE=%d
@@ -455,6 +523,8 @@ func (gs *Supplier) InstallKibana() error {
 			export K_ROOT=$DEPS_DIR/%s
 			export KIBANA_HOME=$DEPS_DIR/%s
 			export K_DO_SLEEP=%s
+			export K_BP_SERVICE_FALLBACK=%s
+			export K_BP_MISSING_SERVICES='%s'
 			PATH=$PATH:$KIBANA_HOME/bin
 			`,
 		gs.KibanaConfig.ReservedMemory,
@@ -463,7 +533,9 @@ func (gs *Supplier) InstallKibana() error {
 		gs.KibanaConfig.CmdArgs,
 		gs.Stager.DepsIdx(),
 		gs.Kibana.RuntimeLocation,
-		sleepCommand))
+		sleepCommand,
+		serviceFallback,
+		strings.Replace(string(missingServices), "'", `'\''`, -1)))
 
 	if err := gs.WriteDependencyProfileD(gs.Kibana.Name, content); err != nil {
 		gs.Log.Error("Error writing profile.d script for Kibana: %s", err.Error())
@@ -476,171 +548,706 @@ func (gs *Supplier) InstallKibana() error {
 
 func (gs *Supplier) PrepareStagingEnvironment() error {
 	os.Setenv("PORT", "8080") //dummy PORT: used by template processing for Kibana check
+
+	//stand-in values for the template processing for Kibana check, if not available during staging
+	if os.Getenv("VCAP_APPLICATION") == "" {
+		os.Setenv("VCAP_APPLICATION", `{"limits":{"mem":1024}}`)
+	}
+	if os.Getenv("VCAP_SERVICES") == "" {
+		os.Setenv("VCAP_SERVICES", "{}")
+	}
+	return nil
+}
+
+// CheckKibanaConfig renders all templates and conf.d files like the launcher does at startup
+// and validates the merged kibana.yml against the known settings of the Kibana version
+func (gs *Supplier) CheckKibanaConfig() error {
+	gs.Log.BeginStep("Checking Kibana config")
+
+	version, err := gs.SelectDependencyVersion(Dependency{Name: "kibana", VersionParts: 3, ConfigVersion: gs.KibanaConfig.Version})
+	if err != nil {
+		return err
+	}
+	kibanaSchema, err := schema.ForVersion(version)
+	if err != nil {
+		gs.Log.Warning("Skipping Kibana config check: %s", err.Error())
+		return nil
+	}
+
+	workDir, err := ioutil.TempDir("", "kibana-config-check")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	l := gs.StagingLauncher(workDir)
+	config, err := l.BuildConfig()
+	if err != nil {
+		gs.Log.Error("Invalid Kibana config: %s", err.Error())
+		return err
+	}
+
+	plugins := []string{}
+	for plugin := range gs.PluginsToInstall {
+		plugins = append(plugins, plugin)
+	}
+
+	issues := kibanaSchema.Check(config, plugins)
+	for _, issue := range issues {
+		gs.Log.Error("Invalid Kibana %s setting %s", version, issue.String())
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d invalid Kibana setting(s)", len(issues))
+	}
+
+	gs.Log.Info("Kibana config is valid for Kibana %s", version)
 	return nil
 }
 
+// StagingLauncher returns a launcher which renders the config of the app into workDir like the launcher
+// does at startup, with the stand-ins of the staging environment
+func (gs *Supplier) StagingLauncher(workDir string) *launcher.Launcher {
+	return &launcher.Launcher{
+		Log:             libbuildpack.NewLogger(ioutil.Discard),
+		Home:            gs.Stager.BuildDir(),
+		Root:            gs.Stager.DepDir(),
+		WorkDir:         workDir,
+		SslVerification: gs.SslVerification,
+		ClientCert:      gs.ClientCert,
+		ClientKey:       gs.ClientKey,
+		ClientCreds:     gs.ClientCreds,
+		ServerSsl:       gs.KibanaConfig.ServerSsl.Enabled,
+		ServerCert:      gs.ServerCert,
+		ServerKey:       gs.ServerKey,
+		Auth:            gs.Auth,
+		KibanaPort:      5601,
+		VcapServices:    gs.VcapServices,
+	}
+}
+
+// InstallUserCertificates validates the certificates of the Kibana file and installs them as PEM files
+// into the dependency directory, from where the cf-certificates template adds them to the CA bundle
 func (gs *Supplier) InstallUserCertificates() error {
 
 	var certArray = []string{}
+	var stagingCertArray = []string{}
 
 	if len(gs.KibanaConfig.Certificates) == 0 { // no certificates to install
 		return nil
 	}
 
-	localCerts, _ := gs.ReadLocalCertificates(gs.Stager.BuildDir() + "/certificates")
+	certDir := filepath.Join(gs.Stager.BuildDir(), "certificates")
+	if _, err := os.Stat(certDir); os.IsNotExist(err) {
+		gs.Log.Error("The Kibana file lists certificates, but the app has no 'certificates' directory")
+		return errors.New("certificates directory not found")
+	}
 
-	for i := 0; i < len(gs.KibanaConfig.Certificates); i++ {
+	for _, name := range gs.KibanaConfig.Certificates {
+		gs.Log.Info("----> adding user certificate '%s' ... ", name)
 
-		localCert := localCerts[gs.KibanaConfig.Certificates[i]]
-		if localCert != "" {
-			gs.Log.Info(fmt.Sprintf("----> adding user certificate '%s' ... ", gs.KibanaConfig.Certificates[i]))
-			certArray = append(certArray, fmt.Sprintf("$HOME/certificates/%s", localCert))
-		} else {
-			err := errors.New("crt file for certificate not found in directory")
-			gs.Log.Error("File %s.crt not found in directory '/certificates'", gs.KibanaConfig.Certificates[i])
+		file, err := certs.Find(certDir, name)
+		if err != nil {
+			gs.Log.Error("%s in directory 'certificates'", err.Error())
 			return err
 		}
-	}
-
-	if len(certArray) > 0 {
-		jsonCertArray, err := json.Marshal(certArray)
+		data, err := ioutil.ReadFile(file)
 		if err != nil {
 			return err
 		}
-		content := util.TrimLines(fmt.Sprintf(`
-				export K_CERTS="%s"
-				`, strings.Replace( string(jsonCertArray) ,`"`,`\"`,-1) ))
-
-		if err := gs.WriteDependencyProfileD("certificates", content); err != nil {
+		certificates, err := certs.Parse(data)
+		if err != nil {
+			gs.Log.Error("Invalid certificate file %s: %s", filepath.Base(file), err.Error())
 			return err
 		}
+		for _, c := range certificates {
+			warning, err := certs.Check(c, time.Now(), gs.KibanaConfig.CertificateExpiryWarningDays)
+			if err != nil {
+				gs.Log.Error("Invalid certificate in %s: %s", filepath.Base(file), err.Error())
+				return err
+			}
+			if warning != "" {
+				gs.Log.Warning("Certificate in %s %s", filepath.Base(file), warning)
+			}
+			gs.Log.Info("       %s", certs.Describe(c))
+		}
+		gs.CaCertificates = append(gs.CaCertificates, certificates...)
 
+		// installed as PEM, also DER encoded files
+		if err := ioutil.WriteFile(filepath.Join(gs.Stager.DepDir(), "certificates", name+".pem"), certs.Encode(certificates), 0644); err != nil {
+			return err
+		}
+		certArray = append(certArray, fmt.Sprintf("$DEPS_DIR/%s/certificates/%s.pem", gs.Stager.DepsIdx(), name))
+		stagingCertArray = append(stagingCertArray, filepath.Join(gs.Stager.DepDir(), "certificates", name+".pem"))
 	}
 
-	return nil
-
-}
-
-func (gs *Supplier) InstallTemplates() error {
-
-	if !gs.ConfigFilesExists && len(gs.KibanaConfig.ConfigTemplates) == 0 {
-		// install all default templates
-
-		//copy default templates to config
-		for _, t := range gs.TemplatesConfig.Templates {
+	jsonCertArray, err := json.Marshal(certArray)
+	if err != nil {
+		return err
+	}
+	content := util.TrimLines(fmt.Sprintf(`
+			export K_CERTS="%s"
+			`, strings.Replace(string(jsonCertArray), `"`, `\"`, -1)))
 
-			if t.IsDefault {
+	if err := gs.WriteDependencyProfileD("certificates", content); err != nil {
+		return err
+	}
 
-				if len(t.Tags) > 0 {
-					vcapServices := []conf.VcapService{}
-					vcapServicesWithTag := gs.VcapServices.WithTags(t.Tags)
-					vcapServicesUserProvided := gs.VcapServices.UserProvided()
+	//used by template processing for Kibana check
+	jsonStagingCertArray, err := json.Marshal(stagingCertArray)
+	if err != nil {
+		return err
+	}
+	os.Setenv("K_CERTS", string(jsonStagingCertArray))
 
-					if len(vcapServicesWithTag) > 0 {
-						vcapServices = append(vcapServices, vcapServicesWithTag...)
-					}
-					if len(vcapServicesUserProvided) > 0 {
-						vcapServices = append(vcapServices, vcapServicesUserProvided...)
-					}
+	return nil
+}
 
-					if len(vcapServices) == 0 {
+// InstallServiceCertificates makes the cf-certificates template add the CA certificates of the credentials
+// of the services bound to templates (credentials-ca-field of the alias) to the CA bundle at startup,
+// so they follow the binding. The certificates of services bound during staging are checked.
+func (gs *Supplier) InstallServiceCertificates() error {
+	caCredentials := []map[string]string{}
+	added := map[string]bool{}
 
-						if gs.KibanaConfig.EnableServiceFallback {
-							ti := t
-							ti.ServiceInstanceName = ""
-							gs.TemplatesToInstall = append(gs.TemplatesToInstall, ti)
-							gs.Log.Warning("No service found for template %s, will do the fallback. Please bind a service and restage the app", ti.Name)
-						} else {
-							return errors.New("no service found for template")
-						}
-					} else if len(vcapServices) > 1 {
-						return errors.New("more than one service found for template")
-					} else {
-						ti := t
-						ti.ServiceInstanceName = vcapServices[0].Name
-						gs.TemplatesToInstall = append(gs.TemplatesToInstall, ti)
-					}
-				} else {
-					ti := t
-					ti.ServiceInstanceName = ""
-					gs.TemplatesToInstall = append(gs.TemplatesToInstall, ti)
-				}
-			}
+	for _, ti := range gs.TemplatesToInstall {
+		if ti.ServiceInstanceName == "" || added[ti.ServiceInstanceName] {
+			continue
 		}
+		service := gs.VcapServices.WithName(ti.ServiceInstanceName)
+		alias := gs.TemplatesConfig.AliasFor(service, gs.KibanaConfig.AliasProfiles)
+		if alias.CredentialsCaField == "" {
+			continue
+		}
+		added[ti.ServiceInstanceName] = true
+		caCredentials = append(caCredentials, map[string]string{"service": ti.ServiceInstanceName, "field": alias.CredentialsCaField})
 
-	} else {
-		//only install explicitly defined templates, if any
-		//check them all
-
-		for _, ct := range gs.KibanaConfig.ConfigTemplates {
-			found := false
-			templateName := strings.Trim(ct.Name, " ")
-			if len(templateName) == 0 {
-				gs.Log.Warning("Skipping template: no valid name defined for template in Kibana file")
-				continue
-			}
-			for _, t := range gs.TemplatesConfig.Templates {
-				if templateName == t.Name {
-					serviceInstanceName := strings.Trim(ct.ServiceInstanceName, " ")
-					if len(serviceInstanceName) == 0 && len(t.Tags) > 0 {
-						gs.Log.Error("Template %s requires service instance name: No service instance name defined for template in Kibana file", templateName)
-						return errors.New("no service instance name defined for template in Kibana file")
-					}
-
-					ti := t
-					if len(serviceInstanceName) > 0 && len(t.Tags) == 0 {
-						gs.Log.Warning("Service instance name '%s' is defined for template %s in Kibana file but template can not be bound to a service.", serviceInstanceName, templateName)
-					} else {
-						ti.ServiceInstanceName = serviceInstanceName
-					}
-					gs.TemplatesToInstall = append(gs.TemplatesToInstall, ti)
+		if service == nil {
+			continue
+		}
+		value, ok := service.Credential(alias.CredentialsCaField)
+		if !ok {
+			gs.Log.Debug("Service %s has no CA certificate in credential %s", service.Name, alias.CredentialsCaField)
+			continue
+		}
 
-					found = true
-					break
-				}
+		gs.Log.Info("----> adding CA certificate of service '%s' (credential %s) ... ", service.Name, alias.CredentialsCaField)
+		certificates, err := certs.Parse([]byte(fmt.Sprintf("%v", value)))
+		if err != nil {
+			gs.Log.Error("Invalid CA certificate in credential %s of service %s: %s", alias.CredentialsCaField, service.Name, err.Error())
+			return err
+		}
+		for _, c := range certificates {
+			warning, err := certs.Check(c, time.Now(), gs.KibanaConfig.CertificateExpiryWarningDays)
+			if err != nil {
+				gs.Log.Error("Invalid CA certificate of service %s: %s", service.Name, err.Error())
+				return err
 			}
-			if !found {
-				gs.Log.Warning("Template %s defined in Kibana file does not exist", templateName)
+			if warning != "" {
+				gs.Log.Warning("CA certificate of service %s %s", service.Name, warning)
 			}
+			gs.Log.Info("       %s", certs.Describe(c))
 		}
+		gs.CaCertificates = append(gs.CaCertificates, certificates...)
 	}
 
-	//copy templates --> conf.d
-	for _, ti := range gs.TemplatesToInstall {
+	if len(caCredentials) == 0 {
+		return nil
+	}
+	jsonCaCredentials, err := json.Marshal(caCredentials)
+	if err != nil {
+		return err
+	}
+	content := util.TrimLines(fmt.Sprintf(`
+			export K_CA_CREDENTIALS='%s'
+			`, strings.Replace(string(jsonCaCredentials), "'", `'\''`, -1)))
 
-		os.Setenv("SERVICE_INSTANCE_NAME", ti.ServiceInstanceName)
-		os.Setenv("CREDENTIALS_HOST_FIELD", gs.TemplatesConfig.Alias.CredentialsHostField)
-		os.Setenv("CREDENTIALS_USERNAME_FIELD", gs.TemplatesConfig.Alias.CredentialsUsernameField)
-		os.Setenv("CREDENTIALS_PASSWORD_FIELD", gs.TemplatesConfig.Alias.CredentialsPasswordField)
+	if err := gs.WriteDependencyProfileD("service-certificates", content); err != nil {
+		return err
+	}
+	os.Setenv("K_CA_CREDENTIALS", string(jsonCaCredentials)) //used by template processing for Kibana check
+	return nil
+}
 
-		templateFile := filepath.Join(gs.BPDir(), "defaults/templates/", ti.Name+".yml")
-		destFile := filepath.Join(gs.Stager.DepDir(), "conf.d", ti.Name+".yml")
+// InstallClientCertificate installs the client certificate for the connection to Elasticsearch:
+// the files of client-certificate of the Kibana file, otherwise the launcher takes it from the credentials
+// of the service bound to a template (credentials-client-cert-field and credentials-client-key-field
+// of the alias), which are checked if the service is bound during staging
+func (gs *Supplier) InstallClientCertificate() error {
+	if gs.KibanaConfig.ClientCertificate.Certificate != "" || gs.KibanaConfig.ClientCertificate.Key != "" {
+		return gs.installClientCertificateFiles()
+	}
 
-		err := exec.Command(fmt.Sprintf("%s/gte", gs.GTE.StagingLocation), "-d", "<<:>>", templateFile, destFile).Run()
-		if err != nil {
-			gs.Log.Error("Error pre-processing template %s: %s", ti.Name, err.Error())
-			return err
+	for _, ti := range gs.TemplatesToInstall {
+		if ti.ServiceInstanceName == "" {
+			continue
+		}
+		service := gs.VcapServices.WithName(ti.ServiceInstanceName)
+		alias := gs.TemplatesConfig.AliasFor(service, gs.KibanaConfig.AliasProfiles)
+		if alias.CredentialsClientCertField == "" || alias.CredentialsClientKeyField == "" {
+			continue
 		}
+		gs.ClientCreds = &launcher.ClientCredentials{Service: ti.ServiceInstanceName, Certificate: alias.CredentialsClientCertField, Key: alias.CredentialsClientKeyField}
 
+		if service != nil {
+			if err := gs.checkClientCredentials(service, alias); err != nil {
+				return err
+			}
+		}
+		break
+	}
+	if gs.ClientCreds == nil {
+		return nil
 	}
 
-	// copy grok-patterns, mappings and plugins
-	for i := 0; i < len(gs.TemplatesToInstall); i++ {
-		for p := 0; p < len(gs.TemplatesToInstall[i].Plugins); p++ {
-			gs.PluginsToInstall[gs.TemplatesToInstall[i].Plugins[p]] = ""
-		}
+	jsonClientCreds, err := json.Marshal(gs.ClientCreds)
+	if err != nil {
+		return err
 	}
+	content := util.TrimLines(fmt.Sprintf(`
+			export K_CLIENT_CREDENTIALS='%s'
+			`, strings.Replace(string(jsonClientCreds), "'", `'\''`, -1)))
+	return gs.WriteDependencyProfileD("client-certificate", content)
+}
 
-	//default Plugins will be installed in method "InstallKibanaPlugins"
+func (gs *Supplier) checkClientCredentials(service *conf.VcapService, alias conf.Alias) error {
+	cert, certOk := service.Credential(alias.CredentialsClientCertField)
+	key, keyOk := service.Credential(alias.CredentialsClientKeyField)
+	if !certOk && !keyOk {
+		gs.Log.Debug("Service %s has no client certificate in credential %s", service.Name, alias.CredentialsClientCertField)
+		return nil
+	}
+	if !certOk || !keyOk {
+		gs.Log.Error("The client certificate of service %s requires the credentials %s and %s", service.Name, alias.CredentialsClientCertField, alias.CredentialsClientKeyField)
+		return errors.New("incomplete client certificate credentials")
+	}
 
+	gs.Log.Info("----> checking client certificate of service '%s' (credential %s) ... ", service.Name, alias.CredentialsClientCertField)
+	certPEM, keyPEM := []byte(fmt.Sprintf("%v", cert)), []byte(fmt.Sprintf("%v", key))
+	if err := gs.checkKeyPair("client", certs.CheckClient, certPEM, keyPEM); err != nil {
+		gs.Log.Error("Invalid client certificate of service %s: %s", service.Name, err.Error())
+		return err
+	}
 	return nil
 }
 
+// installClientCertificateFiles installs the client certificate and key of the app
+func (gs *Supplier) installClientCertificateFiles() error {
+	client := gs.KibanaConfig.ClientCertificate
+	certFile, keyFile, err := gs.installCertificateFiles("client", client.Certificate, client.Key, certs.CheckClient)
+	if err != nil {
+		return err
+	}
+	gs.ClientCert, gs.ClientKey = certFile, keyFile
+
+	content := util.TrimLines(fmt.Sprintf(`
+			export K_CLIENT_CERT=$DEPS_DIR/%s/client-certificate/client.crt
+			export K_CLIENT_KEY=$DEPS_DIR/%s/client-certificate/client.key
+			`, gs.Stager.DepsIdx(), gs.Stager.DepsIdx()))
+	return gs.WriteDependencyProfileD("client-certificate", content)
+}
+
+// installCertificateFiles installs the certificate and key files of the app (names in the certificates folder)
+// as <kind>.crt and <kind>.key into <kind>-certificate of the dependency directory, the key is readable only
+// by the app user. It returns the installed files.
+func (gs *Supplier) installCertificateFiles(kind string, certName string, keyName string, check certificateCheck) (string, string, error) {
+	if certName == "" || keyName == "" {
+		gs.Log.Error("The %s certificate of the Kibana file requires certificate and key", kind)
+		return "", "", fmt.Errorf("incomplete %s certificate", kind)
+	}
+	gs.Log.Info("----> adding %s certificate '%s' ... ", kind, certName)
+
+	certDir := filepath.Join(gs.Stager.BuildDir(), "certificates")
+	certFile, err := certs.Find(certDir, certName)
+	if err != nil {
+		gs.Log.Error("%s in directory 'certificates'", err.Error())
+		return "", "", err
+	}
+	keyFile, err := certs.FindKey(certDir, keyName)
+	if err != nil {
+		gs.Log.Error("%s in directory 'certificates'", err.Error())
+		return "", "", err
+	}
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return "", "", err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	certificates, err := certs.Parse(data)
+	if err != nil {
+		gs.Log.Error("Invalid certificate file %s: %s", filepath.Base(certFile), err.Error())
+		return "", "", err
+	}
+	certPEM := certs.Encode(certificates) // installed as PEM, also DER encoded files
+	if err := gs.checkKeyPair(kind, check, certPEM, keyPEM); err != nil {
+		gs.Log.Error("Invalid %s certificate %s: %s", kind, filepath.Base(certFile), err.Error())
+		return "", "", err
+	}
+
+	dir := filepath.Join(gs.Stager.DepDir(), kind+"-certificate")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	installedCert, installedKey := filepath.Join(dir, kind+".crt"), filepath.Join(dir, kind+".key")
+	if err := ioutil.WriteFile(installedCert, certPEM, 0644); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(installedKey, keyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	return installedCert, installedKey, nil
+}
+
+type certificateCheck func(c *x509.Certificate, now time.Time, warnDays int) (string, error)
+
+// checkKeyPair checks the first of the PEM encoded certificates and that the private key matches it
+func (gs *Supplier) checkKeyPair(kind string, check certificateCheck, certPEM []byte, keyPEM []byte) error {
+	certificates, err := certs.Parse(certPEM)
+	if err != nil {
+		return err
+	}
+	warning, err := check(certificates[0], time.Now(), gs.KibanaConfig.CertificateExpiryWarningDays)
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		gs.Log.Warning("The %s certificate %s", kind, warning)
+	}
+	gs.Log.Info("       %s", certs.Describe(certificates[0]))
+	return certs.CheckKeyPair(certPEM, keyPEM)
+}
+
+// InstallServerCertificate enables TLS for the Kibana server with the server certificate of the app
+// or the CF instance identity certificate, which the launcher watches for rotation
+func (gs *Supplier) InstallServerCertificate() error {
+	server := gs.KibanaConfig.ServerSsl
+	if !server.Enabled {
+		if server.Certificate != "" || server.Key != "" {
+			gs.Log.Warning("server-ssl of the Kibana file has a certificate but is not enabled")
+		}
+		return nil
+	}
+
+	var content string
+	if server.Certificate != "" || server.Key != "" {
+		certFile, keyFile, err := gs.installCertificateFiles("server", server.Certificate, server.Key, certs.CheckServer)
+		if err != nil {
+			return err
+		}
+		gs.ServerCert, gs.ServerKey = certFile, keyFile
+		content = util.TrimLines(fmt.Sprintf(`
+			export K_BP_SERVER_SSL=true
+			export K_SERVER_CERT=$DEPS_DIR/%s/server-certificate/server.crt
+			export K_SERVER_KEY=$DEPS_DIR/%s/server-certificate/server.key
+			`, gs.Stager.DepsIdx(), gs.Stager.DepsIdx()))
+	} else {
+		gs.Log.Info("----> using the CF instance identity certificate for the Kibana server")
+		// the instance identity credentials are only available at runtime
+		gs.ServerCert = "/etc/cf-instance-credentials/instance.crt"
+		gs.ServerKey = "/etc/cf-instance-credentials/instance.key"
+		content = util.TrimLines(`
+			export K_BP_SERVER_SSL=true
+			export K_SERVER_CERT=$CF_INSTANCE_CERT
+			export K_SERVER_KEY=$CF_INSTANCE_KEY
+			`)
+	}
+	return gs.WriteDependencyProfileD("server-certificate", content)
+}
+
+// InstallAuth configures the authentication proxy which the launcher starts in front of Kibana.
+// The credentials of the auth service are checked, it must be bound during staging.
+func (gs *Supplier) InstallAuth() error {
+	auth := gs.KibanaConfig.Auth
+	if auth.Type == "" {
+		if auth.Service != "" || auth.Issuer != "" {
+			gs.Log.Warning("auth of the Kibana file has no type, Kibana is not protected")
+		}
+		return nil
+	}
+	gs.Log.Info("----> configuring %s authentication with the credentials of service '%s' ... ", auth.Type, auth.Service)
+
+	if auth.Service == "" {
+		gs.Log.Error("auth of the Kibana file requires the service with the credentials")
+		return errors.New("auth service missing")
+	}
+	if auth.Type == conf.AuthBasic && (auth.Issuer != "" || len(auth.Scopes) > 0 || len(auth.AllowedUsers) > 0) {
+		gs.Log.Error("auth of type basic does not use issuer, scopes and allowed-users, they require type oidc")
+		return errors.New("invalid auth settings for type basic")
+	}
+	if auth.Type == conf.AuthOidc {
+		if u, err := url.Parse(auth.Issuer); err != nil || u.Scheme != "https" || u.Host == "" {
+			gs.Log.Error("auth of the Kibana file requires the https URL of the issuer, got '%s'", auth.Issuer)
+			return errors.New("invalid auth issuer")
+		}
+	}
+	if gs.VcapServices.WithName(auth.Service) == nil {
+		gs.Log.Error("The service %s of auth is not bound, bind it and restage the app", auth.Service)
+		return errors.New("auth service not bound")
+	}
+
+	l := launcher.Launcher{Auth: &auth, VcapServices: gs.VcapServices}
+	config, err := l.ProxyConfig()
+	if err == nil {
+		_, err = proxy.New(config, &url.URL{}, gs.Log)
+	}
+	if err != nil {
+		gs.Log.Error("Invalid auth: %s", err.Error())
+		return err
+	}
+	gs.Auth = &auth
+
+	jsonAuth, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+	content := util.TrimLines(fmt.Sprintf(`
+			export K_BP_AUTH='%s'
+			`, strings.Replace(string(jsonAuth), "'", `'\''`, -1)))
+	return gs.WriteDependencyProfileD("auth", content)
+}
+
+// InstallSslVerification sets the verification mode of the TLS connection to Elasticsearch, full by default
+// if there are CA certificates, and checks the TLS connection to the services bound during staging
+func (gs *Supplier) InstallSslVerification() error {
+	gs.SslVerification = gs.KibanaConfig.SslVerification
+	if gs.SslVerification == "" && len(gs.CaCertificates) > 0 {
+		gs.SslVerification = certs.VerifyFull
+	}
+	if gs.SslVerification == "" {
+		return nil
+	}
+
+	if gs.SslVerification == certs.VerifyNone {
+		gs.Log.Warning("**WARNING** ssl-verification is none: the certificate of Elasticsearch is NOT verified, the connection is open to man-in-the-middle attacks!")
+	}
+	gs.Log.Info("----> Using ssl-verification %s", gs.SslVerification)
+
+	content := util.TrimLines(fmt.Sprintf(`
+			export K_BP_SSL_VERIFICATION=%s
+			`, gs.SslVerification))
+	if err := gs.WriteDependencyProfileD("ssl-verification", content); err != nil {
+		return err
+	}
+
+	for _, ti := range gs.TemplatesToInstall {
+		service := gs.VcapServices.WithName(ti.ServiceInstanceName)
+		if service == nil {
+			continue
+		}
+		endpoint := service.Endpoint(gs.TemplatesConfig.AliasFor(service, gs.KibanaConfig.AliasProfiles))
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme != "https" {
+			continue
+		}
+		address := u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		}
+
+		err = certs.VerifyServer(address, gs.CaCertificates, gs.SslVerification, 5*time.Second)
+		if _, ok := err.(*certs.ConnectError); ok {
+			gs.Log.Warning("Unable to check the certificate of service %s: %s", service.Name, err.Error())
+		} else if err != nil {
+			gs.Log.Error("The certificate of service %s (%s) does not pass ssl-verification %s: %s", service.Name, address, gs.SslVerification, err.Error())
+			gs.Log.Error("Add its CA certificate to the certificates of the Kibana file or to the credentials of the service")
+			return err
+		} else if gs.SslVerification != certs.VerifyNone {
+			gs.Log.Info("       certificate of service %s (%s) verified", service.Name, address)
+		}
+	}
+	return nil
+}
+
+func (gs *Supplier) InstallTemplates() error {
+
+	if !gs.ConfigFilesExists && len(gs.KibanaConfig.ConfigTemplates) == 0 {
+		// install all default templates
+
+		//copy default templates to config
+		for _, t := range gs.TemplatesConfig.Templates {
+
+			if t.IsDefault && !t.IsFallback {
+
+				if t.BindsService() {
+					service, err := t.SelectService(gs.VcapServices)
+					if err != nil {
+						if ambiguous, ok := err.(*conf.AmbiguousServicesError); ok {
+							gs.Log.Error("More than one service found for template %s, please refine the selection rules or define the service instance in the Kibana file:", t.Name)
+							for _, c := range ambiguous.Candidates {
+								gs.Log.Error("  %s", c.String())
+							}
+						}
+						return err
+					}
+
+					if service == nil {
+
+						if gs.KibanaConfig.EnableServiceFallback {
+							gs.InstallFallbackTemplate(t)
+						} else {
+							return errors.New("no service found for template")
+						}
+					} else {
+						ti := t
+						ti.ServiceInstanceName = service.Name
+						gs.TemplatesToInstall = append(gs.TemplatesToInstall, ti)
+						gs.Log.Info("Template %s is bound to service %s", ti.Name, service.Name)
+					}
+				} else {
+					ti := t
+					ti.ServiceInstanceName = ""
+					gs.TemplatesToInstall = append(gs.TemplatesToInstall, ti)
+				}
+			}
+		}
+
+	} else {
+		//only install explicitly defined templates, if any
+		//check them all
+
+		for _, ct := range gs.KibanaConfig.ConfigTemplates {
+			found := false
+			templateName := strings.Trim(ct.Name, " ")
+			if len(templateName) == 0 {
+				gs.Log.Warning("Skipping template: no valid name defined for template in Kibana file")
+				continue
+			}
+			for _, t := range gs.TemplatesConfig.Templates {
+				if templateName == t.Name {
+					serviceInstanceName := strings.Trim(ct.ServiceInstanceName, " ")
+					if len(serviceInstanceName) == 0 && t.BindsService() {
+						gs.Log.Error("Template %s requires service instance name: No service instance name defined for template in Kibana file", templateName)
+						return errors.New("no service instance name defined for template in Kibana file")
+					}
+
+					ti := t
+					if len(serviceInstanceName) > 0 && !t.BindsService() {
+						gs.Log.Warning("Service instance name '%s' is defined for template %s in Kibana file but template can not be bound to a service.", serviceInstanceName, templateName)
+					} else {
+						ti.ServiceInstanceName = serviceInstanceName
+					}
+					gs.TemplatesToInstall = append(gs.TemplatesToInstall, ti)
+
+					found = true
+					break
+				}
+			}
+			if !found {
+				gs.Log.Warning("Template %s defined in Kibana file does not exist", templateName)
+			}
+		}
+	}
+
+	//pre-process templates --> conf.d, certificates.d, keystore.d or profile.d depending on the template type
+	//staging renders the <<...>> expressions only, {{...}} expressions are rendered at startup
+	for _, ti := range gs.TemplatesToInstall {
+
+		renderer, err := template.NewRenderer().WithDelims("<<:>>")
+		if err != nil {
+			return err
+		}
+		alias := gs.TemplatesConfig.AliasFor(gs.VcapServices.WithName(ti.ServiceInstanceName), gs.KibanaConfig.AliasProfiles)
+		gs.Log.Debug("Template %s uses the credential alias %+v", ti.Name, alias)
+
+		renderer.Env["SERVICE_INSTANCE_NAME"] = ti.ServiceInstanceName
+		renderer.Env["CREDENTIALS_HOST_FIELD"] = alias.CredentialsHostField
+		renderer.Env["CREDENTIALS_USERNAME_FIELD"] = alias.CredentialsUsernameField
+		renderer.Env["CREDENTIALS_PASSWORD_FIELD"] = alias.CredentialsPasswordField
+		renderer.Env["CREDENTIALS_URI_FIELD"] = alias.CredentialsUriField
+
+		if ti.TemplateType() == conf.TemplateTypeEnv {
+			if err := gs.InstallEnvTemplate(ti, renderer); err != nil {
+				gs.Log.Error("Error pre-processing template %s: %s", ti.Name, err.Error())
+				return err
+			}
+			continue
+		}
+
+		destDir := filepath.Join(gs.Stager.DepDir(), launcher.TemplateDirs[ti.TemplateType()])
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return err
+		}
+		if err := renderer.RenderFile(ti.File(), filepath.Join(destDir, ti.Name+".yml")); err != nil {
+			gs.Log.Error("Error pre-processing template %s: %s", ti.Name, err.Error())
+			return err
+		}
+
+	}
+
+	// copy grok-patterns, mappings and plugins
+	for i := 0; i < len(gs.TemplatesToInstall); i++ {
+		for p := 0; p < len(gs.TemplatesToInstall[i].Plugins); p++ {
+			name := gs.TemplatesToInstall[i].Plugins[p]
+			if _, ok := gs.PluginsToInstall[name]; !ok { // the entry of the Kibana file wins
+				gs.PluginsToInstall[name] = conf.Plugin{Name: name}
+			}
+		}
+	}
+
+	//default Plugins will be installed in method "InstallKibanaPlugins"
+
+	return nil
+}
+
+// InstallFallbackTemplate installs the fallback template of a template whose service is not bound,
+// or the template itself without service if there is no fallback template
+func (gs *Supplier) InstallFallbackTemplate(t conf.Template) {
+	gs.MissingServices = append(gs.MissingServices, fmt.Sprintf("template %s: bind a service with %s and restage the app", t.Name, t.SelectionHint()))
+
+	if fallback, ok := gs.TemplatesConfig.FallbackFor(t); ok {
+		gs.TemplatesToInstall = append(gs.TemplatesToInstall, fallback)
+		gs.Log.Warning("No service found for template %s, using the fallback template %s. Please bind a service and restage the app", t.Name, fallback.Name)
+		return
+	}
+
+	ti := t
+	ti.ServiceInstanceName = ""
+	gs.TemplatesToInstall = append(gs.TemplatesToInstall, ti)
+	gs.Log.Warning("No service found for template %s and no fallback template defined, using %s without service. Please bind a service and restage the app", t.Name, t.Name)
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// InstallEnvTemplate renders an env template, a map of environment variables, into a profile.d script.
+// The values are exported in single quotes, so credentials with $, ` or " are neither expanded nor executed
+// when the script is sourced. Env templates are rendered with << >> only, {{ }} is literal text.
+func (gs *Supplier) InstallEnvTemplate(ti conf.Template, renderer *template.Renderer) error {
+	text, err := ioutil.ReadFile(ti.File())
+	if err != nil {
+		return err
+	}
+	out, err := renderer.Render(filepath.Base(ti.File()), text)
+	if err != nil {
+		return err
+	}
+
+	vars := yaml.MapSlice{}
+	if err := yaml.Unmarshal(out, &vars); err != nil {
+		return err
+	}
+	exports := []string{}
+	for _, v := range vars {
+		name := fmt.Sprintf("%v", v.Key)
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name '%s'", name)
+		}
+		value := ""
+		if v.Value != nil {
+			value = fmt.Sprintf("%v", v.Value)
+		}
+		exports = append(exports, fmt.Sprintf(`export %s='%s'`, name, strings.Replace(value, "'", `'\''`, -1)))
+	}
+	return gs.WriteDependencyProfileD("template-"+ti.Name, strings.Join(exports, "\n")+"\n")
+}
+
 func (gs *Supplier) ListKibanaPlugins() error {
 	gs.Log.Info("----> Listing all installed Kibana plugins ...")
 
 	out, err := exec.Command(fmt.Sprintf("%s/bin/kibana-plugin", gs.Kibana.StagingLocation), "list").CombinedOutput()
-	gs.Log.Info(string(out))
+	gs.Log.Info("%s", string(out))
 	if err != nil {
 		gs.Log.Error("Error listing all installed Kibana plugins: %s", err.Error())
 		return err
@@ -648,40 +1255,238 @@ func (gs *Supplier) ListKibanaPlugins() error {
 	return nil
 }
 
-func (gs *Supplier) InstallKibanaPlugins() error {
+// InstalledKibanaPlugins returns the versions of the plugins installed in Kibana by name
+func (gs *Supplier) InstalledKibanaPlugins() (map[string]string, error) {
+	out, err := exec.Command(fmt.Sprintf("%s/bin/kibana-plugin", gs.Kibana.StagingLocation), "list").CombinedOutput()
+	if err != nil {
+		gs.Log.Error("%s", string(out))
+		gs.Log.Error("Error listing all installed Kibana plugins: %s", err.Error())
+		return nil, err
+	}
+	installed := pluginutil.ParseList(string(out))
+	// x-pack of the default distribution (6.3 and newer) is in node_modules, not in plugins, but can be removed
+	if _, err := os.Stat(filepath.Join(gs.Kibana.StagingLocation, "node_modules", "x-pack")); err == nil {
+		installed["x-pack"] = gs.Kibana.Version
+	}
+	return installed, nil
+}
+
+// RemoveKibanaPlugins removes the plugins of remove-plugins from the Kibana distribution, the bundles
+// are rebuilt by OptimizeKibana
+func (gs *Supplier) RemoveKibanaPlugins() error {
+	if len(gs.KibanaConfig.RemovePlugins) == 0 {
+		return nil
+	}
+
+	installed, err := gs.InstalledKibanaPlugins()
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range installed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range gs.KibanaConfig.RemovePlugins {
+		if _, ok := installed[name]; ok {
+			continue
+		}
+		message := fmt.Sprintf("Kibana plugin %s of remove-plugins is not installed in Kibana %s", name, gs.Kibana.Version)
+		if suggestion := util.ClosestMatch(name, names); suggestion != "" {
+			message += fmt.Sprintf(" (did you mean '%s'?)", suggestion)
+		}
+		if len(names) > 0 {
+			message += ", installed plugins: " + strings.Join(names, ", ")
+		}
+		gs.Log.Error("%s", message)
+		return errors.New("unknown plugin to remove")
+	}
+
+	gs.Log.Info("----> Removing Kibana plugins ...")
+	for _, name := range gs.KibanaConfig.RemovePlugins {
+		gs.Log.Info("       - removing plugin %s", name)
+		out, err := exec.Command(fmt.Sprintf("%s/bin/kibana-plugin", gs.Kibana.StagingLocation), "remove", name).CombinedOutput()
+		if err != nil {
+			gs.Log.Error("%s", string(out))
+			gs.Log.Error("Error removing Kibana plugin %s: %s", name, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckRemovePlugins rejects plugins which are to be installed and to be removed
+func (gs *Supplier) CheckRemovePlugins() error {
+	for _, name := range gs.KibanaConfig.RemovePlugins {
+		if _, ok := gs.PluginsToInstall[name]; ok {
+			gs.Log.Error("Kibana plugin %s is in plugins (or of a template) and in remove-plugins", name)
+			return errors.New("plugin to install and to remove")
+		}
+	}
+	return nil
+}
+
+// PluginDependencies returns the names of the buildpack dependencies the plugins are taken from: x-pack
+// for x-pack plugins and kibana-plugins for other plugins without archive of their own
+func (gs *Supplier) PluginDependencies() []string {
+	needsXPack, needsKibanaPlugins := false, false
+	for name, plugin := range gs.PluginsToInstall {
+		switch {
+		case plugin.Url != "" || plugin.File != "":
+		case strings.HasPrefix(name, "x-pack"):
+			needsXPack = true
+		default:
+			needsKibanaPlugins = true
+		}
+	}
+	dependencies := []string{}
+	if needsXPack {
+		dependencies = append(dependencies, "x-pack")
+	}
+	if needsKibanaPlugins {
+		dependencies = append(dependencies, "kibana-plugins")
+	}
+	return dependencies
+}
+
+// PrepareKibanaPlugins finds, downloads and verifies the archive of each plugin and checks
+// that it is built for the selected Kibana version, before Kibana is installed
+func (gs *Supplier) PrepareKibanaPlugins() error {
+
+	kibana, err := gs.NewDependency("kibana", 3, gs.KibanaConfig.Version)
+	if err != nil {
+		return err
+	}
 
 	xPackPlugins, _ := gs.ReadLocalPlugins(gs.XPack.StagingLocation)
 	defaultPlugins, _ := gs.ReadLocalPlugins(gs.KibanaPlugins.StagingLocation)
 	userPlugins, _ := gs.ReadLocalPlugins(gs.Stager.BuildDir() + "/plugins/")
 
-	gs.Log.Info("----> Installing Kibana plugins (this can take a few minutes!) ...")
-	for key, _ := range gs.PluginsToInstall {
+	gs.PluginDownloadDir, err = ioutil.TempDir("", "kibana-plugins")
+	if err != nil {
+		return err
+	}
+	prepared := false
+	defer func() {
+		if !prepared { // removed by InstallPluginBundle after the installation otherwise
+			os.RemoveAll(gs.PluginDownloadDir)
+		}
+	}()
+
+	gs.Log.Info("----> Checking Kibana plugins for Kibana %s ...", kibana.Version)
+	for key, plugin := range gs.PluginsToInstall {
 		//Priorisation
 		xpackPlugin := gs.GetLocalPlugin(key, xPackPlugins)
 		defaultPlugin := gs.GetLocalPlugin(key, defaultPlugins)
 		userPlugin := gs.GetLocalPlugin(key, userPlugins)
 
 		pluginToInstall := ""
-
-		if xpackPlugin != "" {
+		fromApp := false // archives of the buildpack dependencies are verified by the manifest
+
+		if plugin.File != "" {
+			pluginToInstall = filepath.Join(gs.Stager.BuildDir(), plugin.File) // Prio 0 (archive of the entry)
+			fromApp = true
+		} else if plugin.Url != "" {
+			pluginToInstall = filepath.Join(gs.PluginDownloadDir, key+".zip") // Prio 0 (download of the entry)
+			gs.Log.Info("       - downloading plugin %s from %s", key, plugin.Url)
+			if err := pluginutil.Download(plugin.Url, pluginToInstall); err != nil {
+				gs.Log.Error("Error downloading Kibana plugin %s: %s", key, err.Error())
+				return err
+			}
+			fromApp = true
+		} else if xpackPlugin != "" {
 			pluginToInstall = filepath.Join(gs.XPack.StagingLocation, xpackPlugin) // Prio 1 (offline installation)
 		} else if defaultPlugin != "" {
 			pluginToInstall = filepath.Join(gs.KibanaPlugins.StagingLocation, defaultPlugin) // Prio 2 (offline installation)
 		} else if userPlugin != "" {
 			pluginToInstall = filepath.Join(gs.Stager.BuildDir(), "plugins", userPlugin) // Prio 3 (offline installation)
+			fromApp = true
+		} else if gs.KibanaConfig.Buildpack.Offline { // reported by CheckOffline
+			return gs.offlineError([]string{fmt.Sprintf("plugin %s (not in the plugins folder, the kibana-plugins or the x-pack dependency)", key)})
 		} else {
 			pluginToInstall = key // Prio 4 (online installation)
+			if plugin.Sha256 != "" {
+				gs.Log.Error("Kibana plugin %s has a sha256 but no archive to verify, add url or file to its entry", key)
+				return errors.New("plugin archive missing")
+			}
+			gs.Log.Warning("Kibana plugin %s is installed online without checksum verification", key)
+		}
+
+		if pluginToInstall != key {
+			if err := gs.VerifyPlugin(plugin, pluginToInstall, fromApp); err != nil {
+				return err
+			}
+			if err := gs.CheckPluginCompatibility(plugin, pluginToInstall, kibana.Version); err != nil {
+				return err
+			}
+		}
+		gs.PluginArchives[key] = pluginToInstall
+	}
+
+	prepared = true
+	return nil
+}
+
+// CheckPluginCompatibility compares the Kibana version of the plugin manifest in the archive with
+// the selected Kibana version and lists the compatible Kibana versions of the buildpack on a mismatch
+func (gs *Supplier) CheckPluginCompatibility(plugin conf.Plugin, archive string, kibanaVersion string) error {
+	if !strings.HasSuffix(archive, ".zip") {
+		gs.Log.Debug("Kibana plugin %s (%s) is not a zip archive, compatibility not checked", plugin.Name, filepath.Base(archive))
+		return nil
+	}
+
+	manifest, err := pluginutil.ReadManifest(archive)
+	if err != nil {
+		gs.Log.Error("Kibana plugin %s (%s) is not a valid plugin archive: %s", plugin.Name, filepath.Base(archive), err.Error())
+		return err
+	}
+	if plugin.Version != "" && manifest.Version != plugin.Version {
+		gs.Log.Error("Kibana plugin %s (%s) has version %s, expected %s", plugin.Name, filepath.Base(archive), manifest.Version, plugin.Version)
+		return errors.New("plugin version mismatch")
+	}
+	if manifest.Compatible(kibanaVersion) {
+		return nil
+	}
+
+	compatible := []string{}
+	for _, v := range gs.Manifest.AllDependencyVersions("kibana") {
+		if manifest.Compatible(v) {
+			compatible = append(compatible, v)
 		}
+	}
+	message := fmt.Sprintf("Kibana plugin %s (%s) is built for Kibana %s, but Kibana %s is selected", plugin.Name, filepath.Base(archive), manifest.KibanaVersion, kibanaVersion)
+	if len(compatible) > 0 {
+		gs.Log.Error("%s. Compatible Kibana versions of the buildpack: %s", message, strings.Join(compatible, ", "))
+	} else {
+		gs.Log.Error("%s. No Kibana version of the buildpack is compatible, use a build of the plugin for Kibana %s", message, kibanaVersion)
+	}
+	return errors.New("incompatible plugin")
+}
+
+// PluginInstallArgs returns the arguments of kibana-plugin to install a plugin. Kibana versions with an
+// optimizer must not optimize after each plugin, OptimizeKibana builds the bundles once for all plugins.
+func PluginInstallArgs(kibanaVersion string, plugin string) []string {
+	if OptimizeSupported(kibanaVersion) {
+		return []string{"install", "--no-optimize", plugin}
+	}
+	return []string{"install", plugin}
+}
+
+func (gs *Supplier) InstallKibanaPlugins() error {
 
-		if strings.HasSuffix(pluginToInstall, ".zip") && !(strings.HasPrefix(pluginToInstall, "http://") || strings.HasPrefix(pluginToInstall, "https://")){
+	gs.Log.Info("----> Installing Kibana plugins (this can take a few minutes!) ...")
+	for key, _ := range gs.PluginsToInstall {
+		pluginToInstall := gs.PluginArchives[key]
+		if strings.HasSuffix(pluginToInstall, ".zip") && !(strings.HasPrefix(pluginToInstall, "http://") || strings.HasPrefix(pluginToInstall, "https://")) {
 			pluginToInstall = "file://" + pluginToInstall
 		}
 
 		//Install Plugin
 		gs.Log.Info("       - installing plugin %s", key)
-		out, err := exec.Command(fmt.Sprintf("%s/bin/kibana-plugin", gs.Kibana.StagingLocation), "install", pluginToInstall).CombinedOutput()
+		out, err := exec.Command(fmt.Sprintf("%s/bin/kibana-plugin", gs.Kibana.StagingLocation), PluginInstallArgs(gs.Kibana.Version, pluginToInstall)...).CombinedOutput()
 		if err != nil {
-			gs.Log.Error(string(out))
+			gs.Log.Error("%s", string(out))
 			gs.Log.Error("Error installing Kibana plugin %s: %s", key, err.Error())
 			return err
 		}
@@ -690,33 +1495,435 @@ func (gs *Supplier) InstallKibanaPlugins() error {
 	return nil
 }
 
-func (gs *Supplier) ReadLocalCertificates(filePath string) (map[string]string, error) {
+// CheckOffline fails the staging in offline mode if a dependency or a plugin would be downloaded, before
+// anything is installed, and reports all of them at once: dependencies must be in the buildpack (cached
+// buildpack) or in the application cache, plugins must not have a url, their files must be in the app and
+// plugins without archive of their own must be in the plugins folder or in the archive of a dependency.
+func (gs *Supplier) CheckOffline() error {
+	if !gs.KibanaConfig.Buildpack.Offline {
+		return nil
+	}
+	gs.Log.Info("----> Offline mode: checking that no downloads are needed ...")
 
-	var localCerts map[string]string
-	localCerts = make(map[string]string)
+	missing := []string{}
+	dependencyMissing := false
+	localPlugins := []string{}
+	for _, name := range append([]string{"kibana"}, gs.PluginDependencies()...) {
+		dependency, err := gs.NewDependency(name, 3, gs.KibanaConfig.Version)
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("dependency %s %s (not in the manifest: %s)", name, gs.KibanaConfig.Version, err.Error()))
+			continue
+		}
+		archive := gs.DependencyArchive(dependency)
+		if archive == "" {
+			missing = append(missing, fmt.Sprintf("dependency %s %s (neither in the buildpack nor in the application cache)", name, dependency.Version))
+			dependencyMissing = true
+			continue
+		}
+		if name != "kibana" {
+			entries, err := util.ArchiveEntries(archive)
+			if err != nil {
+				gs.Log.Error("Unable to read the archive of %s %s: %s", name, dependency.Version, err.Error())
+				return err
+			}
+			localPlugins = append(localPlugins, entries...)
+		}
+	}
+	userPlugins, _ := gs.ReadLocalPlugins(filepath.Join(gs.Stager.BuildDir(), "plugins"))
+	localPlugins = append(localPlugins, userPlugins...)
 
-	file, err := os.Open(filePath)
+	names := []string{}
+	for name := range gs.PluginsToInstall {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		plugin := gs.PluginsToInstall[name]
+		switch {
+		case plugin.Url != "":
+			missing = append(missing, fmt.Sprintf("plugin %s (download from %s)", name, plugin.Url))
+		case plugin.File != "":
+			if _, err := os.Stat(filepath.Join(gs.Stager.BuildDir(), plugin.File)); err != nil {
+				missing = append(missing, fmt.Sprintf("plugin %s (file %s not found)", name, plugin.File))
+			}
+		case gs.GetLocalPlugin(name, localPlugins) == "":
+			missing = append(missing, fmt.Sprintf("plugin %s (not in the plugins folder, the kibana-plugins or the x-pack dependency)", name))
+		}
+	}
+
+	if len(missing) > 0 {
+		if dependencyMissing && !gs.Manifest.IsCached() {
+			gs.Log.Error("The buildpack is not a cached buildpack, its dependencies are downloaded")
+		}
+		return gs.offlineError(missing)
+	}
+	return nil
+}
+
+// DependencyArchive returns the archive of a dependency in the application cache or in the cached buildpack,
+// the same files InstallDependency uses, or an empty string if the dependency would be downloaded
+func (gs *Supplier) DependencyArchive(dependency Dependency) string {
+	candidates := []string{filepath.Join(gs.DepCacheDir, dependency.DirName)}
+	if gs.Manifest.IsCached() {
+		if entry, err := gs.ManifestEntry(dependency); err == nil {
+			dir := filepath.Join(gs.BuildpackDir, "dependencies")
+			candidates = append(candidates, filepath.Join(dir, fmt.Sprintf("%x", md5.Sum([]byte(entry.URI))), path.Base(entry.URI)))
+			uri := entry.URI
+			if u, err := url.Parse(uri); err == nil && u.User != nil {
+				u.User = url.UserPassword("-redacted-", "-redacted-")
+				uri = u.String()
+			}
+			candidates = append(candidates, filepath.Join(dir, strings.NewReplacer("/", "_", ":", "_", "?", "_", "&", "_").Replace(uri)))
+		}
+	}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func (gs *Supplier) offlineError(missing []string) error {
+	gs.Log.Error("Offline mode: no local or cached source for:")
+	for _, m := range missing {
+		gs.Log.Error("       - %s", m)
+	}
+	gs.Log.Error("Use a cached buildpack, put the plugin archives into the app or disable offline in the buildpack section of the Kibana file")
+	return errors.New("downloads are not allowed in offline mode")
+}
+
+// OptimizeKibana builds the bundles of Kibana and its plugins during staging, so Kibana only serves the
+// pre-built bundles at startup. The optimizer uses the config rendered like at startup, as settings like
+// server.basePath or the enabled flags of plugins change the bundles. It runs without Elasticsearch and
+// exits when it is done.
+func (gs *Supplier) OptimizeKibana() error {
+	if !OptimizeSupported(gs.Kibana.Version) {
+		gs.Log.Debug("--> Kibana %s ships pre-built plugin bundles, no optimization", gs.Kibana.Version)
+		return nil
+	}
+
+	nodeOptions, err := gs.OptimizeNodeOptions()
 	if err != nil {
-		gs.Log.Error("failed opening certificates directory: %s", err)
-		return localCerts, err
+		gs.Log.Error("Unable to optimize Kibana: %s", err.Error())
+		return err
 	}
-	defer file.Close()
 
-	list, _ := file.Readdirnames(0) // 0 to read all files and folders
-	for _, name := range list {
+	workDir, err := ioutil.TempDir("", "kibana-optimize")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	configFile, err := gs.RenderOptimizeConfig(workDir)
+	if err != nil {
+		gs.Log.Error("Unable to render the Kibana config for the optimizer: %s", err.Error())
+		return err
+	}
+
+	gs.Log.Info("----> Optimizing Kibana bundles (this can take a few minutes!) ...")
+	gs.Log.Info("       Using NODE_OPTIONS=\"%s\"", nodeOptions)
+	start := time.Now()
+	out, err := gs.OptimizeCommand(configFile, nodeOptions).CombinedOutput()
+	if err != nil {
+		gs.Log.Error("%s", string(out))
+		gs.Log.Error("Error optimizing Kibana bundles: %s", err.Error())
+		return err
+	}
+	gs.Log.Debug("%s", string(out))
+	gs.Log.Info("       done in %s", time.Since(start).Round(time.Second))
+	return nil
+}
+
+// RenderOptimizeConfig renders the config of the app into workDir like the launcher does at startup and
+// returns the kibana.yml the optimizer builds the bundles with, PluginBundleKey hashes the same file
+func (gs *Supplier) RenderOptimizeConfig(workDir string) (string, error) {
+	l := gs.StagingLauncher(workDir)
+	if _, err := l.BuildConfig(); err != nil {
+		return "", err
+	}
+	return l.ConfigFile(), nil
+}
+
+// OptimizeConfigChecksum returns the checksum of the kibana.yml of the optimizer, without the paths of the
+// temporary directory it is rendered into, e.g. of the CA bundle
+func (gs *Supplier) OptimizeConfigChecksum() (string, error) {
+	workDir, err := ioutil.TempDir("", "kibana-optimize")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(workDir)
+
+	configFile, err := gs.RenderOptimizeConfig(workDir)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(strings.Replace(string(data), workDir, "", -1)))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// OptimizeCommand returns the command of the Kibana optimizer with the config file and NODE_OPTIONS
+func (gs *Supplier) OptimizeCommand(configFile string, nodeOptions string) *exec.Cmd {
+	cmd := exec.Command(filepath.Join(gs.Kibana.StagingLocation, "bin", "kibana"), "--optimize", "-c", configFile)
+	cmd.Env = append(os.Environ(), "NODE_OPTIONS="+nodeOptions)
+	return cmd
+}
+
+// OptimizeNodeOptions returns the NODE_OPTIONS of the optimizer: optimize-heap-size, or the max heap size
+// calculated from the memory of the staging container as the launcher does at runtime
+func (gs *Supplier) OptimizeNodeOptions() (string, error) {
+	heapSize := gs.KibanaConfig.OptimizeHeapSize
+	if heapSize == 0 && gs.VcapApp.Limits != nil && gs.VcapApp.Limits.Mem > 0 {
+		var err error
+		if heapSize, err = launcher.HeapSize(gs.VcapApp.Limits.Mem, gs.KibanaConfig.ReservedMemory, gs.KibanaConfig.HeapPercentage); err != nil {
+			return "", err
+		}
+	}
+	if heapSize == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("--max-old-space-size=%d", heapSize), nil
+}
+
+// OptimizeSupported returns true for Kibana versions with bin/kibana --optimize (before 7.10, newer
+// versions build the bundles of their plugins with the Kibana distribution and the plugin archives)
+func OptimizeSupported(version string) bool {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return true
+	}
+	major, err1 := strconv.Atoi(parts[0])
+	minor, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	return major < 7 || (major == 7 && minor < 10)
+}
+
+// PluginBundleKey returns the cache key of the installed plugins and the optimized bundle, a hash of the
+// Kibana version, the sorted plugins with the checksums of their archives, remove-plugins and the kibana.yml
+// of the optimizer, as settings like server.basePath change the bundles. It is calculated before anything is
+// downloaded: archives are identified by the sha256 of their entry, the checksum of the file in the app or the
+// manifest checksum of the dependency they are taken from. It returns an empty key, i.e. the plugins are not
+// cached, if a plugin is downloaded from a url without sha256.
+func (gs *Supplier) PluginBundleKey() (string, error) {
+	hash := sha256.New()
+	kibanaVersion := ""
+	for _, name := range append([]string{"kibana"}, gs.PluginDependencies()...) {
+		dependency, err := gs.NewDependency(name, 3, gs.KibanaConfig.Version)
+		if err != nil {
+			return "", err
+		}
+		entry, err := gs.ManifestEntry(dependency)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s %s %s\n", name, dependency.Version, entry.SHA256)
+		if name == "kibana" {
+			kibanaVersion = dependency.Version
+		}
+	}
+
+	if OptimizeSupported(kibanaVersion) {
+		sum, err := gs.OptimizeConfigChecksum()
+		if err != nil {
+			return "", fmt.Errorf("rendering the Kibana config for the optimizer: %s", err.Error())
+		}
+		fmt.Fprintf(hash, "config %s\n", sum)
+	}
+
+	names := []string{}
+	for name := range gs.PluginsToInstall {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	userPlugins, _ := gs.ReadLocalPlugins(filepath.Join(gs.Stager.BuildDir(), "plugins"))
+	for _, name := range names {
+		plugin := gs.PluginsToInstall[name]
+		archive := ""
+		switch {
+		case plugin.Sha256 != "":
+			fmt.Fprintf(hash, "%s sha256 %s\n", name, strings.ToLower(plugin.Sha256))
+			continue
+		case plugin.File != "":
+			archive = filepath.Join(gs.Stager.BuildDir(), plugin.File)
+		case plugin.Url != "":
+			gs.Log.Debug("--> Kibana plugin %s has no sha256, the plugins are not cached", name)
+			return "", nil
+		default:
+			// taken from a dependency, the plugins folder of the app or installed online by name
+			if userPlugin := gs.GetLocalPlugin(name, userPlugins); userPlugin != "" {
+				archive = filepath.Join(gs.Stager.BuildDir(), "plugins", userPlugin)
+			}
+		}
+		sum := "-"
+		if archive != "" {
+			var err error
+			if sum, err = pluginutil.Checksum(archive); err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintf(hash, "%s file %s\n", name, sum)
+	}
+
+	removed := append([]string{}, gs.KibanaConfig.RemovePlugins...)
+	sort.Strings(removed)
+	for _, name := range removed {
+		fmt.Fprintf(hash, "remove %s\n", name)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ManifestEntry returns the entry of a dependency in the manifest of the buildpack
+func (gs *Supplier) ManifestEntry(dependency Dependency) (libbuildpack.ManifestEntry, error) {
+	manifest := libbuildpack.Manifest{}
+	if err := libbuildpack.NewYAML().Load(filepath.Join(gs.BuildpackDir, "manifest.yml"), &manifest); err != nil {
+		return libbuildpack.ManifestEntry{}, err
+	}
+	for _, entry := range manifest.ManifestEntries {
+		if entry.Dependency.Name == dependency.Name && entry.Dependency.Version == dependency.Version {
+			return entry, nil
+		}
+	}
+	return libbuildpack.ManifestEntry{}, fmt.Errorf("dependency %s %s not found in the manifest", dependency.Name, dependency.Version)
+}
+
+// pluginBundleDir returns the name of the cache directory of the plugin bundle, it must not start
+// with the name of a dependency, as InstallDependency removes other versions of a dependency
+func pluginBundleDir(key string) string {
+	return "plugin-bundle-" + key[:16]
+}
+
+// InstallPluginBundle removes the plugins of remove-plugins from Kibana, then restores the cached plugins and
+// optimized bundle of the key, or installs the plugins, optimizes Kibana and caches the result
+func (gs *Supplier) InstallPluginBundle(key string, cached bool) error {
+	if err := gs.RemoveKibanaPlugins(); err != nil {
+		return err
+	}
+
+	if cached {
+		return gs.RestorePluginBundle(key)
+	}
+	if len(gs.PluginsToInstall) == 0 && len(gs.KibanaConfig.RemovePlugins) == 0 {
+		return nil
+	}
+	defer os.RemoveAll(gs.PluginDownloadDir)
+
+	if len(gs.PluginsToInstall) > 0 {
+		if err := gs.InstallKibanaPlugins(); err != nil {
+			return err
+		}
+	}
+	if err := gs.OptimizeKibana(); err != nil {
+		return err
+	}
+	gs.CachePluginBundle(key)
+	return nil
+}
+
+// PluginBundleCached returns true if the application cache has the plugins and the optimized bundle of
+// a previous staging with the key
+func (gs *Supplier) PluginBundleCached(key string) bool {
+	if key == "" || gs.KibanaConfig.Buildpack.NoCache {
+		return false
+	}
+	dirName := pluginBundleDir(key)
+	if _, ok := gs.CachedDeps[dirName]; !ok {
+		gs.Log.Debug("--> no cached plugin bundle %s", dirName)
+		return false
+	}
+	return true
+}
 
-		if strings.HasSuffix(name, ".crt") {
-			certParts := strings.Split(name, ".crt")
+// RestorePluginBundle copies the cached plugins and optimized bundle of the key into Kibana. The cached
+// plugin dependencies are kept for the next staging with other plugins, although they are not installed.
+func (gs *Supplier) RestorePluginBundle(key string) error {
+	gs.Log.Info("----> Restoring Kibana plugins and optimized bundle from the application cache ...")
+	dirName := pluginBundleDir(key)
+	cacheDir := filepath.Join(gs.DepCacheDir, dirName)
+	for _, dir := range []string{"plugins", "optimize"} {
+		target := filepath.Join(gs.Kibana.StagingLocation, dir)
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := libbuildpack.CopyDirectory(filepath.Join(cacheDir, dir), target); err != nil {
+			// the next staging installs the plugins again
+			os.RemoveAll(cacheDir)
+			gs.Log.Error("Error restoring the cached Kibana plugins, please restage: %s", err.Error())
+			return err
+		}
+	}
+	gs.CachedDeps[dirName] = "in use"
 
-			if len(certParts) == 2 {
-				certName := certParts[0]
-				localCerts[certName] = name
+	for _, name := range gs.PluginDependencies() {
+		if dependency, err := gs.NewDependency(name, 3, gs.KibanaConfig.Version); err == nil {
+			if _, ok := gs.CachedDeps[dependency.DirName]; ok {
+				gs.CachedDeps[dependency.DirName] = "in use"
 			}
+		}
+	}
+	return nil
+}
 
+// CachePluginBundle copies the installed plugins and the optimized bundle into the application cache, unless
+// the key is empty. A failure is only logged as the next staging installs the plugins again.
+func (gs *Supplier) CachePluginBundle(key string) {
+	if key == "" || gs.KibanaConfig.Buildpack.NoCache {
+		return
+	}
+	dirName := pluginBundleDir(key)
+	cacheDir := filepath.Join(gs.DepCacheDir, dirName)
+	for _, dir := range []string{"plugins", "optimize"} {
+		target := filepath.Join(cacheDir, dir)
+		err := os.MkdirAll(target, 0755)
+		if err == nil {
+			err = libbuildpack.CopyDirectory(filepath.Join(gs.Kibana.StagingLocation, dir), target)
+		}
+		if err != nil {
+			os.RemoveAll(cacheDir)
+			gs.Log.Warning("Unable to cache the Kibana plugins: %s", err.Error())
+			return
 		}
 	}
+	gs.Log.Debug("--> cached plugin bundle %s", dirName)
+	gs.CachedDeps[dirName] = "in use"
+}
 
-	return localCerts, nil
+// VerifyPlugin checks the archive of a plugin against the sha256 of its entry and rejects zip archives
+// with entries outside of the plugin directory. Unverified archives of the app are reported with their
+// checksum, so it can be added to the Kibana file.
+func (gs *Supplier) VerifyPlugin(plugin conf.Plugin, archive string, fromApp bool) error {
+	if plugin.Sha256 != "" {
+		if err := pluginutil.Verify(archive, plugin.Sha256); err != nil {
+			gs.Log.Error("Kibana plugin %s (%s) is rejected: %s", plugin.Name, filepath.Base(archive), err.Error())
+			return err
+		}
+		gs.Log.Info("       - verified plugin %s (sha256 %s)", plugin.Name, strings.ToLower(plugin.Sha256))
+	} else if fromApp {
+		sum, err := pluginutil.Checksum(archive)
+		if err != nil {
+			gs.Log.Error("Error reading Kibana plugin %s: %s", plugin.Name, err.Error())
+			return err
+		}
+		gs.Log.Warning("Kibana plugin %s (%s) is not verified, add 'sha256: %s' to its entry in the Kibana file", plugin.Name, filepath.Base(archive), sum)
+	}
+
+	if strings.HasSuffix(archive, ".zip") {
+		if err := pluginutil.ScanZip(archive); err != nil {
+			gs.Log.Error("Kibana plugin %s (%s) is rejected: %s", plugin.Name, filepath.Base(archive), err.Error())
+			return err
+		}
+	}
+	return nil
 }
 
 func (gs *Supplier) ReadLocalPlugins(filePath string) ([]string, error) {
@@ -735,7 +1942,9 @@ func (gs *Supplier) ReadLocalPlugins(filePath string) ([]string, error) {
 func (gs *Supplier) GetLocalPlugin(pluginName string, pluginFileNames []string) string {
 
 	for i := 0; i < len(pluginFileNames); i++ {
-		if strings.HasPrefix(pluginFileNames[i], pluginName) {
+		// the name followed by a version or the extension, my-plugin must not match my-plugin-extras-1.0.zip
+		rest := strings.TrimPrefix(pluginFileNames[i], pluginName)
+		if rest != pluginFileNames[i] && (rest == "" || strings.HasPrefix(rest, ".") || (len(rest) > 1 && (rest[0] == '-' || rest[0] == '_') && rest[1] >= '0' && rest[1] <= '9')) {
 			return pluginFileNames[i]
 		}
 	}
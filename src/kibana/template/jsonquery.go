@@ -0,0 +1,551 @@
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JsonQuery evaluates a JMESPath expression on a JSON document, e.g.
+// *[?name=='my-es'].credentials.host | [] | [0]. It supports the subset used by the templates of older
+// buildpack versions: fields (quoted if they are not identifiers), indexes (negative ones count from the end),
+// sub-expressions, the projections * and [*], filters with comparisons, &&, || and !, flatten [], pipes, @ and
+// raw string and json literals. Slices, multi-selects and functions are not supported. Missing values return nil.
+func JsonQuery(document string, expression string) (interface{}, error) {
+	var data interface{}
+	if strings.TrimSpace(document) != "" {
+		if err := json.Unmarshal([]byte(document), &data); err != nil {
+			return nil, fmt.Errorf("invalid json document: %s", err.Error())
+		}
+	}
+
+	tokens, err := lexQuery(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression '%s': %s", expression, err.Error())
+	}
+	p := &queryParser{tokens: tokens}
+	ast, err := p.expression(0)
+	if err == nil && p.peek().kind != tokEOF {
+		err = fmt.Errorf("unexpected %s", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression '%s': %s", expression, err.Error())
+	}
+	return ast.eval(data), nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokField
+	tokLiteral
+	tokNumber
+	tokDot
+	tokStar
+	tokCurrent
+	tokLbracket
+	tokRbracket
+	tokFlatten
+	tokFilter
+	tokLparen
+	tokRparen
+	tokPipe
+	tokOr
+	tokAnd
+	tokNot
+	tokCompare
+)
+
+// binding powers of the tokens, a projection stops at tokens below projectionStop
+var bindingPower = map[tokenKind]int{
+	tokPipe:     1,
+	tokOr:       2,
+	tokAnd:      3,
+	tokCompare:  5,
+	tokFlatten:  9,
+	tokStar:     20,
+	tokFilter:   21,
+	tokDot:      40,
+	tokNot:      45,
+	tokLbracket: 55,
+	tokLparen:   60,
+}
+
+const projectionStop = 10
+
+type token struct {
+	kind  tokenKind
+	text  string      // text in the expression
+	value interface{} // literal value, index or name of a quoted field
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+func lexQuery(expression string) ([]token, error) {
+	tokens := []token{}
+	s := expression
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case isIdentifierStart(c):
+			end := i + 1
+			for end < len(s) && (isIdentifierStart(s[end]) || isDigit(s[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokField, text: s[i:end]})
+			i = end
+		case isDigit(c) || (c == '-' && i+1 < len(s) && isDigit(s[i+1])):
+			end := i + 1
+			for end < len(s) && isDigit(s[end]) {
+				end++
+			}
+			n, _ := strconv.Atoi(s[i:end])
+			tokens = append(tokens, token{kind: tokNumber, text: s[i:end], value: n})
+			i = end
+		case c == '"':
+			end := closingQuote(s, i, '"')
+			if end < 0 {
+				return nil, fmt.Errorf(`missing " after position %d`, i)
+			}
+			var name string
+			if err := json.Unmarshal([]byte(s[i:end+1]), &name); err != nil {
+				return nil, fmt.Errorf("invalid quoted field %s", s[i:end+1])
+			}
+			tokens = append(tokens, token{kind: tokField, text: s[i : end+1], value: name})
+			i = end + 1
+		case c == '\'':
+			end := closingQuote(s, i, '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ' after position %d", i)
+			}
+			value := strings.Replace(s[i+1:end], `\'`, "'", -1)
+			tokens = append(tokens, token{kind: tokLiteral, text: s[i : end+1], value: value})
+			i = end + 1
+		case c == '`':
+			end := closingQuote(s, i, '`')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ` after position %d", i)
+			}
+			raw := strings.Replace(s[i+1:end], "\\`", "`", -1)
+			var value interface{}
+			if err := json.Unmarshal([]byte(raw), &value); err != nil {
+				return nil, fmt.Errorf("invalid json literal %s", s[i:end+1])
+			}
+			tokens = append(tokens, token{kind: tokLiteral, text: s[i : end+1], value: value})
+			i = end + 1
+		case strings.HasPrefix(s[i:], "[]"):
+			tokens = append(tokens, token{kind: tokFlatten, text: "[]"})
+			i += 2
+		case strings.HasPrefix(s[i:], "[?"):
+			tokens = append(tokens, token{kind: tokFilter, text: "[?"})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, token{kind: tokOr, text: "||"})
+			i += 2
+		case strings.HasPrefix(s[i:], "&&"):
+			tokens = append(tokens, token{kind: tokAnd, text: "&&"})
+			i += 2
+		case strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") || strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">="):
+			tokens = append(tokens, token{kind: tokCompare, text: s[i : i+2]})
+			i += 2
+		case c == '<' || c == '>':
+			tokens = append(tokens, token{kind: tokCompare, text: s[i : i+1]})
+			i++
+		default:
+			kinds := map[byte]tokenKind{'.': tokDot, '*': tokStar, '@': tokCurrent, '[': tokLbracket, ']': tokRbracket,
+				'(': tokLparen, ')': tokRparen, '|': tokPipe, '!': tokNot}
+			kind, ok := kinds[c]
+			if !ok {
+				return nil, fmt.Errorf("unsupported character '%c'", c)
+			}
+			tokens = append(tokens, token{kind: kind, text: string(c)})
+			i++
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+// closingQuote returns the position of the quote closing the one at start, skipping escaped quotes
+func closingQuote(s string, start int, quote byte) int {
+	for i := start + 1; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == quote {
+			return i
+		}
+	}
+	return -1
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// queryParser is a top down operator precedence parser like the one of the JMESPath reference implementation
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryParser) expect(kind tokenKind, what string) error {
+	if t := p.next(); t.kind != kind {
+		return fmt.Errorf("expected %s, got %s", what, t)
+	}
+	return nil
+}
+
+func (p *queryParser) expression(bp int) (queryNode, error) {
+	left, err := p.nud(p.next())
+	if err != nil {
+		return nil, err
+	}
+	for bp < bindingPower[p.peek().kind] {
+		if left, err = p.led(p.next(), left); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+// nud parses a token at the start of an expression
+func (p *queryParser) nud(t token) (queryNode, error) {
+	switch t.kind {
+	case tokField:
+		return fieldNode(fieldName(t)), nil
+	case tokLiteral:
+		return literalNode{t.value}, nil
+	case tokCurrent:
+		return currentNode{}, nil
+	case tokStar:
+		return p.projection(objectProjection, currentNode{}, nil, bindingPower[tokStar])
+	case tokFlatten:
+		return p.projection(flattenProjection, currentNode{}, nil, bindingPower[tokFlatten])
+	case tokFilter:
+		return p.led(t, currentNode{})
+	case tokLbracket:
+		return p.led(t, currentNode{})
+	case tokNot:
+		operand, err := p.expression(bindingPower[tokNot])
+		return notNode{operand}, err
+	case tokLparen:
+		inner, err := p.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(tokRparen, "')'")
+	}
+	return nil, fmt.Errorf("unexpected %s", t)
+}
+
+// led parses a token following the expression left
+func (p *queryParser) led(t token, left queryNode) (queryNode, error) {
+	switch t.kind {
+	case tokDot:
+		if p.peek().kind == tokStar {
+			p.next()
+			return p.projection(objectProjection, left, nil, bindingPower[tokDot])
+		}
+		right, err := p.dotRhs()
+		return subexpressionNode{left, right}, err
+	case tokLbracket:
+		switch p.peek().kind {
+		case tokNumber:
+			index := p.next().value.(int)
+			return subexpressionNode{left, indexNode(index)}, p.expect(tokRbracket, "']'")
+		case tokStar:
+			p.next()
+			if err := p.expect(tokRbracket, "']'"); err != nil {
+				return nil, err
+			}
+			return p.projection(listProjection, left, nil, bindingPower[tokStar])
+		}
+		return nil, fmt.Errorf("only indexes and [*] are supported in brackets, got %s", p.peek())
+	case tokFlatten:
+		return p.projection(flattenProjection, left, nil, bindingPower[tokFlatten])
+	case tokFilter:
+		condition, err := p.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRbracket, "']'"); err != nil {
+			return nil, err
+		}
+		return p.projection(filterProjection, left, condition, bindingPower[tokFilter])
+	case tokPipe:
+		right, err := p.expression(bindingPower[tokPipe])
+		return pipeNode{left, right}, err
+	case tokOr, tokAnd:
+		right, err := p.expression(bindingPower[t.kind])
+		return logicNode{t.kind == tokAnd, left, right}, err
+	case tokCompare:
+		right, err := p.expression(bindingPower[tokCompare])
+		return compareNode{t.text, left, right}, err
+	}
+	return nil, fmt.Errorf("unexpected %s", t)
+}
+
+// dotRhs parses the field after a dot
+func (p *queryParser) dotRhs() (queryNode, error) {
+	t := p.next()
+	if t.kind != tokField {
+		return nil, fmt.Errorf("expected a field after '.', got %s", t)
+	}
+	return fieldNode(fieldName(t)), nil
+}
+
+// projection parses the expression applied to each element of a projection, up to a token which
+// stops projections like | or []
+func (p *queryParser) projection(kind projectionKind, left queryNode, condition queryNode, bp int) (queryNode, error) {
+	node := projectionNode{kind: kind, left: left, condition: condition, right: currentNode{}}
+	switch next := p.peek().kind; {
+	case bindingPower[next] < projectionStop:
+	case next == tokLbracket || next == tokFilter:
+		right, err := p.expression(bp)
+		if err != nil {
+			return nil, err
+		}
+		node.right = right
+	case next == tokDot:
+		p.next()
+		if p.peek().kind != tokField {
+			return nil, fmt.Errorf("expected a field after '.', got %s", p.peek())
+		}
+		right, err := p.expression(bp)
+		if err != nil {
+			return nil, err
+		}
+		node.right = right
+	default:
+		return nil, fmt.Errorf("unexpected %s after projection", p.peek())
+	}
+	return node, nil
+}
+
+func fieldName(t token) string {
+	if name, ok := t.value.(string); ok {
+		return name
+	}
+	return t.text
+}
+
+type queryNode interface {
+	eval(data interface{}) interface{}
+}
+
+type currentNode struct{}
+
+func (currentNode) eval(data interface{}) interface{} {
+	return data
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n literalNode) eval(interface{}) interface{} {
+	return n.value
+}
+
+type fieldNode string
+
+func (n fieldNode) eval(data interface{}) interface{} {
+	if object, ok := data.(map[string]interface{}); ok {
+		return object[string(n)]
+	}
+	return nil
+}
+
+type indexNode int
+
+func (n indexNode) eval(data interface{}) interface{} {
+	list, ok := data.([]interface{})
+	if !ok {
+		return nil
+	}
+	i := int(n)
+	if i < 0 {
+		i += len(list)
+	}
+	if i < 0 || i >= len(list) {
+		return nil
+	}
+	return list[i]
+}
+
+type subexpressionNode struct {
+	left, right queryNode
+}
+
+func (n subexpressionNode) eval(data interface{}) interface{} {
+	if value := n.left.eval(data); value != nil {
+		return n.right.eval(value)
+	}
+	return nil
+}
+
+type pipeNode struct {
+	left, right queryNode
+}
+
+func (n pipeNode) eval(data interface{}) interface{} {
+	return n.right.eval(n.left.eval(data))
+}
+
+type projectionKind int
+
+const (
+	listProjection projectionKind = iota
+	objectProjection
+	flattenProjection
+	filterProjection
+)
+
+type projectionNode struct {
+	kind                   projectionKind
+	left, condition, right queryNode
+}
+
+// eval applies the right expression to the elements of the left value, results without value are dropped
+func (n projectionNode) eval(data interface{}) interface{} {
+	value := n.left.eval(data)
+	elements := []interface{}{}
+	switch n.kind {
+	case objectProjection:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		keys := []string{}
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			elements = append(elements, object[key])
+		}
+	default:
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for _, element := range list {
+			switch {
+			case n.kind == flattenProjection:
+				if inner, ok := element.([]interface{}); ok {
+					elements = append(elements, inner...)
+				} else {
+					elements = append(elements, element)
+				}
+			case n.kind == filterProjection:
+				if truthy(n.condition.eval(element)) {
+					elements = append(elements, element)
+				}
+			default:
+				elements = append(elements, element)
+			}
+		}
+	}
+
+	result := []interface{}{}
+	for _, element := range elements {
+		if value := n.right.eval(element); value != nil {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+type notNode struct {
+	operand queryNode
+}
+
+func (n notNode) eval(data interface{}) interface{} {
+	return !truthy(n.operand.eval(data))
+}
+
+type logicNode struct {
+	and         bool
+	left, right queryNode
+}
+
+// eval returns the left value if it decides the result, the right value otherwise
+func (n logicNode) eval(data interface{}) interface{} {
+	left := n.left.eval(data)
+	if truthy(left) != n.and {
+		return left
+	}
+	return n.right.eval(data)
+}
+
+type compareNode struct {
+	op          string
+	left, right queryNode
+}
+
+func (n compareNode) eval(data interface{}) interface{} {
+	left, right := n.left.eval(data), n.right.eval(data)
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(left, right)
+	case "!=":
+		return !reflect.DeepEqual(left, right)
+	}
+	a, ok1 := left.(float64)
+	b, ok2 := right.(float64)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	switch n.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	}
+	return a >= b
+}
+
+// truthy returns false for false, null and empty strings, lists and objects like JMESPath
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
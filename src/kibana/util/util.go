@@ -1,9 +1,16 @@
 package util
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"io"
 	"regexp"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 func TrimLines(text string) string {
@@ -28,4 +35,111 @@ func RemoveAllContents(dir string) error {
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// ClosestMatch returns the candidate with the smallest edit distance to name (ignoring case),
+// or an empty string if no candidate is close enough to be a likely typo
+func ClosestMatch(name string, candidates []string) string {
+	sorted := append([]string{}, candidates...)
+	sort.Strings(sorted)
+
+	best := ""
+	bestDistance := len(name)/3 + 2
+	for _, candidate := range sorted {
+		if d := levenshtein(strings.ToLower(name), strings.ToLower(candidate)); d < bestDistance {
+			best = candidate
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+func levenshtein(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	result := values[0]
+	for _, v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+	return result
+}
+
+// ArchiveEntries returns the sorted names of the top-level files and directories of a zip or tar.gz archive,
+// the format is detected from the content as cached dependencies have no file extension
+func ArchiveEntries(archive string) ([]string, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic, err := reader.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	if string(magic) == "PK" {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		z, err := zip.NewReader(file, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range z.File {
+			names = append(names, f.Name)
+		}
+	} else {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		t := tar.NewReader(gz)
+		for {
+			header, err := t.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, header.Name)
+		}
+	}
+
+	seen := map[string]bool{}
+	entries := []string{}
+	for _, name := range names {
+		name = strings.SplitN(strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/"), "/", 2)[0]
+		if name != "" && name != "." && !seen[name] {
+			seen[name] = true
+			entries = append(entries, name)
+		}
+	}
+	sort.Strings(entries)
+	return entries, nil
+}